@@ -1,37 +1,177 @@
+// Package bsign implements RSA blind signatures used for authorizing ballots.
+//
+// Scheme follows RFC 9474 (RSABSSA-SHA384-PSS-Deterministic). Message is encoded
+// with EMSA-PSS (SHA-384, MGF1 with SHA-384, 48 bytes of salt) before blinding, so
+// final signature is an ordinary RSASSA-PSS signature of the ballot.
+// Ballots are random values generated by client, so deterministic variant
+// (without message randomizer) is sufficient here.
+//
+// Protocol looks as follows:
+//   client: envelope, inv := Blind(pk, ballot)
+//   server: blindsig := Sign(sk, envelope)
+//   client: sign := Finalize(pk, ballot, blindsig, inv)
+//   anyone: Verify(pk, ballot, sign)
 package bsign
 
 import (
+	"crypto"
+	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/subtle"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"math/big"
 )
 
-// Sign is signing ballot provided by client.
+// Parameters of the PSS encoding.
+const (
+	hashFunc   = crypto.SHA384
+	saltLength = 48
+)
+
+// Blind prepares ballot to be signed by server.
 //
-// Function takes key and ballot. It returns ballot^d mod N.
-func Sign(key *rsa.PrivateKey, in []byte) *big.Int {
+// Ballot is encoded using EMSA-PSS and multiplied by r^e mod N, where r is random.
+// Function returns envelope, which should be sent to server, and inverse of r,
+// which is later needed in Finalize.
+func Blind(key *rsa.PublicKey, ballot []byte) ([]byte, *big.Int, error) {
+	salt := make([]byte, saltLength)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, nil, err
+	}
+	em, err := encodePSS(ballot, salt, key.N.BitLen()-1)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := rand.Int(rand.Reader, key.N)
+	if err != nil {
+		return nil, nil, err
+	}
+	return blind(key, em, r)
+}
+
+// blind multiplies encoded message em by r^e mod N.
+func blind(key *rsa.PublicKey, em []byte, r *big.Int) ([]byte, *big.Int, error) {
+	m := new(big.Int).SetBytes(em)
+	// Message not coprime with N would reveal factorization of N, it should never happen.
+	if new(big.Int).GCD(nil, nil, m, key.N).Cmp(big.NewInt(1)) != 0 {
+		return nil, nil, fmt.Errorf("Error! Encoded ballot is not invertible mod N.")
+	}
+
+	inv := new(big.Int).ModInverse(r, key.N)
+	if inv == nil {
+		return nil, nil, fmt.Errorf("Error! Blinding factor is not invertible mod N.")
+	}
+
+	// envelope = m*(r^e) mod N
+	x := new(big.Int).Exp(r, big.NewInt(int64(key.E)), key.N)
+	z := x.Mod(x.Mul(x, m), key.N)
+	return z.FillBytes(make([]byte, key.Size())), inv, nil
+}
+
+// Sign is signing envelope (blinded ballot) provided by client.
+//
+// Function takes key and envelope. It returns envelope^d mod N.
+// Result is checked before returning, so faulty computation never leaks the key.
+func Sign(key *rsa.PrivateKey, envelope []byte) ([]byte, error) {
+	if len(envelope) == 0 {
+		return nil, fmt.Errorf("Error! Envelope is empty.")
+	}
+	m := new(big.Int).SetBytes(envelope)
+	if m.Cmp(key.N) >= 0 {
+		return nil, fmt.Errorf("Error! Envelope is not smaller than N.")
+	}
+
 	// Calculate m^d to generate sign for client.
-	m := new(big.Int).SetBytes(in)
-	return m.Exp(m, key.D, key.PublicKey.N)
+	s := new(big.Int).Exp(m, key.D, key.N)
+	check := new(big.Int).Exp(s, big.NewInt(int64(key.E)), key.N)
+	if check.Cmp(m) != 0 {
+		return nil, fmt.Errorf("Error! Signing envelope failed.")
+	}
+	return s.FillBytes(make([]byte, key.Size())), nil
 }
 
-// Verify check if the sign is Valid.
+// Finalize removes blinding factor from signed envelope.
 //
-// Input is a public key corresponding to key used for signing and sign, which is a pair
-// of numbers mod N. Sign is valid if hash(m) = (md)^e mod N.
-func Verify(key *rsa.PublicKey, m []byte, md []byte) bool {
-	mi := new(big.Int).SetBytes(m)
-	// We check if hash(m) = (md)^e mod N.
-	// If sign is correct, md = hash(m)^d and equality is satisfied.
-	// For frontend reasons we are hashing here decimal representation of m.
-	hash := sha256.Sum256([]byte(mi.Text(10)))
-	// Calculate md^e mod N
-	mdi := new(big.Int).SetBytes(md)
-	bhi := new(big.Int).Exp(mdi, big.NewInt(int64(key.E)), key.N)
-
-	if subtle.ConstantTimeCompare(bhi.Bytes(), hash[:]) >= 1 {
-		return true
-	}
-	return false
+// Inv is a value returned by Blind. Returned sign is checked with Verify,
+// so client knows that server signed the right ballot.
+func Finalize(key *rsa.PublicKey, ballot, signedEnvelope []byte, inv *big.Int) ([]byte, error) {
+	if len(signedEnvelope) != key.Size() {
+		return nil, fmt.Errorf("Error! Signed envelope has wrong length.")
+	}
+	// Having (m^d)*r mod N we are removing blinding factor r.
+	z := new(big.Int).SetBytes(signedEnvelope)
+	s := z.Mod(z.Mul(z, inv), key.N)
+	sign := s.FillBytes(make([]byte, key.Size()))
+
+	if !Verify(key, ballot, sign) {
+		return nil, fmt.Errorf("Error! Signature of ballot is invalid.")
+	}
+	return sign, nil
+}
+
+// Verify check if the sign is valid.
+//
+// Input is a public key corresponding to key used for signing, ballot and sign.
+// Sign is valid if it is a proper RSASSA-PSS signature of ballot.
+func Verify(key *rsa.PublicKey, ballot []byte, sign []byte) bool {
+	hash := sha512.Sum384(ballot)
+	err := rsa.VerifyPSS(key, hashFunc, hash[:], sign, &rsa.PSSOptions{
+		SaltLength: saltLength,
+		Hash:       hashFunc,
+	})
+	return err == nil
+}
+
+// encodePSS is EMSA-PSS-ENCODE from RFC 8017 with SHA-384 and MGF1.
+func encodePSS(msg, salt []byte, emBits int) ([]byte, error) {
+	hLen := hashFunc.Size()
+	emLen := (emBits + 7) / 8
+	if emLen < hLen+saltLength+2 {
+		return nil, fmt.Errorf("Error! Key is too short for PSS encoding.")
+	}
+
+	if len(salt) != saltLength {
+		return nil, fmt.Errorf("Error! Salt has wrong length.")
+	}
+
+	mHash := sha512.Sum384(msg)
+
+	// H = Hash(0x00 * 8 || mHash || salt)
+	h := hashFunc.New()
+	h.Write(make([]byte, 8))
+	h.Write(mHash[:])
+	h.Write(salt)
+	hashed := h.Sum(nil)
+
+	// EM = maskedDB || H || 0xbc, where DB = PS || 0x01 || salt.
+	em := make([]byte, emLen)
+	db := em[:emLen-hLen-1]
+	db[len(db)-saltLength-1] = 0x01
+	copy(db[len(db)-saltLength:], salt)
+	mgf1XOR(db, hashed)
+	db[0] &= 0xff >> uint(8*emLen-emBits)
+	copy(em[emLen-hLen-1:], hashed)
+	em[emLen-1] = 0xbc
+	return em, nil
+}
+
+// mgf1XOR xors out with MGF1 mask generated from seed.
+func mgf1XOR(out []byte, seed []byte) {
+	var counter [4]byte
+	done := 0
+	for i := uint32(0); done < len(out); i++ {
+		binary.BigEndian.PutUint32(counter[:], i)
+		h := hashFunc.New()
+		h.Write(seed)
+		h.Write(counter[:])
+		for _, b := range h.Sum(nil) {
+			if done >= len(out) {
+				break
+			}
+			out[done] ^= b
+			done++
+		}
+	}
 }
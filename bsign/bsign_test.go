@@ -0,0 +1,135 @@
+package bsign
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+func fromHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("Invalid hex %v: %v", s, err)
+	}
+	return b
+}
+
+func TestVectors(t *testing.T) {
+	for _, test := range testsVectors {
+
+		t.Run(test.name, func(t *testing.T) {
+			key := &rsa.PrivateKey{
+				PublicKey: rsa.PublicKey{
+					N: new(big.Int).SetBytes(fromHex(t, test.n)),
+					E: 65537,
+				},
+				D: new(big.Int).SetBytes(fromHex(t, test.d)),
+				Primes: []*big.Int{
+					new(big.Int).SetBytes(fromHex(t, test.p)),
+					new(big.Int).SetBytes(fromHex(t, test.q)),
+				},
+			}
+			if err := key.Validate(); err != nil {
+				t.Fatalf("Invalid key in test vector: %v", err)
+			}
+			msg := fromHex(t, test.msg)
+
+			em, err := encodePSS(msg, fromHex(t, test.salt), key.N.BitLen()-1)
+			if err != nil || !bytes.Equal(em, fromHex(t, test.encoded)) {
+				t.Errorf("Encoded message %x, want %v", em, test.encoded)
+				t.Errorf("Error %v, want nil error", err)
+			}
+
+			expinv := new(big.Int).SetBytes(fromHex(t, test.inv))
+			r := new(big.Int).ModInverse(expinv, key.N)
+			envelope, inv, err := blind(&key.PublicKey, em, r)
+			if err != nil || !bytes.Equal(envelope, fromHex(t, test.blinded)) || inv.Cmp(expinv) != 0 {
+				t.Errorf("Envelope %x, want %v", envelope, test.blinded)
+				t.Errorf("Error %v, want nil error", err)
+			}
+
+			blindsig, err := Sign(key, envelope)
+			if err != nil || !bytes.Equal(blindsig, fromHex(t, test.blind_sig)) {
+				t.Errorf("Blind signature %x, want %v", blindsig, test.blind_sig)
+				t.Errorf("Error %v, want nil error", err)
+			}
+
+			sign, err := Finalize(&key.PublicKey, msg, blindsig, inv)
+			if err != nil || !bytes.Equal(sign, fromHex(t, test.sig)) {
+				t.Errorf("Signature %x, want %v", sign, test.sig)
+				t.Errorf("Error %v, want nil error", err)
+			}
+			if !Verify(&key.PublicKey, msg, fromHex(t, test.sig)) {
+				t.Errorf("Signature from test vector is not valid")
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	ballot := []byte("ballot")
+
+	envelope, inv, err := Blind(&key.PublicKey, ballot)
+	if err != nil {
+		t.Fatalf("Error %v in Blind, want nil error", err)
+	}
+	blindsig, err := Sign(key, envelope)
+	if err != nil {
+		t.Fatalf("Error %v in Sign, want nil error", err)
+	}
+	sign, err := Finalize(&key.PublicKey, ballot, blindsig, inv)
+	if err != nil {
+		t.Fatalf("Error %v in Finalize, want nil error", err)
+	}
+	if !Verify(&key.PublicKey, ballot, sign) {
+		t.Errorf("Valid signature was rejected")
+	}
+
+	if Verify(&key.PublicKey, []byte("ballou"), sign) {
+		t.Errorf("Signature of tampered ballot was accepted")
+	}
+	if Verify(&other.PublicKey, ballot, sign) {
+		t.Errorf("Signature was accepted with wrong key")
+	}
+	if _, err := Finalize(&other.PublicKey, ballot, blindsig, inv); err == nil {
+		t.Errorf("Finalize accepted envelope signed with wrong key")
+	}
+	othersig, err := Sign(other, envelope)
+	if err != nil {
+		t.Fatalf("Error %v in Sign, want nil error", err)
+	}
+	if _, err := Finalize(&key.PublicKey, ballot, othersig, inv); err == nil {
+		t.Errorf("Finalize accepted envelope signed with wrong key")
+	}
+}
+
+func TestSign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	for _, test := range testsSign {
+
+		t.Run(test.name, func(t *testing.T) {
+			var envelope []byte
+			if !test.empty {
+				envelope = new(big.Int).Add(key.N, big.NewInt(test.offset)).Bytes()
+			}
+			_, err := Sign(key, envelope)
+			if err == nil || err.Error() != test.exp_err {
+				t.Errorf("Error %v, want error %v", err, test.exp_err)
+			}
+		})
+	}
+}
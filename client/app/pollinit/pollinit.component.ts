@@ -3,8 +3,20 @@ import { Router } from '@angular/router';
 
 import { grpc } from '@improbable-eng/grpc-web';
 import { Query } from "Projekt_Rada/query/query_pb_service";
-import { PollQuestion, PollSchema } from "Projekt_Rada/query/query_pb";
-import { QAListToSchema } from "../proto_parsing";
+import { CreateFromTemplateRequest,
+         ExportFile,
+         ExportRequest,
+         ListTemplatesRequest,
+         PollInitReply,
+         PollInitRequest,
+         PollMetadata,
+         PollRequest,
+         PollSchema,
+         PollTemplate,
+         SaveTemplateRequest,
+         TemplateList,
+         TokenExport } from "Projekt_Rada/query/query_pb";
+import { QAListToSchema, toMetadata } from "../proto_parsing";
 import { host } from '../host';
 
 @Component({
@@ -17,20 +29,105 @@ export class PollInitComponent {
       optionsList: [""],
       type: PollSchema.QuestionType.OPEN,
       answersList: [""],
+      min: 0,
+      max: 0,
+      step: 0,
+      required: false,
+      minSelections: 0,
+      maxSelections: 0,
+      maxLength: 0,
+      section: 0,
+      showIf: undefined,
+      shuffle: false,
+      optionIdsList: [],
     },
   ];
 
+  // Questions are grouped into sections, question has number of its section.
+  sectionsList: PollSchema.Section.AsObject[] = [];
+
+  // Title, description (Markdown) and language of the poll, time of creation is set by server.
+  metadata: PollMetadata.AsObject = {
+    title: "",
+    description: "",
+    created: 0,
+    locale: "pl",
+    author: "",
+    translationsList: [],
+  };
+
+  // Number of voting tokens generated for the poll.
+  tokensCount: number = 100;
+
+  // Listed poll is shown to everyone in list of polls.
+  listed: boolean = false;
+
+  // Saved templates, poll can be created from one of them instead of questions above.
+  templatesList: PollTemplate.AsObject[] = [];
+  templateId: number;
+
+  // Templates belong to owner identified by owner key returned with the first poll.
+  // Polls created with owner key belong to the same owner.
+  ownerKey: string = "";
+
   constructor (private router: Router) {}
 
+  loadTemplates() {
+    grpc.unary(Query.ListTemplates, {
+      request: new ListTemplatesRequest(),
+      host: host,
+      metadata: new grpc.Metadata({"rada-owner-key": this.ownerKey}),
+      onEnd: res => {
+        const { status, statusMessage, headers, message, trailers } = res;
+        if (status === grpc.Code.OK && message) {
+          this.templatesList = (<TemplateList> message).toObject().templatesList;
+        } else {
+          alert("Błąd\n" + statusMessage);
+        }
+      }
+    });
+  }
+
   addQuestion() {
     this.questionsList.push({
       question: "",
       optionsList: [""],
       type: PollSchema.QuestionType.OPEN,
       answersList: [""],
+      min: 0,
+      max: 0,
+      step: 0,
+      required: false,
+      minSelections: 0,
+      maxSelections: 0,
+      maxLength: 0,
+      section: 0,
+      showIf: undefined,
+      shuffle: false,
+      optionIdsList: [],
+    });
+  }
+
+  addSection() {
+    this.sectionsList.push({
+      title: "",
+      description: "",
     });
   }
 
+  // Question can be shown depending on answer to earlier checkbox or closed question.
+  toggleCondition(index: number) {
+    let qa = this.questionsList[index];
+    qa.showIf = qa.showIf ? undefined : { question: 0, optionsList: [] };
+  }
+
+  // Questions which can be referred by condition of index-th question.
+  conditionQuestions(index: number) {
+    return this.questionsList
+      .map((qa, i) => ({ qa: qa, i: i }))
+      .filter(q => q.i < index && (q.qa.type == PollSchema.QuestionType.CHECKBOX || q.qa.type == PollSchema.QuestionType.CLOSE));
+  }
+
   addOption(index: number) {
     console.log(index)
     this.questionsList[index].optionsList.push("");
@@ -47,20 +144,123 @@ export class PollInitComponent {
     }
   }
 
+  saveTemplate() {
+    let name = prompt('Nazwa szablonu');
+    if (!name) {
+      return;
+    }
+    let request: SaveTemplateRequest = new SaveTemplateRequest();
+    request.setName(name);
+    let schema: PollSchema = QAListToSchema(this.questionsList, this.sectionsList);
+    schema.setListed(this.listed);
+    request.setSchema(schema);
+    request.setMetadata(toMetadata(this.metadata));
+    grpc.unary(Query.SaveTemplate, {
+      request: request,
+      host: host,
+      metadata: new grpc.Metadata({"rada-owner-key": this.ownerKey}),
+      onEnd: res => {
+        const { status, statusMessage, headers, message, trailers } = res;
+        if (status === grpc.Code.OK && message) {
+          this.templatesList.push((<PollTemplate> message).toObject());
+        } else {
+          alert("Błąd\n" + statusMessage);
+        }
+      }
+    });
+  }
+
+  // Poll created from template gets its own keys and tokens, like any other new poll.
+  createFromTemplate() {
+    let request: CreateFromTemplateRequest = new CreateFromTemplateRequest();
+    request.setTemplateId(this.templateId);
+    request.setTokens(this.tokensCount);
+    grpc.unary(Query.CreateFromTemplate, {
+      request: request,
+      host: host,
+      metadata: new grpc.Metadata({"rada-owner-key": this.ownerKey}),
+      onEnd: res => {
+        const { status, statusMessage, headers, message, trailers } = res;
+        if (status === grpc.Code.OK && message) {
+          this.pollCreated(<PollInitReply> message);
+        } else {
+          alert("Błąd\n" + statusMessage);
+        }
+      }
+    });
+  }
+
   sendPoll() {
-    const schema: PollSchema = QAListToSchema(this.questionsList);
+    const schema: PollSchema = QAListToSchema(this.questionsList, this.sectionsList);
+    schema.setListed(this.listed);
+    let request: PollInitRequest = new PollInitRequest();
+    request.setSchema(schema);
+    request.setMetadata(toMetadata(this.metadata));
+    request.setTokens(this.tokensCount);
+    // Without owner key server creates new owner and sends its key.
+    let metadata = new grpc.Metadata();
+    if (this.ownerKey) {
+      metadata.set("rada-owner-key", this.ownerKey);
+    }
     grpc.unary(Query.PollInit, {
-      request: schema,
+      request: request,
+      host: host,
+      metadata: metadata,
+      onEnd: res => {
+        const { status, statusMessage, headers, message, trailers } = res;
+        if (status === grpc.Code.OK && message) {
+          this.pollCreated(<PollInitReply> message);
+        }
+      }
+    });
+  }
+
+  pollCreated(response: PollInitReply) {
+    let pollid: string = response.getId();
+    // Admin key is sent only once, creator has to keep it to manage the poll.
+    this.download("klucz_administratora_" + pollid + ".txt", [response.getAdminKey()]);
+    if (response.getOwnerKey()) {
+      this.ownerKey = response.getOwnerKey();
+      this.download("klucz_wlasciciela.txt", [this.ownerKey]);
+    }
+    this.exportTokens(pollid, response.getAdminKey());
+  }
+
+  // Tokens are available only to poll's owner, so admin key is sent with request.
+  exportTokens(pollid: string, adminKey: string) {
+    let request: PollRequest = new PollRequest();
+    request.setPollid(pollid);
+    grpc.unary(Query.ExportTokens, {
+      request: request,
+      host: host,
+      metadata: new grpc.Metadata({"rada-admin-key": adminKey}),
+      onEnd: res => {
+        const { status, statusMessage, headers, message, trailers } = res;
+        if (status === grpc.Code.OK && message) {
+          let tokens = (<TokenExport> message).getTokensList();
+          this.download("tokeny_" + pollid + ".txt", tokens);
+          this.exportLinks(pollid, adminKey);
+        }
+      }
+    });
+  }
+
+  // Voting links with embedded tokens are exported as CSV file.
+  exportLinks(pollid: string, adminKey: string) {
+    let request: ExportRequest = new ExportRequest();
+    request.setPollid(pollid);
+    request.setFormat(ExportRequest.Format.CSV);
+    grpc.unary(Query.ExportVotingLinks, {
+      request: request,
       host: host,
+      metadata: new grpc.Metadata({"rada-admin-key": adminKey}),
       onEnd: res => {
         const { status, statusMessage, headers, message, trailers } = res;
         if (status === grpc.Code.OK && message) {
-          let response = (<PollQuestion> message);
-          let tokens = response.getTokensList();
-          let pollid: number = response.getId();
-          this.download("tokeny_" + pollid.toString() + ".txt", tokens);
-          this.router.navigate(['/results', pollid]);
+          let file = (<ExportFile> message);
+          this.download(file.getName(), [new TextDecoder().decode(file.getData_asU8())]);
         }
+        this.router.navigate(['/results', pollid]);
       }
     });
   }
@@ -1,23 +1,69 @@
-import { EnvelopeToSign, PollSchema, RSASignature, VoteRequest } from "Projekt_Rada/query/query_pb";
+import { Ballot, EnvelopeToSign, PollMetadata, PollSchema, RSASignature, VoteRequest } from "Projekt_Rada/query/query_pb";
+import { md, util } from 'node-forge';
 
-export function QAListToSchema(questionsList: PollSchema.QA.AsObject[]) {
+export function QAListToSchema(questionsList: PollSchema.QA.AsObject[], sectionsList: PollSchema.Section.AsObject[] = []) {
   let schema = new PollSchema();
+  for (let sec of sectionsList){
+    const section = new PollSchema.Section();
+    section.setTitle(sec.title);
+    section.setDescription(sec.description);
+    schema.addSections(section);
+  }
   for (let qa of questionsList){
     const QA = new PollSchema.QA();
     QA.setQuestion(qa.question);
-    QA.setType(qa.type as 0 | 1 | 2);
+    QA.setType(qa.type as 0 | 1 | 2 | 3 | 4 | 5);
     QA.setOptionsList(qa.optionsList);
     QA.setAnswersList(qa.answersList);
+    QA.setMin(qa.min);
+    QA.setMax(qa.max);
+    QA.setStep(qa.step);
+    QA.setRequired(qa.required);
+    QA.setMinSelections(qa.minSelections);
+    QA.setMaxSelections(qa.maxSelections);
+    QA.setMaxLength(qa.maxLength);
+    QA.setSection(qa.section);
+    QA.setShuffle(qa.shuffle);
+    QA.setOptionIdsList(qa.optionIdsList);
+    if (qa.showIf) {
+      const cond = new PollSchema.Condition();
+      cond.setQuestion(qa.showIf.question);
+      cond.setOptionsList(qa.showIf.optionsList);
+      QA.setShowIf(cond);
+    }
     schema.addQuestions(QA);
   }
   return schema
 }
 
-export function toEnvelope(envelope: string, pollid: number, token: string) {
+export function toMetadata(metadata: PollMetadata.AsObject) {
+  let md = new PollMetadata();
+  md.setTitle(metadata.title);
+  md.setDescription(metadata.description);
+  md.setLocale(metadata.locale);
+  md.setAuthor(metadata.author);
+  for (let tr of metadata.translationsList) {
+    const translation = new PollMetadata.Translation();
+    translation.setLocale(tr.locale);
+    translation.setTitle(tr.title);
+    translation.setDescription(tr.description);
+    for (let qt of tr.questionsList) {
+      const question = new PollMetadata.QuestionTranslation();
+      question.setQuestion(qt.question);
+      question.setOptionsList(qt.optionsList);
+      translation.addQuestions(question);
+    }
+    md.addTranslations(translation);
+  }
+  return md;
+}
+
+export function toEnvelope(envelope: string, pollid: string, token: string, sig: string) {
   let request: EnvelopeToSign = new EnvelopeToSign();
   request.setEnvelope(hexToBase64(envelope))
   request.setPollid(pollid)
   request.setToken(token)
+  request.setSig(sig)
   return request
 }
 
@@ -29,15 +75,118 @@ export function toRSASignature(ballot, sign: string) {
   return signature;
 }
 
-export function toVoteRequest(pollid: number, schema: PollSchema, signature: RSASignature) {
+export function toVoteRequest(pollid: string, ballot: Ballot.AsObject, signature: RSASignature, nonce: string, weight: number) {
   let request: VoteRequest = new VoteRequest();
 
   request.setPollid(pollid)
-  request.setAnswers(schema)
+  request.setBallot(toBallot(ballot))
   request.setSign(signature)
+  request.setNonce(btoa(nonce))
+  request.setWeight(weight)
   return request
 }
 
+// Version of ballot encoding, has to match BallotVersion in query/ballot.go.
+// Options are selected by their IDs, so display order doesn't matter.
+export const ballotVersion = 2;
+
+// ID of j-th option, like PollSchema_QA.OptionID in query/query_utils.go.
+export function optionId(qa: PollSchema.QA.AsObject, j: number) {
+  return qa.optionIdsList.length ? qa.optionIdsList[j] : j;
+}
+
+// Converts answers in legacy form into a compact ballot, like NewBallot in query/ballot.go.
+// Questions without an answer are omitted.
+export function QAListToBallot(questionsList: PollSchema.QA.AsObject[]) {
+  let ballot: Ballot.AsObject = { version: ballotVersion, answersList: [] };
+  questionsList.forEach((qa, i) => {
+    let ans: Ballot.Answer.AsObject = { question: i, selectedList: [], text: "", number: 0 };
+    let answered = false;
+    switch (qa.type) {
+      case PollSchema.QuestionType.OPEN:
+        ans.text = qa.answersList[0] || "";
+        answered = ans.text != "";
+        break;
+      case PollSchema.QuestionType.CHECKBOX:
+      case PollSchema.QuestionType.CLOSE:
+        qa.answersList.forEach((a, j) => {
+          if (a == "true") {
+            ans.selectedList.push(optionId(qa, j));
+          }
+        });
+        answered = ans.selectedList.length > 0;
+        break;
+      case PollSchema.QuestionType.RANKED:
+        answered = qa.answersList.some(a => a);
+        ans.selectedList = answered ? qa.answersList.map(a => optionId(qa, parseInt(a))) : [];
+        break;
+      case PollSchema.QuestionType.NUMBER:
+      case PollSchema.QuestionType.SCALE:
+        answered = qa.answersList.length > 0 && qa.answersList[0] != "";
+        ans.number = answered ? parseFloat(qa.answersList[0]) : 0;
+        break;
+    }
+    if (answered) {
+      ballot.answersList.push(ans);
+    }
+  });
+  return ballot;
+}
+
+function toBallot(ballot: Ballot.AsObject) {
+  let b: Ballot = new Ballot();
+  b.setVersion(ballot.version);
+  for (let ans of ballot.answersList) {
+    let a = new Ballot.Answer();
+    a.setQuestion(ans.question);
+    a.setSelectedList(ans.selectedList);
+    a.setText(ans.text);
+    a.setNumber(ans.number);
+    b.addAnswers(a);
+  }
+  return b;
+}
+
+// Ballot is a commitment to answers: SHA-256 hash of nonce and compact answers.
+// Calculation has to match Ballot.Commitment in query/ballot.go.
+// Nonce and returned ballot are binary strings.
+export function ballotCommitment(ballot: Ballot.AsObject, nonce: string) {
+  let sha256 = md.sha256.create();
+  sha256.update("Rada ballot v2");
+  writeBytes(sha256, nonce);
+  sha256.update(uint32ToBytes(ballot.version));
+  sha256.update(uint32ToBytes(ballot.answersList.length));
+  for (let ans of ballot.answersList) {
+    sha256.update(uint32ToBytes(ans.question));
+    sha256.update(uint32ToBytes(ans.selectedList.length));
+    for (let opt of ans.selectedList) {
+      sha256.update(uint32ToBytes(opt));
+    }
+    writeBytes(sha256, util.encodeUtf8(ans.text));
+    sha256.update(float64ToBytes(ans.number));
+  }
+  return sha256.digest().getBytes();
+}
+
+function writeBytes(sha256, bytes: string) {
+  sha256.update(uint32ToBytes(bytes.length));
+  sha256.update(bytes);
+}
+
+function uint32ToBytes(n: number) {
+  return String.fromCharCode((n >>> 24) & 255, (n >>> 16) & 255, (n >>> 8) & 255, n & 255);
+}
+
+function float64ToBytes(x: number) {
+  let view = new DataView(new ArrayBuffer(8));
+  view.setFloat64(0, x);
+  let bytes = "";
+  for (let i = 0; i < 8; i++) {
+    bytes += String.fromCharCode(view.getUint8(i));
+  }
+  return bytes;
+}
+
 function hexToBase64(hexstring) {
     return btoa(hexstring.match(/\w{2}/g).map(function(a) {
         return String.fromCharCode(parseInt(a, 16));
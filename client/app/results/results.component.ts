@@ -13,17 +13,19 @@ import { host } from '../host';
 })
 export class ResultsComponent {
   summary: PollSummary.AsObject;
+  // Set when server refuses to show results, e.g. before poll is closed.
+  errorMessage: string;
 
   // Each entry in this array is an input for graph regarding question with matching index.
   // Graph input is array of arrays consisting of at pair [key, value].
   graphsInput: any[] = [];
 
-  pollid: number;
-  inpid: number;
+  pollid: string;
+  inpid: string;
 
   constructor (private route: ActivatedRoute, private router: Router) {
-    this.pollid = parseInt(this.route.snapshot.paramMap.get('pollid'));
-    if(!isNaN(this.pollid)){
+    this.pollid = this.route.snapshot.paramMap.get('pollid');
+    if(this.pollid){
       let request: SummaryRequest = new SummaryRequest();
       request.setPollid(this.pollid);
 
@@ -35,6 +37,8 @@ export class ResultsComponent {
           if (status === grpc.Code.OK && message) {
             this.summary = (<PollSummary>message).toObject()
             this.getGraphsInput()
+          } else {
+            this.errorMessage = statusMessage;
           }
         }
       });
@@ -50,8 +54,18 @@ export class ResultsComponent {
   }
 
   getGraphsInput() {
-    for (let qa of this.summary.schema.questionsList) {
+    for (let [index, qa] of this.summary.schema.questionsList.entries()) {
       let graphInp = []; 
+      let numeric = this.numericResult(index);
+      if (numeric) {
+        // Histogram bins are labeled with their ranges.
+        for (let bin of numeric.histogramList) {
+          let label = bin.from == bin.to ? String(bin.from) : bin.from + " - " + bin.to;
+          graphInp.push([label, bin.count]);
+        }
+        this.graphsInput.push(graphInp)
+        continue;
+      }
       for(let [i, opt] of qa.optionsList.entries()) {
         graphInp.push([opt, parseInt(qa.answersList[i])]);
       }
@@ -60,6 +74,16 @@ export class ResultsComponent {
     console.log(this.summary)
   }
 
+  // Returns statistics of numeric question with given index.
+  numericResult(index: number) {
+    return this.summary.numericList.find(r => r.question == index);
+  }
+
+  // Returns instant-runoff tally of ranked question with given index.
+  rankedResult(index: number) {
+    return this.summary.rankedList.find(r => r.question == index);
+  }
+
   get diagnostic() { return JSON.stringify(this.summary); }
 
   onSubmit() {}
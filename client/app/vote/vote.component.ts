@@ -4,19 +4,28 @@ import { ActivatedRoute,
 
 import { grpc } from '@improbable-eng/grpc-web';
 import { Query } from "Projekt_Rada/query/query_pb_service";
-import { EnvelopeToSign, 
+import { Ballot,
+         EnvelopeToSign, 
          GetPollRequest, 
+         ListPollsRequest,
+         PollList,
+         PollListing,
+         PollStatus,
+         PollMetadata,
          PollSchema, 
          PollWithPublicKey, 
          RSASignature,
          SignedEnvelope, 
+         TokenRequest,
+         TokenWeight,
          VoteRequest } from "Projekt_Rada/query/query_pb";
-import { QAListToSchema,
+import { QAListToBallot,
+         ballotCommitment,
          toEnvelope,
          toRSASignature,
          toVoteRequest } from "../proto_parsing";
 import { host } from '../host';
-import { pki, md } from 'node-forge';
+import { pki, md, mgf, pss, random, util } from 'node-forge';
 import * as bigInt from 'big-integer';
 
 @Component({
@@ -25,20 +34,46 @@ import * as bigInt from 'big-integer';
 })
 export class VoteComponent {
   questionsList: PollSchema.QA.AsObject[];
+  sectionsList: PollSchema.Section.AsObject[] = [];
+  metadata: PollMetadata.AsObject;
+  // Order in which options of every question are displayed, answers are kept in schema order.
+  optionsOrder: number[][] = [];
   
-  publickey; //PublicKey
+  publickey; //PublicKey of token's weight class
+  publickeys = new Map<number, any>(); // Keys of all weight classes.
+  weight: number;
 
   token: string;
+  sig: string; // Signature of token from voting link, server refuses tokens without it.
+  fromLink: boolean = false; // Page was opened with voting link.
+  votingLink: string; // Voting link pasted by voter.
 
-  ballot: bigInt.BigInteger;
+  answers: Ballot.AsObject; // Answers in compact form.
+  ballot: string; // Binary string, commitment to answers.
+  nonce: string; // Binary string.
   r: bigInt.BigInteger;
 
-  pollid: number;
-  inpid: number;
+  pollid: string;
+  inpid: string;
+
+  // Open polls shown when poll is not chosen yet, searched by title.
+  pollsList: PollListing.AsObject[] = [];
+  searchTitle: string = "";
+  nextPageToken: string = "";
 
   constructor (private route: ActivatedRoute, private router: Router) {
-    this.pollid = parseInt(this.route.snapshot.paramMap.get('pollid'));
-    if(!isNaN(this.pollid)){
+    this.pollid = this.route.snapshot.paramMap.get('pollid');
+    // Voting links contain token, it was verified by server when serving the page.
+    let token = this.route.snapshot.queryParamMap.get('token');
+    if (token) {
+      this.token = token;
+      this.sig = this.route.snapshot.queryParamMap.get('sig');
+      this.fromLink = true;
+    }
+    if(!this.pollid){
+      this.listPolls(false);
+    }
+    if(this.pollid){
       let request: GetPollRequest = new GetPollRequest();
       request.setPollid(this.pollid);
       grpc.unary(Query.GetPoll, {
@@ -49,10 +84,17 @@ export class VoteComponent {
           if (status === grpc.Code.OK && message) {
             let pollwithkey: PollWithPublicKey.AsObject = (<PollWithPublicKey>message).toObject()
             this.questionsList = pollwithkey.poll.questionsList;
-            let pempublickey = "-----BEGIN RSA PUBLIC KEY-----\n" +
-                               pollwithkey.key.key.toString() +
-                               "-----END RSA PUBLIC KEY-----";
-            this.publickey = pki.publicKeyFromPem(pempublickey);
+            this.sectionsList = pollwithkey.poll.sectionsList;
+            this.metadata = pollwithkey.metadata;
+            this.translate(navigator.language);
+            this.optionsOrder = this.questionsList.map(qa => {
+              let order = qa.optionsList.map((opt, j) => j);
+              return qa.shuffle ? shuffle(order) : order;
+            });
+            this.publickeys.set(1, toPublicKey(pollwithkey.key.key));
+            for (let wk of pollwithkey.weightedKeysList) {
+              this.publickeys.set(wk.weight, toPublicKey(wk.key.key));
+            }
           }
         }
       });
@@ -63,39 +105,155 @@ export class VoteComponent {
     this.router.navigate(['/vote', this.inpid]);
   }
 
+  // Lists open polls, next pages are appended to the list.
+  listPolls(nextPage: boolean) {
+    let request: ListPollsRequest = new ListPollsRequest();
+    request.setStatesList([PollStatus.State.OPEN]);
+    request.setTitle(this.searchTitle);
+    if (nextPage) {
+      request.setPageToken(this.nextPageToken);
+    } else {
+      this.pollsList = [];
+    }
+    grpc.unary(Query.ListPolls, {
+      request: request,
+      host: host,
+      onEnd: res => {
+        const { status, statusMessage, headers, message, trailers } = res;
+        if (status === grpc.Code.OK && message) {
+          let list: PollList.AsObject = (<PollList>message).toObject();
+          this.pollsList = this.pollsList.concat(list.pollsList);
+          this.nextPageToken = list.nextPageToken;
+        }
+      }
+    });
+  }
+
   trackOption(index: number, option: string) {
     return index;
   }
 
+  // Texts of poll are shown in voter's language, if poll has translation to it.
+  // Only displayed texts change, ballot refers to questions and options by numbers.
+  translate(language: string) {
+    if (!this.metadata || !language) {
+      return;
+    }
+    let lang = language.toLowerCase();
+    let tr = this.metadata.translationsList.find(t => t.locale.toLowerCase() == lang) ||
+             this.metadata.translationsList.find(t => t.locale.toLowerCase() == lang.split("-")[0]);
+    if (!tr) {
+      return;
+    }
+    this.metadata.title = tr.title || this.metadata.title;
+    this.metadata.description = tr.description || this.metadata.description;
+    tr.questionsList.forEach((qt, i) => {
+      let qa = this.questionsList[i];
+      qa.question = qt.question || qa.question;
+      qt.optionsList.forEach((opt, j) => {
+        qa.optionsList[j] = opt || qa.optionsList[j];
+      });
+    });
+  }
+
+  // Title of section is shown before its first question.
+  sectionStarts(i: number): boolean {
+    let section = this.questionsList[i].section;
+    return section < this.sectionsList.length && (i == 0 || this.questionsList[i - 1].section != section);
+  }
+
+  // Question is shown if it has no condition, or question referred by condition
+  // is shown and has any of condition's options selected (see PollSchema.Visible
+  // in query/query_utils.go). Answers have form used by inputs, before onSubmit parses them.
+  visible(i: number): boolean {
+    let cond = this.questionsList[i].showIf;
+    if (!cond) {
+      return true;
+    }
+    if (cond.question >= i || !this.visible(cond.question)) {
+      return false;
+    }
+    let dep = this.questionsList[cond.question];
+    return cond.optionsList.some(opt => {
+      if (dep.type == PollSchema.QuestionType.CLOSE) {
+        return dep.answersList[0] !== undefined && dep.answersList[0] !== "" && parseInt(dep.answersList[0]) == opt;
+      }
+      return dep.answersList[opt] == "true";
+    });
+  }
+
+  // Voting link pasted by voter carries token and its signature.
+  readVotingLink(): boolean {
+    try {
+      let params = new URL(this.votingLink).searchParams;
+      this.token = params.get('token');
+      this.sig = params.get('sig');
+    } catch (e) {
+      return false;
+    }
+    return !!this.token && !!this.sig;
+  }
+
   onSubmit() {
+    if (!this.fromLink && !this.readVotingLink()) {
+      alert("Błąd\nNieprawidłowy link do głosowania");
+      return;
+    }
     if (confirm('Czy chcesz wysłać odpowiedź?')) {
+      // Skipped questions can't be answered, so their answers are removed.
+      let shown = this.questionsList.map((qa, i) => this.visible(i));
       // Parse input
-      for(let qa of this.questionsList){
+      this.questionsList.forEach((qa, i) => {
+        if(!shown[i]){
+          qa.answersList = [];
+          return;
+        }
         // If question is close, then first answer field is containing id of selected answer.
         if(qa.type==PollSchema.QuestionType.CLOSE){
           qa.answersList = qa.answersList.map((ans, index) => {
             return parseInt(qa.answersList[0])==index?"true":"false";
           })
         }
+        // If question is ranked, answers contain place of each option,
+        // server expects options ordered from the most preferred one.
+        if(qa.type==PollSchema.QuestionType.RANKED && qa.answersList.some(ans => ans)){
+          let ranking = qa.answersList.map(ans => "");
+          qa.answersList.forEach((place, index) => {
+            ranking[parseInt(place) - 1] = index.toString();
+          })
+          qa.answersList = ranking;
+        }
+        // Number inputs give numbers, server expects one string or no answer.
+        if(qa.type==PollSchema.QuestionType.NUMBER || qa.type==PollSchema.QuestionType.SCALE){
+          let ans = qa.answersList[0];
+          qa.answersList = (ans === undefined || ans === null || ans === "") ? [] : [String(ans)];
+        }
         // If question is checkbox, we want to replace empty strings to false answer
         if(qa.type==PollSchema.QuestionType.CHECKBOX){
           qa.answersList = qa.answersList.map((ans, index) => {
             return ans==""?"false":ans;
           })
         }
-      }
+      });
 
-      let envelope = this.calculateEnvelope()
-      let request: EnvelopeToSign = toEnvelope(envelope.toString(16), this.pollid, this.token);
-    
-      grpc.unary(Query.SignBallot, {
+      // Token's weight decides which key signs the ballot.
+      let request: TokenRequest = new TokenRequest();
+      request.setPollid(this.pollid);
+      request.setToken(this.token);
+      request.setSig(this.sig);
+      grpc.unary(Query.GetTokenWeight, {
         request: request,
         host: host,
         onEnd: res => {
           const { status, statusMessage, headers, message, trailers } = res;
           if (status === grpc.Code.OK && message) {
-            let signedEnvelope: SignedEnvelope.AsObject = (<SignedEnvelope>message).toObject()
-            this.sendVote(signedEnvelope)
+            this.weight = Math.max((<TokenWeight>message).getWeight(), 1);
+            this.publickey = this.publickeys.get(this.weight);
+            if (this.publickey) {
+              this.signBallot();
+            } else {
+              alert("Błąd\nBrak klucza dla wagi " + this.weight);
+            }
           }
           else {
             alert("Błąd\n" + statusMessage)
@@ -105,12 +263,37 @@ export class VoteComponent {
     }
   }
 
+  signBallot() {
+    // Ballot commits to answers, so signature can't be used for other answers.
+    this.nonce = random.getBytesSync(32);
+    this.answers = QAListToBallot(this.questionsList);
+    this.ballot = ballotCommitment(this.answers, this.nonce);
+
+    let envelope = this.calculateEnvelope()
+    let size = Math.ceil(this.publickey.n.bitLength() / 8);
+    let request: EnvelopeToSign = toEnvelope(envelope.toString(16).padStart(2 * size, '0'), this.pollid, this.token, this.sig);
+  
+    grpc.unary(Query.SignBallot, {
+      request: request,
+      host: host,
+      onEnd: res => {
+        const { status, statusMessage, headers, message, trailers } = res;
+        if (status === grpc.Code.OK && message) {
+          let signedEnvelope: SignedEnvelope.AsObject = (<SignedEnvelope>message).toObject()
+          this.sendVote(signedEnvelope)
+        }
+        else {
+          alert("Błąd\n" + statusMessage)
+        }
+      }
+    });
+  }
+
   sendVote(senv: SignedEnvelope.AsObject) {
     let sign = this.calculateSign(senv.sign);
 
-    let schema: PollSchema = QAListToSchema(this.questionsList);
-    let signature: RSASignature = toRSASignature(this.ballot.toString(16), sign.toString(16));
-    let request: VoteRequest = toVoteRequest(this.pollid, schema, signature);
+    let signature: RSASignature = toRSASignature(util.bytesToHex(this.ballot), sign);
+    let request: VoteRequest = toVoteRequest(this.pollid, this.answers, signature, this.nonce, this.weight);
     
     grpc.unary(Query.PollVote, {
       request: request,
@@ -125,16 +308,19 @@ export class VoteComponent {
   }
 
   calculateEnvelope(){
-    // Generate ballot to be signed.
     let N = bigInt.call({}, this.publickey.n.toString())
     let e = bigInt.call({}, this.publickey.e.toString()) // Should be always 65537
-    this.ballot = bigInt.randBetween(bigInt.call({}, "2"), N);
 
-    // We are hashing ballot.
-    let sha256 = md.sha256.create();
-    sha256.update(this.ballot.toString())
-    let hash = sha256.digest().toHex()
-    let m = bigInt.call({}, hash, 16)
+    // Ballot is encoded using EMSA-PSS with SHA-384 (RFC 9474).
+    let sha384 = md.sha384.create();
+    sha384.update(this.ballot);
+    let encoder = pss.create({
+      md: md.sha384.create(),
+      mgf: mgf.mgf1.create(md.sha384.create()),
+      saltLength: 48
+    });
+    let encoded = encoder.encode(sha384, this.publickey.n.bitLength());
+    let m = bigInt.call({}, util.bytesToHex(encoded), 16)
 
     // Get random blinding factor.
     this.r = bigInt.randBetween(bigInt.call({}, "2"), N);
@@ -156,12 +342,30 @@ export class VoteComponent {
     // Now we can calculate second part of sign.
     // sign = smrevr mod N = m^d mod N
     let sign = smrevr.mod(N)
-    return sign;
+    // Sign has to be as long as the modulus.
+    let size = Math.ceil(this.publickey.n.bitLength() / 8);
+    return sign.toString(16).padStart(2 * size, '0');
   }
 
   get diagnostic() { return JSON.stringify(this.questionsList); }
 }
 
+// Fisher-Yates shuffle, every voter sees options in his own order.
+function shuffle(order: number[]) {
+  for (let i = order.length - 1; i > 0; i--) {
+    let j = Math.floor(Math.random() * (i + 1));
+    [order[i], order[j]] = [order[j], order[i]];
+  }
+  return order;
+}
+
+function toPublicKey(key: string | Uint8Array) {
+  let pempublickey = "-----BEGIN RSA PUBLIC KEY-----\n" +
+                     key.toString() +
+                     "-----END RSA PUBLIC KEY-----";
+  return pki.publicKeyFromPem(pempublickey);
+}
+
 function base64ToHex(str) {
   const raw = atob(str);
   let result = '';
@@ -0,0 +1,181 @@
+// Package links turns voting tokens into links, which can be handed out to voters.
+//
+// Link points at /vote/{pollid} page of web client and carries token with
+// signature of the server:
+//   {base}/vote/{pollid}?token={token}&sig={sig}
+// Signature is HMAC-SHA256 of poll id and token computed with poll's link key,
+// so server can refuse links, which it did not issue. Signature is checked
+// also when token is spent, so token is usable only together with its link.
+// Link is as one-time as the token it contains.
+//
+// Links can be rendered as QR codes (PNG and SVG) and exported in bulk as CSV
+// file or as ZIP archive with one printable PDF page per token.
+package links
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+	"rsc.io/qr"
+)
+
+// KeySize is a size of link key in bytes.
+const KeySize = 32
+
+// Link is a voting link for one token.
+type Link struct {
+	Token string
+	URL   string
+}
+
+// Sign calculates signature of a voting link.
+func Sign(key []byte, pollid string, token string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(pollid))
+	mac.Write([]byte{0})
+	mac.Write([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks if sig is a valid signature of a voting link.
+func Verify(key []byte, pollid string, token, sig string) bool {
+	return hmac.Equal([]byte(Sign(key, pollid, token)), []byte(sig))
+}
+
+// New creates signed voting link for token.
+//
+// Base is an address of web client, e.g. https://rada.example.com.
+func New(base string, key []byte, pollid string, token string) Link {
+	q := url.Values{}
+	q.Set("token", token)
+	q.Set("sig", Sign(key, pollid, token))
+	return Link{
+		Token: token,
+		URL:   strings.TrimRight(base, "/") + "/vote/" + pollid + "?" + q.Encode(),
+	}
+}
+
+// QRPNG renders link as QR code in PNG format.
+func QRPNG(link Link) ([]byte, error) {
+	code, err := qr.Encode(link.URL, qr.M)
+	if err != nil {
+		return nil, fmt.Errorf("Error in QRPNG while encoding link: %w", err)
+	}
+	return code.PNG(), nil
+}
+
+// QRSVG renders link as QR code in SVG format.
+//
+// Each black module of the code is drawn as a unit square, image has a margin
+// of 4 modules required by QR specification.
+func QRSVG(link Link) (string, error) {
+	code, err := qr.Encode(link.URL, qr.M)
+	if err != nil {
+		return "", fmt.Errorf("Error in QRSVG while encoding link: %w", err)
+	}
+	size := code.Size + 8
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+4, y+4)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String(), nil
+}
+
+// CSV exports links as CSV file with columns token and url.
+func CSV(links []Link) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"token", "url"})
+	for _, l := range links {
+		w.Write([]string{l.Token, l.URL})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, fmt.Errorf("Error in CSV while writing links: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ZIP exports links as ZIP archive of PDF files, one for each link.
+//
+// Archive contains also links.csv file created by CSV.
+func ZIP(pollid string, links []Link) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	binCSV, err := CSV(links)
+	if err != nil {
+		return nil, err
+	}
+	f, err := zw.Create("links.csv")
+	if err != nil {
+		return nil, fmt.Errorf("Error in ZIP while creating file: %w", err)
+	}
+	if _, err = f.Write(binCSV); err != nil {
+		return nil, fmt.Errorf("Error in ZIP while writing file: %w", err)
+	}
+
+	for i, l := range links {
+		binPDF, err := PDF(pollid, l)
+		if err != nil {
+			return nil, err
+		}
+		f, err := zw.Create(fmt.Sprintf("token_%04d.pdf", i+1))
+		if err != nil {
+			return nil, fmt.Errorf("Error in ZIP while creating file: %w", err)
+		}
+		if _, err = f.Write(binPDF); err != nil {
+			return nil, fmt.Errorf("Error in ZIP while writing file: %w", err)
+		}
+	}
+
+	if err = zw.Close(); err != nil {
+		return nil, fmt.Errorf("Error in ZIP while closing archive: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// PDF renders printable A4 page with QR code, link and token.
+func PDF(pollid string, link Link) ([]byte, error) {
+	png, err := QRPNG(link)
+	if err != nil {
+		return nil, err
+	}
+
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.AddPage()
+	pdf.SetFont("Helvetica", "B", 20)
+	pdf.CellFormat(0, 12, "Poll "+pollid, "", 1, "C", false, 0, "")
+
+	opt := gofpdf.ImageOptions{ImageType: "PNG"}
+	pdf.RegisterImageOptionsReader("qr", opt, bytes.NewReader(png))
+	pdf.ImageOptions("qr", 55, 30, 100, 100, false, opt, 0, "")
+
+	pdf.SetY(140)
+	pdf.SetFont("Courier", "", 10)
+	pdf.MultiCell(0, 5, link.URL, "", "C", false)
+	pdf.Ln(5)
+	pdf.SetFont("Helvetica", "", 12)
+	pdf.CellFormat(0, 8, "Token: "+link.Token, "", 1, "C", false, 0, "")
+
+	var buf bytes.Buffer
+	if err = pdf.Output(&buf); err != nil {
+		return nil, fmt.Errorf("Error in PDF while rendering page: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,269 @@
+package query
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Versions of Ballot encoding. In version 1 options are selected by their
+// positions in schema, in version 2 by their IDs.
+const (
+	BallotVersionPositions = 1
+	BallotVersionIDs       = 2
+)
+
+// BallotVersion is a current version of Ballot encoding.
+const BallotVersion = BallotVersionIDs
+
+// ballotDomain separates commitments to ballots from commitments to legacy answers.
+const ballotDomain = "Rada ballot v2"
+
+// NewBallot converts answers in legacy form (whole schema with filled answers) into a Ballot.
+//
+// Answers should be checked with ValidateAnswers first. Questions without
+// an answer are omitted. Legacy answers are given by positions of options,
+// so returned ballot uses version BallotVersionPositions.
+func NewBallot(answers *PollSchema) (*Ballot, error) {
+	b := &Ballot{Version: BallotVersionPositions}
+	for i, qa := range answers.GetQuestions() {
+		ans := &Ballot_Answer{Question: int32(i)}
+		answered := false
+		switch qa.Type {
+		case PollSchema_OPEN:
+			if len(qa.Answers) > 0 && qa.Answers[0] != "" {
+				ans.Text = qa.Answers[0]
+				answered = true
+			}
+
+		case PollSchema_CHECKBOX, PollSchema_CLOSE:
+			for j, a := range qa.Answers {
+				// Unchecked options may be sent as empty strings.
+				if a == "" {
+					continue
+				}
+				v, err := strconv.ParseBool(a)
+				if err != nil {
+					return nil, fmt.Errorf("Error in question %v: Error! Answer is not a boolean value.", i+1)
+				}
+				if v {
+					ans.Selected = append(ans.Selected, int32(j))
+				}
+			}
+			answered = len(ans.Selected) > 0
+
+		case PollSchema_RANKED:
+			ranking, err := qa.Ranking()
+			if err != nil {
+				return nil, fmt.Errorf("Error in question %v: %w", i+1, err)
+			}
+			for _, opt := range ranking {
+				ans.Selected = append(ans.Selected, int32(opt))
+			}
+			answered = ranking != nil
+
+		case PollSchema_NUMBER, PollSchema_SCALE:
+			v, ok, err := qa.Number()
+			if err != nil {
+				return nil, fmt.Errorf("Error in question %v: %w", i+1, err)
+			}
+			ans.Number = v
+			answered = ok
+
+		default:
+			return nil, fmt.Errorf("Error in question %v: Error! Wrong question type.", i+1)
+		}
+		if answered {
+			b.Answers = append(b.Answers, ans)
+		}
+	}
+	return b, nil
+}
+
+// answers checks if ballot b contains answer to question with given number.
+func (b *Ballot) answers(question int32) bool {
+	for _, ans := range b.GetAnswers() {
+		if ans.Question == question {
+			return true
+		}
+	}
+	return false
+}
+
+// Commitment calculates ballot binding answers in compact form to a vote.
+//
+// It works like PollSchema.Commitment, but hashes version of encoding and,
+// for every answer, number of question, selected options, text and number.
+func (b *Ballot) Commitment(nonce []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(ballotDomain))
+	writeBytes(h, nonce)
+	writeUint32(h, int(b.GetVersion()))
+	writeUint32(h, len(b.GetAnswers()))
+	for _, ans := range b.GetAnswers() {
+		writeUint32(h, int(ans.Question))
+		writeUint32(h, len(ans.Selected))
+		for _, opt := range ans.Selected {
+			writeUint32(h, int(opt))
+		}
+		writeBytes(h, []byte(ans.Text))
+		bits := math.Float64bits(ans.Number)
+		writeUint32(h, int(bits>>32))
+		writeUint32(h, int(bits))
+	}
+	return h.Sum(nil)
+}
+
+// Positions converts ballot b for poll with schema t into version BallotVersionPositions.
+//
+// Options selected by IDs are replaced by their positions in schema. Ballot
+// which already uses positions is returned unchanged.
+func (t *PollSchema) Positions(b *Ballot) (*Ballot, error) {
+	switch b.GetVersion() {
+	case BallotVersionPositions:
+		return b, nil
+	case BallotVersionIDs:
+	default:
+		return nil, fmt.Errorf("Error! Unknown ballot version %v.", b.GetVersion())
+	}
+
+	res := &Ballot{Version: BallotVersionPositions}
+	for _, ans := range b.Answers {
+		a := proto.Clone(ans).(*Ballot_Answer)
+		// Numbers of questions are checked by ValidateBallot.
+		if ans.Question >= 0 && int(ans.Question) < len(t.Questions) {
+			qa := t.Questions[ans.Question]
+			for k, id := range ans.Selected {
+				pos := qa.optionPosition(id)
+				if pos < 0 {
+					return nil, fmt.Errorf("Error in question %v: Error! Invalid option selected.", ans.Question+1)
+				}
+				a.Selected[k] = int32(pos)
+			}
+		}
+		res.Answers = append(res.Answers, a)
+	}
+	return res, nil
+}
+
+// ValidateBallot checks if b is a valid ballot for poll with schema t.
+//
+// Answers have to refer to existing questions in increasing order. OPEN
+// question has only text, CHECKBOX and CLOSE have distinct existing options
+// selected, RANKED has a ranking of all options and NUMBER and SCALE have
+// a number within range of question.
+func (t *PollSchema) ValidateBallot(b *Ballot) error {
+	b, err := t.Positions(b)
+	if err != nil {
+		return err
+	}
+	last := int32(-1)
+	for _, ans := range b.GetAnswers() {
+		if ans.Question <= last || int(ans.Question) >= len(t.Questions) {
+			return fmt.Errorf("Error! Invalid question number %v.", ans.Question)
+		}
+		last = ans.Question
+		if err := t.Questions[ans.Question].validateBallotAnswer(ans); err != nil {
+			return fmt.Errorf("Error in question %v: %w", ans.Question+1, err)
+		}
+	}
+	return nil
+}
+
+// validateBallotAnswer checks if ans is an answer to question qa.
+func (qa *PollSchema_QA) validateBallotAnswer(ans *Ballot_Answer) error {
+	textual := qa.Type == PollSchema_OPEN
+	selective := qa.Type == PollSchema_CHECKBOX || qa.Type == PollSchema_CLOSE || qa.Type == PollSchema_RANKED
+	numeric := qa.Type == PollSchema_NUMBER || qa.Type == PollSchema_SCALE
+	if !textual && ans.Text != "" {
+		return fmt.Errorf("Error! Text answer to question which is not open.")
+	}
+	if !selective && len(ans.Selected) > 0 {
+		return fmt.Errorf("Error! Options selected in question without options.")
+	}
+	if !numeric && ans.Number != 0 {
+		return fmt.Errorf("Error! Number answer to question which is not numeric.")
+	}
+
+	switch qa.Type {
+	case PollSchema_OPEN:
+		if !IsStringPrintable(ans.Text) {
+			return fmt.Errorf("Error! Answer contains non-printable characters.")
+		}
+
+	case PollSchema_CHECKBOX, PollSchema_CLOSE, PollSchema_RANKED:
+		seen := make([]bool, len(qa.Options))
+		for _, opt := range ans.Selected {
+			if opt < 0 || int(opt) >= len(qa.Options) {
+				return fmt.Errorf("Error! Invalid option selected.")
+			}
+			if seen[opt] {
+				return fmt.Errorf("Error! Option selected more than once.")
+			}
+			seen[opt] = true
+		}
+		if qa.Type == PollSchema_RANKED && len(ans.Selected) != len(qa.Options) {
+			return fmt.Errorf("Error! Ranking has to contain all options.")
+		}
+
+	case PollSchema_NUMBER, PollSchema_SCALE:
+		return qa.checkNumber(ans.Number)
+
+	default:
+		return fmt.Errorf("Error! Wrong question type.")
+	}
+	return nil
+}
+
+// ToSchema converts ballot b for poll with schema t into legacy form.
+//
+// Returned schema is a copy of questions of t with answers filled in, so it
+// can be used with CheckConstraints or displayed. Ballot should be checked
+// with ValidateBallot first.
+func (b *Ballot) ToSchema(t *PollSchema) (*PollSchema, error) {
+	b, err := t.Positions(b)
+	if err != nil {
+		return nil, err
+	}
+	res := &PollSchema{Questions: make([]*PollSchema_QA, len(t.GetQuestions()))}
+	for i, qa := range t.GetQuestions() {
+		q := proto.Clone(qa).(*PollSchema_QA)
+		q.Answers = nil
+		res.Questions[i] = q
+	}
+	for _, ans := range b.GetAnswers() {
+		if ans.Question < 0 || int(ans.Question) >= len(res.Questions) {
+			return nil, fmt.Errorf("Error! Invalid question number %v.", ans.Question)
+		}
+		qa := res.Questions[ans.Question]
+		switch qa.Type {
+		case PollSchema_OPEN:
+			qa.Answers = []string{ans.Text}
+
+		case PollSchema_CHECKBOX, PollSchema_CLOSE:
+			qa.Answers = make([]string, len(qa.Options))
+			for j := range qa.Answers {
+				qa.Answers[j] = "false"
+			}
+			for _, opt := range ans.Selected {
+				if opt < 0 || int(opt) >= len(qa.Options) {
+					return nil, fmt.Errorf("Error! Invalid option selected.")
+				}
+				qa.Answers[opt] = "true"
+			}
+
+		case PollSchema_RANKED:
+			qa.Answers = make([]string, len(ans.Selected))
+			for j, opt := range ans.Selected {
+				qa.Answers[j] = strconv.Itoa(int(opt))
+			}
+
+		case PollSchema_NUMBER, PollSchema_SCALE:
+			qa.Answers = []string{strconv.FormatFloat(ans.Number, 'g', -1, 64)}
+		}
+	}
+	return res, nil
+}
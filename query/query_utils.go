@@ -1,16 +1,59 @@
 package query
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"hash"
+	"math"
+	"strconv"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
+// AdminKeyHeader is a name of gRPC metadata entry carrying poll's admin key.
+const AdminKeyHeader = "rada-admin-key"
+
+// OwnerKeyHeader is a name of gRPC metadata entry carrying owner key, which
+// identifies owner of polls and templates.
+const OwnerKeyHeader = "rada-owner-key"
+
+// MinNonceSize is a minimal length of nonce used in ballot commitment.
+const MinNonceSize = 16
+
+// MaxScaleValues is a maximal number of values on a scale of SCALE question.
+const MaxScaleValues = 100
+
+// MaxNumber is a maximal absolute value of answer to NUMBER or SCALE question.
+// Differences of answers and their squares, used in summaries, don't overflow.
+const MaxNumber = 1e150
+
+// stepPrecision is a tolerance used when checking if number is a multiple of step.
+const stepPrecision = 1e-9
+
+// commitmentDomain separates ballot commitments from other uses of SHA-256.
+const commitmentDomain = "Rada ballot v1"
+
 func (t *PollSchema_QuestionType) IsValid() bool {
-	return PollSchema_OPEN <= *t && *t <= PollSchema_CLOSE
+	return PollSchema_OPEN <= *t && *t <= PollSchema_SCALE
 }
 
 func (t *PollSchema) IsValid() error {
-	for _, qa := range t.Questions {
+	if t.Opens < 0 || t.Closes < 0 {
+		return fmt.Errorf("Error! Negative opening or closing time.")
+	}
+	if t.Opens != 0 && t.Closes != 0 && t.Opens >= t.Closes {
+		return fmt.Errorf("Error! Poll has to be opened before closing.")
+	}
+
+	for _, sec := range t.Sections {
+		if !IsStringPrintable(sec.Title) || !IsStringPrintable(sec.Description) {
+			return fmt.Errorf("Error! Section contains invalid characters.")
+		}
+	}
+
+	for i, qa := range t.Questions {
 		if !IsStringPrintable(qa.Question) {
 			return fmt.Errorf("Error! Question contains invalid characters.")
 		}
@@ -30,10 +73,526 @@ func (t *PollSchema) IsValid() error {
 				return fmt.Errorf("Error! Answer contains invalid characters.")
 			}
 		}
+
+		if qa.Type == PollSchema_RANKED {
+			if _, err := qa.Ranking(); err != nil {
+				return err
+			}
+		}
+
+		if qa.Type == PollSchema_NUMBER || qa.Type == PollSchema_SCALE {
+			if err := qa.checkRange(); err != nil {
+				return err
+			}
+			if _, _, err := qa.Number(); err != nil {
+				return err
+			}
+		}
+
+		if qa.MinSelections < 0 || qa.MaxSelections < 0 || qa.MaxLength < 0 {
+			return fmt.Errorf("Error! Negative limit of answers.")
+		}
+		if qa.MaxSelections != 0 && qa.MinSelections > qa.MaxSelections {
+			return fmt.Errorf("Error! Minimal number of selections is greater than maximal.")
+		}
+		if int(qa.MinSelections) > len(qa.Options) {
+			return fmt.Errorf("Error! Minimal number of selections is greater than number of options.")
+		}
+
+		if err := qa.checkOptionIDs(); err != nil {
+			return err
+		}
+		if qa.Shuffle && qa.Type != PollSchema_CHECKBOX && qa.Type != PollSchema_CLOSE {
+			return fmt.Errorf("Error! Only options of checkbox and closed questions can be shuffled.")
+		}
+
+		if err := t.checkSection(i); err != nil {
+			return err
+		}
+		if err := t.checkCondition(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkOptionIDs checks if IDs of options, if set, are distinct and non-negative.
+func (qa *PollSchema_QA) checkOptionIDs() error {
+	if len(qa.OptionIds) == 0 {
+		return nil
+	}
+	if len(qa.OptionIds) != len(qa.Options) {
+		return fmt.Errorf("Error! Number of option IDs doesn't match number of options.")
+	}
+	seen := make(map[int32]bool)
+	for _, id := range qa.OptionIds {
+		if id < 0 {
+			return fmt.Errorf("Error! Negative option ID.")
+		}
+		if seen[id] {
+			return fmt.Errorf("Error! Option ID repeated.")
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// OptionID returns ID of j-th option of question qa.
+func (qa *PollSchema_QA) OptionID(j int) int32 {
+	if len(qa.OptionIds) == 0 {
+		return int32(j)
+	}
+	return qa.OptionIds[j]
+}
+
+// optionPosition returns position of option with given ID, or -1 if there is no such option.
+func (qa *PollSchema_QA) optionPosition(id int32) int {
+	for j := range qa.Options {
+		if qa.OptionID(j) == id {
+			return j
+		}
+	}
+	return -1
+}
+
+// checkSection checks if i-th question belongs to existing section and
+// follows questions of previous sections.
+func (t *PollSchema) checkSection(i int) error {
+	sec := t.Questions[i].Section
+	if sec < 0 || (sec > 0 && int(sec) >= len(t.Sections)) {
+		return fmt.Errorf("Error! Question belongs to nonexistent section.")
+	}
+	if i > 0 && sec < t.Questions[i-1].Section {
+		return fmt.Errorf("Error! Questions of one section have to be next to each other.")
+	}
+	return nil
+}
+
+// checkCondition checks if condition of i-th question is well formed.
+//
+// Condition can refer only to earlier question, so conditions never form a cycle.
+func (t *PollSchema) checkCondition(i int) error {
+	cond := t.Questions[i].ShowIf
+	if cond == nil {
+		return nil
+	}
+	if cond.Question < 0 || int(cond.Question) >= i {
+		return fmt.Errorf("Error! Condition has to refer to earlier question.")
+	}
+	dep := t.Questions[cond.Question]
+	if dep.Type != PollSchema_CHECKBOX && dep.Type != PollSchema_CLOSE {
+		return fmt.Errorf("Error! Condition has to refer to checkbox or closed question.")
+	}
+	if len(cond.Options) == 0 {
+		return fmt.Errorf("Error! Condition has no options.")
+	}
+	seen := make([]bool, len(dep.Options))
+	for _, opt := range cond.Options {
+		if opt < 0 || int(opt) >= len(dep.Options) {
+			return fmt.Errorf("Error! Condition refers to nonexistent option.")
+		}
+		if seen[opt] {
+			return fmt.Errorf("Error! Option repeated in condition.")
+		}
+		seen[opt] = true
+	}
+	return nil
+}
+
+// Visible checks which questions of schema t are shown to voter who answered with ballot b.
+//
+// Question is shown if it has no condition, or question referred by condition
+// is shown and has any of condition's options selected.
+func (t *PollSchema) Visible(b *Ballot) []bool {
+	// Conditions refer to positions of options.
+	if p, err := t.Positions(b); err == nil {
+		b = p
+	}
+	selected := make(map[int32][]int32)
+	for _, ans := range b.GetAnswers() {
+		selected[ans.Question] = ans.Selected
+	}
+	visible := make([]bool, len(t.Questions))
+	for i, qa := range t.Questions {
+		cond := qa.ShowIf
+		if cond == nil {
+			visible[i] = true
+			continue
+		}
+		// Conditions refer to earlier questions, so their visibility is already known.
+		if cond.Question < 0 || int(cond.Question) >= i || !visible[cond.Question] {
+			continue
+		}
+		for _, opt := range selected[cond.Question] {
+			for _, o := range cond.Options {
+				if opt == o {
+					visible[i] = true
+				}
+			}
+		}
+	}
+	return visible
+}
+
+// ValidateAnswers checks if answers match questions of poll schema t.
+//
+// Answers have to repeat every question of schema in the same order, with the
+// same text, type, options and range. Form of answers depends on type:
+// OPEN question has at most one answer, CHECKBOX and CLOSE have none or one
+// boolean value for each option, RANKED has a ranking of options and NUMBER
+// and SCALE have at most one number within range of question.
+func (t *PollSchema) ValidateAnswers(answers *PollSchema) error {
+	if len(answers.GetQuestions()) != len(t.Questions) {
+		return fmt.Errorf("Error! Number of answers doesn't match number of questions.")
+	}
+	for i, qa := range t.Questions {
+		if err := qa.validateAnswer(answers.Questions[i]); err != nil {
+			return fmt.Errorf("Error in question %v: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// validateAnswer checks if ans is an answer to question qa.
+func (qa *PollSchema_QA) validateAnswer(ans *PollSchema_QA) error {
+	if ans == nil {
+		return fmt.Errorf("Error! Answer is missing.")
+	}
+	if ans.Question != qa.Question {
+		return fmt.Errorf("Error! Question doesn't match poll.")
+	}
+	if ans.Type != qa.Type {
+		return fmt.Errorf("Error! Type of question doesn't match poll.")
+	}
+	if len(ans.Options) != len(qa.Options) {
+		return fmt.Errorf("Error! Number of options doesn't match poll.")
+	}
+	for j, opt := range qa.Options {
+		if ans.Options[j] != opt {
+			return fmt.Errorf("Error! Option doesn't match poll.")
+		}
+	}
+	if ans.Min != qa.Min || ans.Max != qa.Max || ans.Step != qa.Step {
+		return fmt.Errorf("Error! Range of question doesn't match poll.")
+	}
+
+	switch qa.Type {
+	case PollSchema_OPEN:
+		if len(ans.Answers) > 1 {
+			return fmt.Errorf("Error! Open question has more than one answer.")
+		}
+
+	case PollSchema_CHECKBOX, PollSchema_CLOSE:
+		if len(ans.Answers) == 0 {
+			return nil
+		}
+		if len(ans.Answers) != len(qa.Options) {
+			return fmt.Errorf("Error! Number of answers doesn't match number of options.")
+		}
+		for _, a := range ans.Answers {
+			if _, err := strconv.ParseBool(a); err != nil {
+				return fmt.Errorf("Error! Answer is not a boolean value.")
+			}
+		}
+
+	case PollSchema_RANKED:
+		if _, err := ans.Ranking(); err != nil {
+			return err
+		}
+
+	case PollSchema_NUMBER, PollSchema_SCALE:
+		if _, _, err := ans.Number(); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("Error! Wrong question type.")
+	}
+	return nil
+}
+
+// CheckConstraints checks if answers satisfy constraints of questions in schema t.
+//
+// Answers have to be given for every question of schema, in the same order.
+// They should be checked with ValidateAnswers first. Questions skipped
+// because of their conditions can't be answered.
+func (t *PollSchema) CheckConstraints(answers *PollSchema) error {
+	if len(answers.GetQuestions()) != len(t.Questions) {
+		return fmt.Errorf("Error! Number of answers doesn't match number of questions.")
+	}
+	b, err := NewBallot(answers)
+	if err != nil {
+		return err
+	}
+	visible := t.Visible(b)
+	for i, qa := range t.Questions {
+		if !visible[i] {
+			if b.answers(int32(i)) {
+				return fmt.Errorf("Error in question %v: Error! Skipped question can't be answered.", i+1)
+			}
+			continue
+		}
+		if err := qa.checkConstraints(answers.Questions[i].Answers); err != nil {
+			return fmt.Errorf("Error in question %v: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// checkConstraints checks if answers satisfy constraints of question qa.
+func (qa *PollSchema_QA) checkConstraints(answers []string) error {
+	answered := false
+	switch qa.Type {
+	case PollSchema_OPEN:
+		if len(answers) > 1 {
+			return fmt.Errorf("Error! Open question has more than one answer.")
+		}
+		if len(answers) == 1 {
+			answered = strings.TrimSpace(answers[0]) != ""
+			if qa.MaxLength > 0 && utf8.RuneCountInString(answers[0]) > int(qa.MaxLength) {
+				return fmt.Errorf("Error! Answer is longer than %v characters.", qa.MaxLength)
+			}
+		}
+
+	case PollSchema_CHECKBOX, PollSchema_CLOSE:
+		selected := 0
+		for _, ans := range answers {
+			// Unchecked options may be sent as empty strings.
+			if ans == "" {
+				continue
+			}
+			b, err := strconv.ParseBool(ans)
+			if err != nil {
+				return fmt.Errorf("Error! Answer is not a boolean value.")
+			}
+			if b {
+				selected++
+			}
+		}
+		answered = selected > 0
+		if qa.Type == PollSchema_CLOSE && selected > 1 {
+			return fmt.Errorf("Error! More than one option selected in closed question.")
+		}
+		if qa.Type == PollSchema_CHECKBOX && answered {
+			if selected < int(qa.MinSelections) {
+				return fmt.Errorf("Error! At least %v options have to be selected.", qa.MinSelections)
+			}
+			if qa.MaxSelections > 0 && selected > int(qa.MaxSelections) {
+				return fmt.Errorf("Error! At most %v options can be selected.", qa.MaxSelections)
+			}
+		}
+
+	case PollSchema_RANKED:
+		for _, ans := range answers {
+			if ans != "" {
+				answered = true
+			}
+		}
+
+	case PollSchema_NUMBER, PollSchema_SCALE:
+		answered = len(answers) > 0 && answers[0] != ""
+	}
+
+	if qa.Required && !answered {
+		return fmt.Errorf("Error! Answer is required.")
+	}
+	return nil
+}
+
+// checkRange checks if min, max and step of NUMBER or SCALE question are valid.
+func (qa *PollSchema_QA) checkRange() error {
+	for _, v := range []float64{qa.Min, qa.Max, qa.Step} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("Error! Range of question is not a finite number.")
+		}
+	}
+	if qa.Step < 0 {
+		return fmt.Errorf("Error! Negative step.")
+	}
+	if qa.Min > qa.Max {
+		return fmt.Errorf("Error! Minimum is greater than maximum.")
+	}
+	if qa.Type != PollSchema_SCALE {
+		return nil
+	}
+
+	if qa.Min == qa.Max {
+		return fmt.Errorf("Error! Scale has to contain at least two values.")
+	}
+	n := (qa.Max - qa.Min) / qa.scaleStep()
+	if math.Abs(n-math.Round(n)) > stepPrecision {
+		return fmt.Errorf("Error! Range of scale is not a multiple of step.")
+	}
+	if math.Round(n)+1 > MaxScaleValues {
+		return fmt.Errorf("Error! Scale has more than %v values.", MaxScaleValues)
 	}
 	return nil
 }
 
+// scaleStep returns step of SCALE question, 1 if not set.
+func (qa *PollSchema_QA) scaleStep() float64 {
+	if qa.Step == 0 {
+		return 1
+	}
+	return qa.Step
+}
+
+// ScaleValues returns all values of SCALE question, from min to max.
+func (qa *PollSchema_QA) ScaleValues() []float64 {
+	step := qa.scaleStep()
+	n := int(math.Round((qa.Max - qa.Min) / step))
+	values := make([]float64, 0, n+1)
+	for k := 0; k <= n; k++ {
+		values = append(values, qa.Min+float64(k)*step)
+	}
+	return values
+}
+
+// Number reads answer to NUMBER or SCALE question.
+//
+// Returned bool is false if question wasn't answered. Answer has to be
+// within range of question and a multiple of its step.
+func (qa *PollSchema_QA) Number() (float64, bool, error) {
+	if len(qa.Answers) == 0 || (len(qa.Answers) == 1 && qa.Answers[0] == "") {
+		return 0, false, nil
+	}
+	if len(qa.Answers) > 1 {
+		return 0, false, fmt.Errorf("Error! Numeric question has more than one answer.")
+	}
+
+	v, err := strconv.ParseFloat(qa.Answers[0], 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("Error! Answer is not a number.")
+	}
+	if err = qa.checkNumber(v); err != nil {
+		return 0, false, err
+	}
+	return v, true, nil
+}
+
+// checkNumber checks if v is within range of NUMBER or SCALE question and is a multiple of its step.
+//
+// Absolute value of answer can't exceed MaxNumber, even if question is unbounded.
+func (qa *PollSchema_QA) checkNumber(v float64) error {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Errorf("Error! Answer is not a number.")
+	}
+	if math.Abs(v) > MaxNumber {
+		return fmt.Errorf("Error! Number is out of range.")
+	}
+	bounded := qa.Type == PollSchema_SCALE || qa.Min < qa.Max
+	if bounded && (v < qa.Min || v > qa.Max) {
+		return fmt.Errorf("Error! Number is out of range.")
+	}
+	step := qa.Step
+	if qa.Type == PollSchema_SCALE {
+		step = qa.scaleStep()
+	}
+	if step > 0 {
+		k := (v - qa.Min) / step
+		if math.Abs(k-math.Round(k)) > stepPrecision {
+			return fmt.Errorf("Error! Number is not a multiple of step.")
+		}
+	}
+	return nil
+}
+
+// Ranking reads order of options from answers to RANKED question.
+//
+// Answers have to be a permutation of options' numbers. If no option was
+// ranked (answers are empty or all of them are empty strings), nil is returned.
+func (qa *PollSchema_QA) Ranking() ([]int, error) {
+	ranked := false
+	for _, ans := range qa.Answers {
+		if ans != "" {
+			ranked = true
+		}
+	}
+	if !ranked {
+		return nil, nil
+	}
+	if len(qa.Answers) != len(qa.Options) {
+		return nil, fmt.Errorf("Error! Ranking has to contain all options.")
+	}
+
+	ranking := make([]int, len(qa.Answers))
+	seen := make([]bool, len(qa.Options))
+	for i, ans := range qa.Answers {
+		opt, err := strconv.Atoi(ans)
+		if err != nil || opt < 0 || opt >= len(qa.Options) {
+			return nil, fmt.Errorf("Error! Ranking contains invalid option.")
+		}
+		if seen[opt] {
+			return nil, fmt.Errorf("Error! Option ranked more than once.")
+		}
+		seen[opt] = true
+		ranking[i] = opt
+	}
+	return ranking, nil
+}
+
+// IsValid checks if metadata m can describe poll with schema sch.
+//
+// Texts have to be printable and locales have to be valid language tags.
+// Every translation has a different locale and its texts match questions and options of schema.
+func (m *PollMetadata) IsValid(sch *PollSchema) error {
+	if !IsStringPrintable(m.Title) || !IsStringPrintable(m.Description) || !IsStringPrintable(m.Author) {
+		return fmt.Errorf("Error! Metadata contains invalid characters.")
+	}
+	if m.Locale != "" && !isLocale(m.Locale) {
+		return fmt.Errorf("Error! Invalid locale %q.", m.Locale)
+	}
+
+	locales := map[string]bool{strings.ToLower(m.Locale): true}
+	for _, tr := range m.Translations {
+		if !isLocale(tr.Locale) {
+			return fmt.Errorf("Error! Invalid locale %q.", tr.Locale)
+		}
+		if locales[strings.ToLower(tr.Locale)] {
+			return fmt.Errorf("Error! Locale %q translated more than once.", tr.Locale)
+		}
+		locales[strings.ToLower(tr.Locale)] = true
+
+		if !IsStringPrintable(tr.Title) || !IsStringPrintable(tr.Description) {
+			return fmt.Errorf("Error! Translation contains invalid characters.")
+		}
+		if len(tr.Questions) != 0 && len(tr.Questions) != len(sch.GetQuestions()) {
+			return fmt.Errorf("Error! Number of translated questions doesn't match schema.")
+		}
+		for i, qt := range tr.Questions {
+			if len(qt.Options) != 0 && len(qt.Options) != len(sch.Questions[i].Options) {
+				return fmt.Errorf("Error! Number of translated options doesn't match question %v.", i+1)
+			}
+			if !IsStringPrintable(qt.Question) {
+				return fmt.Errorf("Error! Translation contains invalid characters.")
+			}
+			for _, opt := range qt.Options {
+				if !IsStringPrintable(opt) {
+					return fmt.Errorf("Error! Translation contains invalid characters.")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// isLocale checks if s is a language tag: language code of 2 or 3 letters
+// followed by subtags of 1 to 8 letters or digits, separated by hyphens.
+func isLocale(s string) bool {
+	for i, sub := range strings.Split(s, "-") {
+		if len(sub) < 1 || len(sub) > 8 || (i == 0 && (len(sub) < 2 || len(sub) > 3)) {
+			return false
+		}
+		for _, c := range sub {
+			isLetter := ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+			if !isLetter && (i == 0 || c < '0' || c > '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func IsStringPrintable(s string) bool {
 	for _, c := range s {
 		if !unicode.IsGraphic(c) && !unicode.IsSpace(c) {
@@ -42,3 +601,34 @@ func IsStringPrintable(s string) bool {
 	}
 	return true
 }
+
+// Commitment calculates ballot binding answers to a vote.
+//
+// Ballot is SHA-256 hash of nonce followed by answers to all questions.
+// Every value is prefixed with its length, so different answers never
+// give the same input to hash function. Nonce should be random, otherwise
+// ballots of voters who answered the same way would be equal.
+func (t *PollSchema) Commitment(nonce []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(commitmentDomain))
+	writeBytes(h, nonce)
+	writeUint32(h, len(t.GetQuestions()))
+	for _, qa := range t.GetQuestions() {
+		writeUint32(h, len(qa.Answers))
+		for _, ans := range qa.Answers {
+			writeBytes(h, []byte(ans))
+		}
+	}
+	return h.Sum(nil)
+}
+
+func writeUint32(h hash.Hash, n int) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n))
+	h.Write(b[:])
+}
+
+func writeBytes(h hash.Hash, b []byte) {
+	writeUint32(h, len(b))
+	h.Write(b)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"text/template"
+)
+
+// Mailer sends emails to voters.
+type Mailer interface {
+	// Send sends email with given subject and plain text body to one address.
+	Send(to, subject, body string) error
+}
+
+// smtpMailer is a Mailer sending emails through SMTP server.
+type smtpMailer struct {
+	addr string // Address of SMTP server, host:port.
+	from string
+	auth smtp.Auth
+}
+
+// newSMTPMailer creates Mailer using SMTP server at addr.
+//
+// If user is empty, emails are sent without authentication.
+func newSMTPMailer(addr, from, user, password string) *smtpMailer {
+	m := &smtpMailer{
+		addr: addr,
+		from: from,
+	}
+	if user != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		m.auth = smtp.PlainAuth("", user, password, host)
+	}
+	return m
+}
+
+// crlf converts all line endings to CRLF used in emails.
+//
+// Body may already contain CRLF or lone CR, so they are not doubled.
+var crlf = strings.NewReplacer("\r\n", "\r\n", "\r", "\r\n", "\n", "\r\n")
+
+// Send sends email through SMTP server.
+//
+// Address to has to be a plain email address, as returned by mail.ParseAddress.
+func (m *smtpMailer) Send(to, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	// Line breaks in headers would allow to inject other headers.
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(subject))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(crlf.Replace(body))
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, msg.Bytes())
+}
+
+// invitation contains data available in invitation templates.
+type invitation struct {
+	Pollid string
+	Token  string
+	Link   string
+}
+
+// Default templates of invitations, used when request doesn't specify its own.
+const (
+	defaultInviteSubject = "Invitation to poll {{.Pollid}}"
+	defaultInviteBody    = `You are invited to vote in poll {{.Pollid}}.
+
+To vote, open this link:
+{{.Link}}
+
+Link can be used only once. Your token is {{.Token}}.
+`
+)
+
+// renderInvitation fills template with invitation data.
+func renderInvitation(t *template.Template, inv invitation) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, inv); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
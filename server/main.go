@@ -2,28 +2,50 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/mail"
 	"os"
 	"strings"
+	"text/template"
 
 	"github.com/ememak/Projekt-Rada/bsign"
+	"github.com/ememak/Projekt-Rada/links"
 	"github.com/ememak/Projekt-Rada/query"
 	"github.com/ememak/Projekt-Rada/store"
+	"github.com/google/uuid"
 	"github.com/improbable-eng/grpc-web/go/grpcweb"
 	bolt "go.etcd.io/bbolt"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
-// In constants we store connection data.
+// In constants we store connection data and default settings.
 const (
 	port = ":12345"
+
+	defaultTokens    = 100
+	defaultMaxTokens = 50000
+	defaultMaxWeight = 100
+)
+
+var (
+	maxTokens = flag.Int("max_tokens", defaultMaxTokens, "maximal number of tokens generated for one poll")
+	maxWeight = flag.Int("max_weight", defaultMaxWeight, "maximal weight of issued tokens")
+	publicURL = flag.String("public_url", "http://localhost"+port, "address of web client used in voting links")
+	smtpAddr  = flag.String("smtp_addr", "", "address of SMTP server used for invitations, host:port; invitations are disabled if empty")
+	smtpFrom  = flag.String("smtp_from", "rada@localhost", "sender address of invitations")
+	smtpUser  = flag.String("smtp_user", "", "user name for SMTP server, password is read from RADA_SMTP_PASSWORD environment variable")
 )
 
 // Server type contains server implemented in query/query.proto,
@@ -32,6 +54,16 @@ type server struct {
 	query.UnimplementedQueryServer
 
 	data *bolt.DB
+
+	// Maximal number of tokens, which can be requested in PollInit.
+	maxTokens int
+	maxWeight int32
+
+	// Address of web client, voting links point at it.
+	publicURL string
+
+	// Mailer used for sending invitations, nil if invitations are disabled.
+	mailer Mailer
 }
 
 // GetPoll is function used to exchange server public key for specific poll.
@@ -39,90 +71,354 @@ type server struct {
 // GetPollRequest contains poll's id. This poll will be returned.
 // If key or poll are not in database (e.g. requested nonexisting poll), reply contains empty answer.
 func (s *server) GetPoll(ctx context.Context, in *query.GetPollRequest) (*query.PollWithPublicKey, error) {
-	key, err := store.GetKey(s.data, in.Pollid)
+	pollid, err := s.pollNumber(in.Pollid)
+	if err != nil {
+		return &query.PollWithPublicKey{}, err
+	}
+	key, err := store.GetKey(s.data, pollid)
 	if err != nil {
 		err = fmt.Errorf("Error in GetPoll while retrieving key from database: %w", err)
 		return &query.PollWithPublicKey{}, err
 	}
 	binkey := x509.MarshalPKCS1PublicKey(&key.PublicKey)
 
-	poll, err := store.GetPoll(s.data, in.Pollid)
+	sch, err := store.GetSchema(s.data, pollid)
 	if err != nil {
 		err = fmt.Errorf("Error in GetPoll while retrieving poll from database: %w", err)
 		return &query.PollWithPublicKey{}, err
 	}
 
+	md, err := store.GetMetadata(s.data, pollid)
+	if err != nil {
+		err = fmt.Errorf("Error in GetPoll while retrieving metadata from database: %w", err)
+		return &query.PollWithPublicKey{}, err
+	}
+
+	weights, err := store.GetWeights(s.data, pollid)
+	if err != nil {
+		err = fmt.Errorf("Error in GetPoll while retrieving weights from database: %w", err)
+		return &query.PollWithPublicKey{}, err
+	}
+	var wkeys []*query.WeightedKey
+	for _, w := range weights {
+		wkey, err := store.GetWeightedKey(s.data, pollid, w)
+		if err != nil {
+			err = fmt.Errorf("Error in GetPoll while retrieving key from database: %w", err)
+			return &query.PollWithPublicKey{}, err
+		}
+		wkeys = append(wkeys, &query.WeightedKey{
+			Weight: w,
+			Key: &query.PublicKey{
+				Key: x509.MarshalPKCS1PublicKey(&wkey.PublicKey),
+			},
+		})
+	}
+
 	return &query.PollWithPublicKey{
 		Key: &query.PublicKey{
 			Key: binkey,
 		},
-		Poll: poll.Schema,
+		Poll:         sch,
+		WeightedKeys: wkeys,
+		Metadata:     md,
 	}, nil
 }
 
 // PollInit generates new poll and saves it to database.
 //
-// Questions and their types are passed in input parameter.
-func (s *server) PollInit(ctx context.Context, in *query.PollSchema) (*query.PollQuestion, error) {
-	poll, err := store.NewPoll(s.data, in)
+// Questions and their types, optional metadata and number of tokens are passed in input parameter.
+// Reply contains admin key, which authorizes management of the poll. If owner key
+// is sent with request, poll belongs to its owner, otherwise new owner is created
+// and its key is sent in reply.
+func (s *server) PollInit(ctx context.Context, in *query.PollInitRequest) (*query.PollInitReply, error) {
+	if in.Schema == nil {
+		return &query.PollInitReply{}, status.Errorf(codes.InvalidArgument, "Poll schema is missing")
+	}
+	owner, err := s.optionalOwner(ctx)
+	if err != nil {
+		return &query.PollInitReply{}, err
+	}
+	ownerKey := ""
+	if owner == nil {
+		ownerKey, owner, err = store.NewOwner(s.data)
+		if err != nil {
+			return &query.PollInitReply{}, fmt.Errorf("Error in PollInit while creating owner: %w", err)
+		}
+	}
+	reply, err := s.createPoll("PollInit", in.Schema, in.Metadata, owner, in.Tokens)
 	if err != nil {
-		return poll, fmt.Errorf("Error in PollInit while creating new poll in database: %w", err)
+		return reply, err
 	}
+	reply.OwnerKey = ownerKey
+	return reply, nil
+}
 
+// ListPolls sends page of polls matching filters.
+//
+// If owner key is sent with request, only polls of its owner are listed.
+func (s *server) ListPolls(ctx context.Context, in *query.ListPollsRequest) (*query.PollList, error) {
+	owner, err := s.optionalOwner(ctx)
+	if err != nil {
+		return &query.PollList{}, err
+	}
+	list, err := store.ListPolls(s.data, in, owner)
+	if err != nil {
+		return &query.PollList{}, status.Errorf(codes.InvalidArgument, "Error in ListPolls: %v", err)
+	}
+	return list, nil
+}
+
+// SaveTemplate saves schema and metadata as a template of polls.
+//
+// Template belongs to owner identified by owner key sent with request.
+func (s *server) SaveTemplate(ctx context.Context, in *query.SaveTemplateRequest) (*query.PollTemplate, error) {
+	owner, err := s.owner(ctx)
+	if err != nil {
+		return &query.PollTemplate{}, err
+	}
+	tmpl, err := store.SaveTemplate(s.data, &query.PollTemplate{
+		Name:     in.Name,
+		Schema:   in.Schema,
+		Metadata: in.Metadata,
+	}, owner)
+	if err != nil {
+		return &query.PollTemplate{}, status.Errorf(codes.InvalidArgument, "Error in SaveTemplate: %v", err)
+	}
+	return tmpl, nil
+}
+
+// ListTemplates sends all templates of owner identified by owner key.
+func (s *server) ListTemplates(ctx context.Context, in *query.ListTemplatesRequest) (*query.TemplateList, error) {
+	owner, err := s.owner(ctx)
+	if err != nil {
+		return &query.TemplateList{}, err
+	}
+	templates, err := store.ListTemplates(s.data, owner)
+	if err != nil {
+		return &query.TemplateList{}, fmt.Errorf("Error in ListTemplates while reading templates from database: %w", err)
+	}
+	return &query.TemplateList{Templates: templates}, nil
+}
+
+// CreateFromTemplate creates new poll from a template.
+//
+// Only owner of the template can use it. Opening and closing times of template
+// are replaced with times from request. New poll belongs to the same owner.
+func (s *server) CreateFromTemplate(ctx context.Context, in *query.CreateFromTemplateRequest) (*query.PollInitReply, error) {
+	owner, err := s.owner(ctx)
+	if err != nil {
+		return &query.PollInitReply{}, err
+	}
+	tmpl, err := store.GetTemplate(s.data, in.TemplateId, owner)
+	if err != nil {
+		return &query.PollInitReply{}, status.Errorf(codes.NotFound, "Error in CreateFromTemplate: %v", err)
+	}
+	tmpl.Schema.Opens, tmpl.Schema.Closes = in.Opens, in.Closes
+	return s.createPoll("CreateFromTemplate", tmpl.Schema, tmpl.Metadata, owner, in.Tokens)
+}
+
+// CloneFromPoll creates new poll with schema and metadata of existing one.
+//
+// Only owner of the poll can clone it and new poll belongs to the same owner.
+// Opening and closing times are replaced with times from request, votes and
+// tokens are not copied.
+func (s *server) CloneFromPoll(ctx context.Context, in *query.CloneRequest) (*query.PollInitReply, error) {
+	pollid, err := s.authorize(ctx, in.Pollid)
+	if err != nil {
+		return &query.PollInitReply{}, err
+	}
+	owner, err := store.PollOwner(s.data, pollid)
+	if err != nil {
+		return &query.PollInitReply{}, fmt.Errorf("Error in CloneFromPoll while retrieving owner from database: %w", err)
+	}
+	sch, err := store.GetSchema(s.data, pollid)
+	if err != nil {
+		return &query.PollInitReply{}, fmt.Errorf("Error in CloneFromPoll while retrieving poll from database: %w", err)
+	}
+	md, err := store.GetMetadata(s.data, pollid)
+	if err != nil {
+		return &query.PollInitReply{}, fmt.Errorf("Error in CloneFromPoll while retrieving metadata from database: %w", err)
+	}
+	sch.Opens, sch.Closes = in.Opens, in.Closes
+	return s.createPoll("CloneFromPoll", sch, md, owner, in.Tokens)
+}
+
+// createPoll generates key and saves it with new poll with given number of tokens.
+//
+// It is shared by PollInit and functions creating polls from templates and
+// other polls, rpc is a name of calling function used in errors. If number
+// of tokens is 0, server default is used. Metadata can be nil. Poll always gets
+// new admin key and belongs to owner, if it is not nil.
+func (s *server) createPoll(rpc string, sch *query.PollSchema, md *query.PollMetadata, owner []byte, tokens int32) (*query.PollInitReply, error) {
+	n := int(tokens)
+	if n == 0 {
+		n = defaultTokens
+	}
+	if n < 0 || n > s.maxTokens {
+		return &query.PollInitReply{}, status.Errorf(codes.InvalidArgument, "Number of tokens has to be between 1 and %v", s.maxTokens)
+	}
+	if md != nil {
+		if err := md.IsValid(sch); err != nil {
+			return &query.PollInitReply{}, status.Errorf(codes.InvalidArgument, "Error in %v: %v", rpc, err)
+		}
+	}
+
+	// Key is generated first and saved together with poll, so a failure
+	// never leaves a poll without key in database.
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		return poll, fmt.Errorf("Error in PollInit during key generation: %w", err)
+		return &query.PollInitReply{}, fmt.Errorf("Error in %v during key generation: %w", rpc, err)
 	}
-	err = store.SaveKey(s.data, int(poll.Id), key)
+	poll, err := store.NewPollWithKey(s.data, sch, md, key, owner, n)
 	if err != nil {
-		return poll, fmt.Errorf("Error in PollInit while saving key: %w", err)
+		return &query.PollInitReply{}, fmt.Errorf("Error in %v while creating new poll in database: %w", rpc, err)
 	}
 
-	return poll, nil
+	return &query.PollInitReply{
+		Id:       poll.Id,
+		AdminKey: poll.AdminKey,
+	}, nil
+}
+
+// GetTokenWeight returns weight of unused token.
+//
+// Client needs it to blind ballot with key of the right weight class.
+// Token has to be sent with signature from its voting link.
+func (s *server) GetTokenWeight(ctx context.Context, in *query.TokenRequest) (*query.TokenWeight, error) {
+	pollid, err := s.pollNumber(in.Pollid)
+	if err != nil {
+		return &query.TokenWeight{}, err
+	}
+	if err = s.checkLinkSig(pollid, in.Pollid, in.Token, in.Sig); err != nil {
+		return &query.TokenWeight{}, err
+	}
+	weight, err := store.GetTokenWeight(s.data, in.Token, pollid)
+	if err != nil {
+		return &query.TokenWeight{}, status.Errorf(codes.NotFound, "Error in GetTokenWeight: %v", err)
+	}
+	return &query.TokenWeight{Weight: weight}, nil
 }
 
 // SignBallot authorizes a ballot if sent with valid token.
 //
 // Function takes as an input message consisting of an envelope (blinded ballot)
-// and a token. Envelope is signed if token is valid.
+// and a token with signature from its voting link. Envelope is signed if token
+// is valid, with key of token's weight class, so sign itself attests weight of the vote.
 func (s *server) SignBallot(ctx context.Context, in *query.EnvelopeToSign) (*query.SignedEnvelope, error) {
+	pollid, err := s.pollNumber(in.Pollid)
+	if err != nil {
+		return &query.SignedEnvelope{}, err
+	}
+	// Ballots are signed only in open polls, so tokens are not wasted.
+	if err := s.checkOpen(pollid); err != nil {
+		return &query.SignedEnvelope{}, err
+	}
+
+	// Token is accepted only from a voting link issued by server.
+	if err = s.checkLinkSig(pollid, in.Pollid, in.Token, in.Sig); err != nil {
+		return &query.SignedEnvelope{}, err
+	}
+
 	// Check if token and polls number are valid.
-	err := store.AcceptToken(s.data, in.Token, in.Pollid)
+	weight, err := store.AcceptWeightedToken(s.data, in.Token, pollid)
 	if err != nil {
 		return &query.SignedEnvelope{}, err
 	}
 
-	key, err := store.GetKey(s.data, in.Pollid)
+	key, err := store.GetWeightedKey(s.data, pollid, weight)
 	if err != nil {
 		err = fmt.Errorf("Error in SignBallot while retrieving key from database: %w", err)
 		return &query.SignedEnvelope{}, err
 	}
 	// Token is valid. Server is signing envelope.
-	sign := bsign.Sign(key, in.Envelope)
-	if len(sign.Bytes()) == 0 {
-		return &query.SignedEnvelope{}, fmt.Errorf("Error in SignBallot, envelope shouldn't be null")
+	sign, err := bsign.Sign(key, in.Envelope)
+	if err != nil {
+		err = fmt.Errorf("Error in SignBallot while signing envelope: %w", err)
+		return &query.SignedEnvelope{}, err
 	}
 	SM := query.SignedEnvelope{
 		Envelope: in.Envelope, //may be not necessary
-		Sign:     sign.Bytes(),
+		Sign:     sign,
 	}
 	return &SM, nil
 }
 
 // PollVote get signed vote from client, check it's validity and save it.
 //
-// VoteRequest on input consists of vote and sign. If sign was used before, vote is overwritten.
+// VoteRequest on input consists of vote, nonce and sign. Signed ballot has to be
+// equal to commitment of answers and nonce, unless vote is changed with revote key
+// returned with the first vote. If sign was used before, vote is handled
+// according to poll's vote policy. Sign is checked with key of weight class given
+// in request, so vote can't claim higher weight than its token had.
+// Votes without sign or answers, and answers not matching poll's schema or
+// violating constraints of its questions are rejected with InvalidArgument.
 func (s *server) PollVote(ctx context.Context, in *query.VoteRequest) (*query.VoteReply, error) {
-	key, err := store.GetKey(s.data, in.Pollid)
+	// Malformed requests are rejected before any field is used.
+	if in.Sign == nil {
+		return &query.VoteReply{Mess: "Error in PollVote"}, status.Errorf(codes.InvalidArgument, "Error in PollVote: vote is not signed")
+	}
+	if in.Answers == nil && in.Ballot == nil {
+		return &query.VoteReply{Mess: "Error in PollVote"}, status.Errorf(codes.InvalidArgument, "Error in PollVote: vote has no answers")
+	}
+	weight := in.Weight
+	if weight < 1 {
+		weight = 1
+	}
+	pollid, err := s.pollNumber(in.Pollid)
+	if err != nil {
+		return &query.VoteReply{Mess: "Error in PollVote"}, err
+	}
+	key, err := store.GetWeightedKey(s.data, pollid, weight)
 	if err != nil {
 		err = fmt.Errorf("Error in PollVote while retrieving key from database: %w", err)
 		return &query.VoteReply{Mess: "Error in PollVote"}, err
 	}
+	if err = s.checkOpen(pollid); err != nil {
+		return &query.VoteReply{Mess: "Error in PollVote"}, err
+	}
 	// We have to check if the sign is valid.
 	if bsign.Verify(&key.PublicKey, in.Sign.Ballot, in.Sign.Sign) == false {
 		err = fmt.Errorf("Error in PollVte, Sign invalid!")
 		return &query.VoteReply{Mess: "Error in PollVote"}, err
 	}
+	// Signed ballot has to be a commitment to sent answers.
+	if len(in.Nonce) < query.MinNonceSize {
+		err = fmt.Errorf("Error in PollVote, nonce too short!")
+		return &query.VoteReply{Mess: "Error in PollVote"}, err
+	}
+	// Answers sent in compact form have their own commitment, legacy answers are ignored then.
+	commitment := in.Answers.Commitment(in.Nonce)
+	if in.Ballot != nil {
+		commitment = in.Ballot.Commitment(in.Nonce)
+	}
+	// Changed vote is authorized by revote key instead, it is checked in store.SaveVote.
+	if in.RevoteKey == nil && !bytes.Equal(commitment, in.Sign.Ballot) {
+		err = fmt.Errorf("Error in PollVote, ballot does not match answers!")
+		return &query.VoteReply{Mess: "Error in PollVote"}, err
+	}
+
+	// Answers have to match poll's schema and satisfy constraints of its questions.
+	sch, err := store.GetSchema(s.data, pollid)
+	if err != nil {
+		err = fmt.Errorf("Error in PollVote while retrieving poll from database: %w", err)
+		return &query.VoteReply{Mess: "Error in PollVote"}, err
+	}
+	answers := in.Answers
+	if in.Ballot != nil {
+		if err = sch.ValidateBallot(in.Ballot); err != nil {
+			return &query.VoteReply{Mess: "Error in PollVote"}, status.Errorf(codes.InvalidArgument, "Error in PollVote: %v", err)
+		}
+		// Constraints are checked on answers converted into legacy form.
+		answers, err = in.Ballot.ToSchema(sch)
+	} else {
+		err = sch.ValidateAnswers(in.Answers)
+	}
+	if err != nil {
+		return &query.VoteReply{Mess: "Error in PollVote"}, status.Errorf(codes.InvalidArgument, "Error in PollVote: %v", err)
+	}
+	if err = sch.CheckConstraints(answers); err != nil {
+		return &query.VoteReply{Mess: "Error in PollVote"}, status.Errorf(codes.InvalidArgument, "Error in PollVote: %v", err)
+	}
 
 	// Vote is properly signed, we proceed to voting.
 	vr, err := store.SaveVote(s.data, in)
@@ -135,13 +431,491 @@ func (s *server) PollVote(ctx context.Context, in *query.VoteRequest) (*query.Vo
 }
 
 // GetSummary sends all answers for a poll.
+//
+// Draft polls have no results yet. Other polls show results according to
+// their results visibility setting, poll's owner can see them always.
 func (s *server) GetSummary(ctx context.Context, in *query.SummaryRequest) (*query.PollSummary, error) {
-	return store.GetSummary(s.data, in.Pollid)
+	pollid, err := s.pollNumber(in.Pollid)
+	if err != nil {
+		return &query.PollSummary{}, err
+	}
+	ps, err := store.GetStatus(s.data, pollid)
+	if err != nil {
+		return &query.PollSummary{}, err
+	}
+	if ps.State == query.PollStatus_DRAFT {
+		return &query.PollSummary{}, status.Errorf(codes.FailedPrecondition, "Poll is not opened yet")
+	}
+
+	sch, err := store.GetSchema(s.data, pollid)
+	if err != nil {
+		return &query.PollSummary{}, err
+	}
+	if _, err = s.authorize(ctx, in.Pollid); err == nil {
+		return store.GetSummary(s.data, pollid)
+	}
+	switch sch.Results {
+	case query.PollSchema_AFTER_CLOSE:
+		if ps.State == query.PollStatus_OPEN {
+			return &query.PollSummary{}, status.Errorf(codes.FailedPrecondition, "Results will be available after the poll is closed")
+		}
+	case query.PollSchema_OWNER_ONLY:
+		return &query.PollSummary{}, status.Errorf(codes.PermissionDenied, "Results are available only to poll's owner")
+	}
+	return store.GetSummary(s.data, pollid)
+}
+
+// GetPollStatus returns current state of a poll.
+func (s *server) GetPollStatus(ctx context.Context, in *query.PollRequest) (*query.PollStatus, error) {
+	pollid, err := s.pollNumber(in.Pollid)
+	if err != nil {
+		return &query.PollStatus{}, err
+	}
+	ps, err := store.GetStatus(s.data, pollid)
+	if err != nil {
+		return &query.PollStatus{}, status.Errorf(codes.NotFound, "Error in GetPollStatus: %v", err)
+	}
+	return ps, nil
+}
+
+// OpenPoll starts accepting votes in a draft poll.
+func (s *server) OpenPoll(ctx context.Context, in *query.PollRequest) (*query.PollStatus, error) {
+	return s.setState(ctx, in.Pollid, query.PollStatus_OPEN)
+}
+
+// ClosePoll stops accepting votes in a poll.
+func (s *server) ClosePoll(ctx context.Context, in *query.PollRequest) (*query.PollStatus, error) {
+	return s.setState(ctx, in.Pollid, query.PollStatus_CLOSED)
+}
+
+// ArchivePoll marks closed poll as archived.
+func (s *server) ArchivePoll(ctx context.Context, in *query.PollRequest) (*query.PollStatus, error) {
+	return s.setState(ctx, in.Pollid, query.PollStatus_ARCHIVED)
+}
+
+func (s *server) setState(ctx context.Context, id string, state query.PollStatus_State) (*query.PollStatus, error) {
+	pollid, err := s.authorize(ctx, id)
+	if err != nil {
+		return &query.PollStatus{}, err
+	}
+	ps, err := store.SetState(s.data, pollid, state)
+	if err != nil {
+		return &query.PollStatus{}, status.Errorf(codes.FailedPrecondition, "Error while changing poll state: %v", err)
+	}
+	return ps, nil
+}
+
+// GetVotes sends all votes saved in a poll to its owner.
+func (s *server) GetVotes(ctx context.Context, in *query.PollRequest) (*query.PollVotes, error) {
+	pollid, err := s.authorize(ctx, in.Pollid)
+	if err != nil {
+		return &query.PollVotes{}, err
+	}
+	votes, err := store.GetVotes(s.data, pollid)
+	if err != nil {
+		err = fmt.Errorf("Error in GetVotes while retrieving votes from database: %w", err)
+		return &query.PollVotes{}, err
+	}
+	return &query.PollVotes{
+		Pollid: in.Pollid,
+		Votes:  votes,
+	}, nil
+}
+
+// IssueTokens adds new tokens to a poll and sends them to its owner.
+//
+// Tokens supplied in request are saved, if there are none, server generates
+// requested number of random tokens. At most maxTokens are added at once.
+// Weight of tokens is at most maxWeight, as each weight class has its own key,
+// which is generated if poll has no key of this class yet.
+func (s *server) IssueTokens(ctx context.Context, in *query.IssueTokensRequest) (*query.IssueTokensReply, error) {
+	pollid, err := s.authorize(ctx, in.Pollid)
+	if err != nil {
+		return &query.IssueTokensReply{}, err
+	}
+
+	weight := in.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	if weight < 1 || weight > s.maxWeight {
+		return &query.IssueTokensReply{}, status.Errorf(codes.InvalidArgument, "Weight of tokens has to be between 1 and %v", s.maxWeight)
+	}
+	if err := s.ensureKey(pollid, weight); err != nil {
+		return &query.IssueTokensReply{}, err
+	}
+
+	if len(in.Tokens) > 0 {
+		if len(in.Tokens) > s.maxTokens {
+			return &query.IssueTokensReply{}, status.Errorf(codes.InvalidArgument, "At most %v tokens can be issued at once", s.maxTokens)
+		}
+		for _, token := range in.Tokens {
+			if !query.IsStringPrintable(token) {
+				return &query.IssueTokensReply{}, status.Errorf(codes.InvalidArgument, "Token contains invalid characters")
+			}
+		}
+		err := store.SaveTokens(s.data, pollid, in.Tokens, weight)
+		if err != nil {
+			return &query.IssueTokensReply{}, status.Errorf(codes.InvalidArgument, "Error in IssueTokens while saving tokens: %v", err)
+		}
+		return &query.IssueTokensReply{Tokens: in.Tokens}, nil
+	}
+
+	if in.Count <= 0 || int(in.Count) > s.maxTokens {
+		return &query.IssueTokensReply{}, status.Errorf(codes.InvalidArgument, "Number of tokens has to be between 1 and %v", s.maxTokens)
+	}
+	tokens, err := store.GenerateTokens(s.data, pollid, int(in.Count), weight)
+	if err != nil {
+		err = fmt.Errorf("Error in IssueTokens while generating tokens: %w", err)
+		return &query.IssueTokensReply{}, err
+	}
+	return &query.IssueTokensReply{Tokens: tokens}, nil
+}
+
+// ensureKey generates key of weight class, if poll doesn't have it yet.
+func (s *server) ensureKey(pollid int32, weight int32) error {
+	if _, err := store.GetWeightedKey(s.data, pollid, weight); err == nil {
+		return nil
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return fmt.Errorf("Error in IssueTokens during key generation: %w", err)
+	}
+	if _, err = store.AddWeightedKey(s.data, pollid, weight, key); err != nil {
+		return fmt.Errorf("Error in IssueTokens while saving key: %w", err)
+	}
+	return nil
+}
+
+// RevokeToken invalidates unused token of a poll.
+func (s *server) RevokeToken(ctx context.Context, in *query.TokenRequest) (*query.TokenStatus, error) {
+	pollid, err := s.authorize(ctx, in.Pollid)
+	if err != nil {
+		return &query.TokenStatus{}, err
+	}
+	ts, err := store.RevokeToken(s.data, in.Token, pollid)
+	if err != nil {
+		return &query.TokenStatus{}, status.Errorf(codes.FailedPrecondition, "Error in RevokeToken: %v", err)
+	}
+	return ts, nil
+}
+
+// ListTokens sends all tokens of a poll with their states to its owner.
+func (s *server) ListTokens(ctx context.Context, in *query.PollRequest) (*query.TokenList, error) {
+	pollid, err := s.authorize(ctx, in.Pollid)
+	if err != nil {
+		return &query.TokenList{}, err
+	}
+	tokens, err := store.ListTokens(s.data, pollid)
+	if err != nil {
+		err = fmt.Errorf("Error in ListTokens while reading tokens from database: %w", err)
+		return &query.TokenList{}, err
+	}
+	return &query.TokenList{
+		Pollid: in.Pollid,
+		Tokens: tokens,
+	}, nil
+}
+
+// ExportTokens sends unused tokens of a poll to its owner.
+func (s *server) ExportTokens(ctx context.Context, in *query.PollRequest) (*query.TokenExport, error) {
+	pollid, err := s.authorize(ctx, in.Pollid)
+	if err != nil {
+		return &query.TokenExport{}, err
+	}
+	tokens, err := store.GetTokens(s.data, pollid)
+	if err != nil {
+		err = fmt.Errorf("Error in ExportTokens while reading tokens from database: %w", err)
+		return &query.TokenExport{}, err
+	}
+	return &query.TokenExport{
+		Pollid: in.Pollid,
+		Tokens: tokens,
+	}, nil
+}
+
+// GetVotingLink sends signed voting link for unused token to poll's owner.
+func (s *server) GetVotingLink(ctx context.Context, in *query.TokenRequest) (*query.VotingLink, error) {
+	pollid, err := s.authorize(ctx, in.Pollid)
+	if err != nil {
+		return &query.VotingLink{}, err
+	}
+	tokens, err := store.GetTokens(s.data, pollid)
+	if err != nil {
+		err = fmt.Errorf("Error in GetVotingLink while reading tokens from database: %w", err)
+		return &query.VotingLink{}, err
+	}
+	found := false
+	for _, token := range tokens {
+		if token == in.Token {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return &query.VotingLink{}, status.Errorf(codes.NotFound, "No such unused token")
+	}
+
+	key, err := store.GetLinkKey(s.data, pollid)
+	if err != nil {
+		err = fmt.Errorf("Error in GetVotingLink while reading link key: %w", err)
+		return &query.VotingLink{}, err
+	}
+	link := links.New(s.publicURL, key, in.Pollid, in.Token)
+	png, err := links.QRPNG(link)
+	if err != nil {
+		return &query.VotingLink{}, err
+	}
+	svg, err := links.QRSVG(link)
+	if err != nil {
+		return &query.VotingLink{}, err
+	}
+	return &query.VotingLink{
+		Token: link.Token,
+		Url:   link.URL,
+		QrPng: png,
+		QrSvg: svg,
+	}, nil
+}
+
+// ExportVotingLinks sends voting links for all unused tokens of a poll to its owner.
+func (s *server) ExportVotingLinks(ctx context.Context, in *query.ExportRequest) (*query.ExportFile, error) {
+	pollid, err := s.authorize(ctx, in.Pollid)
+	if err != nil {
+		return &query.ExportFile{}, err
+	}
+	tokens, err := store.GetTokens(s.data, pollid)
+	if err != nil {
+		err = fmt.Errorf("Error in ExportVotingLinks while reading tokens from database: %w", err)
+		return &query.ExportFile{}, err
+	}
+	key, err := store.GetLinkKey(s.data, pollid)
+	if err != nil {
+		err = fmt.Errorf("Error in ExportVotingLinks while reading link key: %w", err)
+		return &query.ExportFile{}, err
+	}
+	var ls []links.Link
+	for _, token := range tokens {
+		ls = append(ls, links.New(s.publicURL, key, in.Pollid, token))
+	}
+
+	name := "links_" + in.Pollid
+	switch in.Format {
+	case query.ExportRequest_CSV:
+		data, err := links.CSV(ls)
+		if err != nil {
+			return &query.ExportFile{}, err
+		}
+		return &query.ExportFile{Name: name + ".csv", ContentType: "text/csv", Data: data}, nil
+	case query.ExportRequest_ZIP:
+		data, err := links.ZIP(in.Pollid, ls)
+		if err != nil {
+			return &query.ExportFile{}, err
+		}
+		return &query.ExportFile{Name: name + ".zip", ContentType: "application/zip", Data: data}, nil
+	}
+	return &query.ExportFile{}, status.Errorf(codes.InvalidArgument, "Unknown export format: %v", in.Format)
+}
+
+// InviteVoters sends invitations with voting links to email addresses.
+//
+// Each address gets new token. Address and token are used only to send email,
+// so server can't tell later, who got which token. If sending fails, token
+// is revoked and address is returned in reply. If token can't be revoked,
+// INTERNAL is returned, as it would stay valid.
+func (s *server) InviteVoters(ctx context.Context, in *query.InviteRequest) (*query.InviteReply, error) {
+	pollid, err := s.authorize(ctx, in.Pollid)
+	if err != nil {
+		return &query.InviteReply{}, err
+	}
+	if s.mailer == nil {
+		return &query.InviteReply{}, status.Errorf(codes.Unimplemented, "Sending emails is not configured")
+	}
+	if len(in.Addresses) > s.maxTokens {
+		return &query.InviteReply{}, status.Errorf(codes.InvalidArgument, "At most %v tokens can be issued at once", s.maxTokens)
+	}
+
+	subject, body := in.Subject, in.Body
+	if subject == "" {
+		subject = defaultInviteSubject
+	}
+	if body == "" {
+		body = defaultInviteBody
+	}
+	subjectTmpl, err := template.New("subject").Parse(subject)
+	if err != nil {
+		return &query.InviteReply{}, status.Errorf(codes.InvalidArgument, "Invalid subject template: %v", err)
+	}
+	bodyTmpl, err := template.New("body").Parse(body)
+	if err != nil {
+		return &query.InviteReply{}, status.Errorf(codes.InvalidArgument, "Invalid body template: %v", err)
+	}
+	// Templates are checked before any token is generated.
+	if _, err = renderInvitation(subjectTmpl, invitation{}); err != nil {
+		return &query.InviteReply{}, status.Errorf(codes.InvalidArgument, "Invalid subject template: %v", err)
+	}
+	if _, err = renderInvitation(bodyTmpl, invitation{}); err != nil {
+		return &query.InviteReply{}, status.Errorf(codes.InvalidArgument, "Invalid body template: %v", err)
+	}
+
+	key, err := store.GetLinkKey(s.data, pollid)
+	if err != nil {
+		err = fmt.Errorf("Error in InviteVoters while reading link key: %w", err)
+		return &query.InviteReply{}, err
+	}
+
+	reply := &query.InviteReply{}
+	for _, a := range in.Addresses {
+		addr, err := mail.ParseAddress(a)
+		if err != nil {
+			reply.Failed = append(reply.Failed, a)
+			continue
+		}
+
+		token := uuid.NewString()
+		if err = store.SaveToken(s.data, token, pollid); err != nil {
+			err = fmt.Errorf("Error in InviteVoters while saving token: %w", err)
+			return reply, err
+		}
+		link := links.New(s.publicURL, key, in.Pollid, token)
+		inv := invitation{
+			Pollid: in.Pollid,
+			Token:  token,
+			Link:   link.URL,
+		}
+
+		sub, err := renderInvitation(subjectTmpl, inv)
+		if err == nil {
+			var text string
+			text, err = renderInvitation(bodyTmpl, inv)
+			if err == nil {
+				err = s.mailer.Send(addr.Address, sub, text)
+			}
+		}
+		if err != nil {
+			// Token was not delivered, so nobody should be able to use it.
+			if _, rerr := store.RevokeToken(s.data, token, pollid); rerr != nil {
+				return reply, status.Errorf(codes.Internal, "Error in InviteVoters: invitation to %v was not sent and its token couldn't be revoked: %v", a, rerr)
+			}
+			reply.Failed = append(reply.Failed, a)
+			continue
+		}
+		reply.Sent++
+	}
+	return reply, nil
+}
+
+// checkVotingLink returns false if request is for a voting page with
+// token, which has invalid signature.
+//
+// Requests without token are for voting page, where voting link is pasted by voter.
+func (s *server) checkVotingLink(req *http.Request) bool {
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		return true
+	}
+	id := strings.TrimPrefix(req.URL.Path, "/vote/")
+	pollid, err := store.PollNumber(s.data, id)
+	if err != nil {
+		return false
+	}
+	return s.checkLinkSig(pollid, id, token, req.URL.Query().Get("sig")) == nil
+}
+
+// checkLinkSig returns error if token was not given out in a voting link
+// signed by server.
+//
+// Pollid is a number of poll with random identifier id.
+func (s *server) checkLinkSig(pollid int32, id, token, sig string) error {
+	key, err := store.GetLinkKey(s.data, pollid)
+	if err != nil {
+		return fmt.Errorf("Error while reading link key: %w", err)
+	}
+	if !links.Verify(key, id, token, sig) {
+		return status.Errorf(codes.PermissionDenied, "Token is not from a valid voting link")
+	}
+	return nil
+}
+
+// authorize returns error if request was not sent by poll's owner.
+//
+// Owner is recognized by admin key sent in query.AdminKeyHeader metadata entry.
+// If request is authorized, number of poll with given id is returned.
+func (s *server) authorize(ctx context.Context, id string) (int32, error) {
+	key, ok := headerValue(ctx, query.AdminKeyHeader)
+	if !ok {
+		return 0, status.Errorf(codes.Unauthenticated, "Admin key is required")
+	}
+	pollid, err := store.PollNumber(s.data, id)
+	if err == nil {
+		err = store.CheckAdminKey(s.data, pollid, key)
+	}
+	if err != nil {
+		return 0, status.Errorf(codes.PermissionDenied, "Error while checking admin key: %v", err)
+	}
+	return pollid, nil
+}
+
+// owner returns identifier of owner, whose key is sent in query.OwnerKeyHeader
+// metadata entry.
+func (s *server) owner(ctx context.Context) ([]byte, error) {
+	key, ok := headerValue(ctx, query.OwnerKeyHeader)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "Owner key is required")
+	}
+	owner, err := store.CheckOwner(s.data, key)
+	if err != nil {
+		return nil, status.Errorf(codes.PermissionDenied, "Error while checking owner key: %v", err)
+	}
+	return owner, nil
+}
+
+// optionalOwner is like owner, but returns nil if owner key wasn't sent.
+func (s *server) optionalOwner(ctx context.Context) ([]byte, error) {
+	if _, ok := headerValue(ctx, query.OwnerKeyHeader); !ok {
+		return nil, nil
+	}
+	return s.owner(ctx)
+}
+
+// headerValue reads value of gRPC metadata entry with given name.
+func headerValue(ctx context.Context, name string) (string, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(name)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// pollNumber returns number in database of poll with given id.
+func (s *server) pollNumber(id string) (int32, error) {
+	pollid, err := store.PollNumber(s.data, id)
+	if err != nil {
+		return 0, status.Errorf(codes.NotFound, "Error while reading poll: %v", err)
+	}
+	return pollid, nil
+}
+
+// checkOpen returns error if poll doesn't accept votes.
+func (s *server) checkOpen(pollid int32) error {
+	ps, err := store.GetStatus(s.data, pollid)
+	if err != nil {
+		return err
+	}
+	if ps.State != query.PollStatus_OPEN {
+		return status.Errorf(codes.FailedPrecondition, "Poll is %v, votes are not accepted", ps.State)
+	}
+	return nil
 }
 
 func serverInit(dbfilename string) (*server, error) {
 	var err error
-	s := &server{}
+	s := &server{
+		maxTokens: defaultMaxTokens,
+		maxWeight: defaultMaxWeight,
+		publicURL: "http://localhost" + port,
+	}
 
 	s.data, err = store.DBInit(dbfilename)
 	if err != nil {
@@ -160,12 +934,20 @@ func stringContainSomeElement(s string, match []string) bool {
 }
 
 func main() {
+	flag.Parse()
+
 	s := grpc.NewServer()
 	service, err := serverInit("data.db")
 	if err != nil {
 		fmt.Printf("Error in serverInit: %v", err)
 		os.Exit(1)
 	}
+	service.maxTokens = *maxTokens
+	service.maxWeight = int32(*maxWeight)
+	service.publicURL = *publicURL
+	if *smtpAddr != "" {
+		service.mailer = newSMTPMailer(*smtpAddr, *smtpFrom, *smtpUser, os.Getenv("RADA_SMTP_PASSWORD"))
+	}
 
 	defer service.data.Close()
 	query.RegisterQueryServer(s, service)
@@ -177,6 +959,10 @@ func main() {
 		if strings.Contains(req.URL.Path, "query.Query") {
 			wrappedGrpc.ServeHTTP(resp, req)
 		} else {
+			if strings.HasPrefix(req.URL.Path, "/vote/") && !service.checkVotingLink(req) {
+				http.Error(resp, "Invalid voting link", http.StatusForbidden)
+				return
+			}
 			subpages := []string{"pollinit", "vote", "results"}
 			if stringContainSomeElement(req.URL.Path, subpages) {
 				req.URL.Path = "/"
@@ -1,17 +1,32 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/sha256"
 	"crypto/x509"
-	"math/big"
+	"encoding/csv"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/ememak/Projekt-Rada/bsign"
+	"github.com/ememak/Projekt-Rada/links"
+	"github.com/ememak/Projekt-Rada/query"
 	"github.com/ememak/Projekt-Rada/store"
+	"github.com/ememak/Projekt-Rada/voteclient"
 	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 func TestPollInit(t *testing.T) {
@@ -22,9 +37,13 @@ func TestPollInit(t *testing.T) {
 		s, _ := serverInit("testPI" + strconv.Itoa(i) + ".db")
 		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
 			ctx := context.Background()
-			poll, err := s.PollInit(ctx, test)
-			if !(proto.Equal(poll.Schema, out[i].exp_out.Schema) &&
-				reflect.DeepEqual(poll.Id, out[i].exp_out.Id) &&
+			poll, err := s.PollInit(ctx, &query.PollInitRequest{Schema: test})
+			var sch *query.PollSchema
+			if err == nil {
+				sch, _ = store.GetSchema(s.data, 1)
+			}
+			if !(proto.Equal(sch, out[i].exp_out.Schema) &&
+				validPollID(poll.Id, err) &&
 				reflect.DeepEqual(err, out[i].exp_err)) {
 				t.Errorf("Output %v, want output %v", poll, out[i].exp_out)
 				t.Errorf("Error %v, want error %v", err, out[i].exp_err)
@@ -38,10 +57,14 @@ func TestPollInit(t *testing.T) {
 		s, _ := serverInit("testPI" + strconv.Itoa(len(in)+i) + ".db")
 		t.Run("Test "+strconv.Itoa(len(in)+i), func(t *testing.T) {
 			ctx := context.Background()
-			s.PollInit(ctx, test)
-			poll, err := s.PollInit(ctx, test)
-			if !(proto.Equal(poll.Schema, out[i].exp_out.Schema) &&
-				reflect.DeepEqual(poll.Id, out[i].exp_out.Id) &&
+			first, _ := s.PollInit(ctx, &query.PollInitRequest{Schema: test})
+			poll, err := s.PollInit(ctx, &query.PollInitRequest{Schema: test})
+			var sch *query.PollSchema
+			if err == nil {
+				sch, _ = store.GetSchema(s.data, 2)
+			}
+			if !(proto.Equal(sch, out[i].exp_out.Schema) &&
+				validPollID(poll.Id, err) && (err != nil || poll.Id != first.Id) &&
 				reflect.DeepEqual(err, out[i].exp_err)) {
 				t.Errorf("Output %v, want output %v", poll, out[i].exp_out)
 				t.Errorf("Error %v, want error %v", err, out[i].exp_err)
@@ -50,6 +73,34 @@ func TestPollInit(t *testing.T) {
 	}
 }
 
+func TestPollInitTokens(t *testing.T) {
+	in := testsPollInitTokens
+	for i, test := range in {
+
+		s, _ := serverInit("testPT" + strconv.Itoa(i) + ".db")
+		s.maxTokens = test.maxTokens
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			ctx := context.Background()
+			poll, err := s.PollInit(ctx, &query.PollInitRequest{
+				Schema: &query.PollSchema{},
+				Tokens: test.tokens,
+			})
+			if status.Code(err) != test.exp_err {
+				t.Errorf("Error %v, want error code %v", err, test.exp_err)
+			}
+			if err != nil {
+				return
+			}
+			te, err := s.ExportTokens(adminContext(poll.AdminKey), &query.PollRequest{Pollid: poll.Id})
+			if err != nil || len(te.Tokens) != test.exp_out {
+				t.Errorf("Got %v tokens, want %v tokens", len(te.Tokens), test.exp_out)
+				t.Errorf("Error %v, want nil error", err)
+			}
+		})
+		s.data.Close()
+	}
+}
+
 func TestGetPoll(t *testing.T) {
 	in := testsGetPollIn
 	out := testsGetPollOut
@@ -58,8 +109,8 @@ func TestGetPoll(t *testing.T) {
 		s, _ := serverInit("testGP" + strconv.Itoa(i) + ".db")
 		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
 			ctx := context.Background()
-			s.PollInit(ctx, test.schema)
-			pwk, err := s.GetPoll(ctx, test.pollreq)
+			poll, _ := s.PollInit(ctx, &query.PollInitRequest{Schema: test.schema})
+			pwk, err := s.GetPoll(ctx, &query.GetPollRequest{Pollid: pollOrDefault(test.pollreq.Pollid, poll.Id)})
 			if !(proto.Equal(pwk.Poll, out[i].exp_out) && reflect.DeepEqual(err, out[i].exp_err)) {
 				t.Errorf("Output %v, want output %v", pwk.Poll, out[i].exp_out)
 				t.Errorf("Error %v, want error %v", err, out[i].exp_err)
@@ -86,9 +137,14 @@ func TestSignBallot(t *testing.T) {
 		s, _ := serverInit("testSB" + strconv.Itoa(i) + ".db")
 		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
 			ctx := context.Background()
-			s.PollInit(ctx, test.schema)
+			poll, _ := s.PollInit(ctx, &query.PollInitRequest{Schema: test.schema})
 			store.SaveToken(s.data, "Good token", 1)
-			se, err := s.SignBallot(ctx, test.envelope)
+			envelope := proto.Clone(test.envelope).(*query.EnvelopeToSign)
+			envelope.Pollid = pollOrDefault(envelope.Pollid, poll.Id)
+			if envelope.Sig == "" {
+				envelope.Sig = linkSig(s, envelope.Pollid, envelope.Token)
+			}
+			se, err := s.SignBallot(ctx, envelope)
 			if !reflect.DeepEqual(err, test.exp_err) {
 				t.Errorf("Error %v, want error %v", err, test.exp_err)
 				return
@@ -112,12 +168,28 @@ func TestPollVote(t *testing.T) {
 		s, _ := serverInit("testPV" + strconv.Itoa(i) + ".db")
 		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
 			ctx := context.Background()
-			s.PollInit(ctx, test.schema)
+			poll, _ := s.PollInit(ctx, &query.PollInitRequest{Schema: test.schema})
 			store.SaveToken(s.data, "Good token", 1)
-			se, _ := s.SignBallot(ctx, test.envelope)
-			test.votereq.Sign.Sign = se.Sign
-			vr, err := s.PollVote(ctx, test.votereq)
-			if !(proto.Equal(vr, test.exp_out) && reflect.DeepEqual(err, test.exp_err)) {
+			votereq := proto.Clone(test.votereq).(*query.VoteRequest)
+			votereq.Pollid = pollOrDefault(votereq.Pollid, poll.Id)
+			signed := votereq.Answers
+			if test.signed != nil {
+				signed = test.signed
+			}
+			ballot := signed.Commitment(votereq.Nonce)
+			if votereq.Sign.Ballot == nil {
+				votereq.Sign.Ballot = ballot
+			}
+			key, _ := store.GetKey(s.data, 1)
+			envelope, inv, _ := bsign.Blind(&key.PublicKey, ballot)
+			req := proto.Clone(test.envelope).(*query.EnvelopeToSign)
+			req.Pollid = pollOrDefault(req.Pollid, poll.Id)
+			req.Sig = linkSig(s, req.Pollid, req.Token)
+			req.Envelope = envelope
+			se, _ := s.SignBallot(ctx, req)
+			votereq.Sign.Sign, _ = bsign.Finalize(&key.PublicKey, ballot, se.Sign, inv)
+			vr, err := s.PollVote(ctx, votereq)
+			if !(proto.Equal(withoutRevoteKey(vr), test.exp_out) && reflect.DeepEqual(err, test.exp_err)) {
 				t.Errorf("Output %v, want output %v", vr, test.exp_out)
 				t.Errorf("Error %v, want error %v", err, test.exp_err)
 				return
@@ -127,6 +199,423 @@ func TestPollVote(t *testing.T) {
 	}
 }
 
+func TestPollState(t *testing.T) {
+	in := testsPollState
+	for i, test := range in {
+
+		s, _ := serverInit("testPS" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			ctx := context.Background()
+			poll, _ := s.PollInit(ctx, &query.PollInitRequest{Schema: test.schema})
+			store.SaveToken(s.data, "Good token", 1)
+			if test.close {
+				ps, err := s.ClosePoll(adminContext(poll.AdminKey), &query.PollRequest{Pollid: poll.Id})
+				if err != nil || ps.State != query.PollStatus_CLOSED {
+					t.Errorf("State %v, want state %v", ps.State, query.PollStatus_CLOSED)
+					t.Errorf("Error %v, want nil error", err)
+				}
+			}
+
+			envelope := proto.Clone(test.envelope).(*query.EnvelopeToSign)
+			envelope.Pollid = poll.Id
+			envelope.Sig = linkSig(s, poll.Id, envelope.Token)
+			_, err := s.SignBallot(ctx, envelope)
+			if status.Code(err) != test.exp_sb {
+				t.Errorf("Error %v, want error code %v", err, test.exp_sb)
+			}
+			_, err = s.GetSummary(ctx, &query.SummaryRequest{Pollid: poll.Id})
+			if status.Code(err) != test.exp_gs {
+				t.Errorf("Error %v, want error code %v", err, test.exp_gs)
+			}
+		})
+		s.data.Close()
+	}
+}
+
+func TestResults(t *testing.T) {
+	in := testsResults
+	for i, test := range in {
+
+		s, _ := serverInit("testRS" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			ctx := context.Background()
+			poll, _ := s.PollInit(ctx, &query.PollInitRequest{Schema: test.schema})
+			if test.close {
+				s.ClosePoll(adminContext(poll.AdminKey), &query.PollRequest{Pollid: poll.Id})
+			}
+			if test.owner {
+				ctx = adminContext(poll.AdminKey)
+			}
+
+			_, err := s.GetSummary(ctx, &query.SummaryRequest{Pollid: poll.Id})
+			if status.Code(err) != test.exp_gs {
+				t.Errorf("Error %v, want error code %v", err, test.exp_gs)
+			}
+		})
+		s.data.Close()
+	}
+}
+
+func TestAdminKey(t *testing.T) {
+	in := testsAdminKey
+	for i, test := range in {
+
+		s, _ := serverInit("testAK" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			ctx := context.Background()
+			poll, _ := s.PollInit(ctx, &query.PollInitRequest{Schema: &query.PollSchema{}})
+			if poll.AdminKey == "" {
+				t.Errorf("PollInit returned empty admin key")
+			}
+			if test.useAdminKey {
+				ctx = adminContext(poll.AdminKey)
+			} else if test.key != "" {
+				ctx = adminContext(test.key)
+			}
+
+			pollid := pollOrDefault(test.pollid, poll.Id)
+			_, err := s.GetVotes(ctx, &query.PollRequest{Pollid: pollid})
+			if status.Code(err) != test.exp_err {
+				t.Errorf("Error %v, want error code %v", err, test.exp_err)
+			}
+			_, err = s.ClosePoll(ctx, &query.PollRequest{Pollid: pollid})
+			if status.Code(err) != test.exp_err {
+				t.Errorf("Error %v, want error code %v", err, test.exp_err)
+			}
+		})
+		s.data.Close()
+	}
+}
+
+func TestIssueTokens(t *testing.T) {
+	in := testsIssueTokens
+	for i, test := range in {
+
+		s, _ := serverInit("testIT" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			poll, _ := s.PollInit(context.Background(), &query.PollInitRequest{Schema: &query.PollSchema{}})
+			store.SaveToken(s.data, "Good token", 1)
+			ctx := context.Background()
+			if test.owner {
+				ctx = adminContext(poll.AdminKey)
+			}
+
+			in := proto.Clone(test.in).(*query.IssueTokensRequest)
+			in.Pollid = poll.Id
+			it, err := s.IssueTokens(ctx, in)
+			if status.Code(err) != test.exp_err || len(it.Tokens) != test.exp_out {
+				t.Errorf("Got %v tokens, want %v tokens", len(it.Tokens), test.exp_out)
+				t.Errorf("Error %v, want error code %v", err, test.exp_err)
+			}
+			// Issued tokens can be used for voting.
+			for _, token := range it.Tokens {
+				err = store.AcceptToken(s.data, token, 1)
+				if err != nil {
+					t.Errorf("Token %v not accepted, error: %v", token, err)
+				}
+			}
+		})
+		s.data.Close()
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	in := testsRevokeToken
+	for i, test := range in {
+
+		s, _ := serverInit("testRT" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			poll, _ := s.PollInit(context.Background(), &query.PollInitRequest{Schema: &query.PollSchema{}, Tokens: 1})
+			ctx := context.Background()
+			if test.owner {
+				ctx = adminContext(poll.AdminKey)
+			}
+			token := test.token
+			if token == "" {
+				te, _ := s.ExportTokens(adminContext(poll.AdminKey), &query.PollRequest{Pollid: poll.Id})
+				token = te.Tokens[0]
+			}
+
+			_, err := s.RevokeToken(ctx, &query.TokenRequest{Pollid: poll.Id, Token: token})
+			if status.Code(err) != test.exp_err {
+				t.Errorf("Error %v, want error code %v", err, test.exp_err)
+			}
+			tl, err := s.ListTokens(ctx, &query.PollRequest{Pollid: poll.Id})
+			if status.Code(err) != test.exp_lt {
+				t.Errorf("Error %v, want error code %v", err, test.exp_lt)
+			}
+			if err == nil && (len(tl.Tokens) != 1 || tl.Tokens[0].State != test.exp_state) {
+				t.Errorf("Tokens %v, want one token in state %v", tl.Tokens, test.exp_state)
+			}
+		})
+		s.data.Close()
+	}
+}
+
+func TestVotingLink(t *testing.T) {
+	in := testsVotingLink
+	for i, test := range in {
+
+		s, _ := serverInit("testVL" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			poll, _ := s.PollInit(context.Background(), &query.PollInitRequest{Schema: &query.PollSchema{}, Tokens: 1})
+			ctx := adminContext(poll.AdminKey)
+			token := test.token
+			if token == "" {
+				te, _ := s.ExportTokens(ctx, &query.PollRequest{Pollid: poll.Id})
+				token = te.Tokens[0]
+			}
+
+			vl, err := s.GetVotingLink(ctx, &query.TokenRequest{Pollid: poll.Id, Token: token})
+			if status.Code(err) != test.exp_err {
+				t.Errorf("Error %v, want error code %v", err, test.exp_err)
+			}
+			if err != nil {
+				return
+			}
+			if !bytes.HasPrefix(vl.QrPng, []byte("\x89PNG")) || !strings.HasPrefix(vl.QrSvg, "<svg") {
+				t.Errorf("Invalid QR codes for link %v", vl.Url)
+			}
+
+			req := httptest.NewRequest("GET", strings.NewReplacer(test.replace...).Replace(vl.Url), nil)
+			if s.checkVotingLink(req) != test.exp_valid {
+				t.Errorf("Link %v valid: %v, want %v", req.URL, !test.exp_valid, test.exp_valid)
+			}
+		})
+		s.data.Close()
+	}
+}
+
+func TestExportVotingLinks(t *testing.T) {
+	in := testsExportVotingLinks
+	for i, test := range in {
+
+		s, _ := serverInit("testEL" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			poll, _ := s.PollInit(context.Background(), &query.PollInitRequest{Schema: &query.PollSchema{}, Tokens: 3})
+			ctx := adminContext(poll.AdminKey)
+
+			ef, err := s.ExportVotingLinks(ctx, &query.ExportRequest{Pollid: poll.Id, Format: test.format})
+			name := ""
+			if test.exp_ext != "" {
+				name = "links_" + poll.Id + test.exp_ext
+			}
+			if status.Code(err) != test.exp_err || ef.Name != name {
+				t.Errorf("File %v, want file %v", ef.Name, name)
+				t.Errorf("Error %v, want error code %v", err, test.exp_err)
+			}
+
+			files := 0
+			switch test.format {
+			case query.ExportRequest_CSV:
+				records, _ := csv.NewReader(bytes.NewReader(ef.Data)).ReadAll()
+				files = len(records)
+			case query.ExportRequest_ZIP:
+				zr, err := zip.NewReader(bytes.NewReader(ef.Data), int64(len(ef.Data)))
+				if err == nil {
+					files = len(zr.File)
+				}
+			}
+			if files != test.exp_files {
+				t.Errorf("Got %v entries, want %v entries", files, test.exp_files)
+			}
+		})
+		s.data.Close()
+	}
+}
+
+func TestInviteVoters(t *testing.T) {
+	in := testsInviteVoters
+	for i, test := range in {
+
+		dbname := "testIV" + strconv.Itoa(i) + ".db"
+		s, _ := serverInit(dbname)
+		addr, mails := fakeSMTP(t)
+		s.mailer = newSMTPMailer(addr, "rada@localhost", "", "")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			poll, _ := s.PollInit(context.Background(), &query.PollInitRequest{Schema: &query.PollSchema{}, Tokens: 1})
+			ctx := adminContext(poll.AdminKey)
+			test.in.Pollid = poll.Id
+
+			ir, err := s.InviteVoters(ctx, test.in)
+			if status.Code(err) != test.exp_err || int(ir.Sent) != test.exp_sent || len(ir.Failed) != len(test.exp_failed) {
+				t.Errorf("Reply %v, want %v sent and failed %v", ir, test.exp_sent, test.exp_failed)
+				t.Errorf("Error %v, want error code %v", err, test.exp_err)
+			}
+
+			// Every sent invitation contains a valid link with new token.
+			for j := 0; j < int(ir.GetSent()); j++ {
+				mail := <-mails
+				if !strings.Contains(mail, test.exp_text) {
+					t.Errorf("Mail %v, want mail containing %v", mail, test.exp_text)
+				}
+				// All lines end with CRLF.
+				if rest := strings.ReplaceAll(mail, "\r\n", ""); strings.ContainsAny(rest, "\r\n") {
+					t.Errorf("Mail %q has line endings other than CRLF", mail)
+				}
+				start := strings.Index(mail, "http://")
+				end := strings.Index(mail[start:], "\r\n")
+				req := httptest.NewRequest("GET", mail[start:start+end], nil)
+				if !s.checkVotingLink(req) {
+					t.Errorf("Invalid link %v in invitation", req.URL)
+				}
+				if err := store.AcceptToken(s.data, req.URL.Query().Get("token"), 1); err != nil {
+					t.Errorf("Token from invitation not accepted, error: %v", err)
+				}
+			}
+		})
+		s.data.Close()
+
+		// Addresses are never saved in database.
+		data, _ := os.ReadFile(dbname)
+		for _, a := range test.in.Addresses {
+			if bytes.Contains(data, []byte(a)) {
+				t.Errorf("Address %v saved in database", a)
+			}
+		}
+	}
+}
+
+// usingMailer is a Mailer which fails to send invitations after using their tokens.
+type usingMailer struct {
+	s *server
+}
+
+func (m usingMailer) Send(to, subject, body string) error {
+	start := strings.Index(body, "token=")
+	token := strings.Fields(body[start+len("token="):])[0]
+	token = strings.SplitN(token, "&", 2)[0]
+	if err := store.AcceptToken(m.s.data, token, 1); err != nil {
+		return err
+	}
+	return fmt.Errorf("Mailbox unavailable")
+}
+
+func TestInviteRevokeFailure(t *testing.T) {
+	s, _ := serverInit("testIRF.db")
+	defer s.data.Close()
+	s.mailer = usingMailer{s}
+	poll, _ := s.PollInit(context.Background(), &query.PollInitRequest{Schema: &query.PollSchema{}, Tokens: 1})
+
+	// Token of failed invitation can't be revoked, so the whole request fails.
+	_, err := s.InviteVoters(adminContext(poll.AdminKey), &query.InviteRequest{
+		Pollid:    poll.Id,
+		Addresses: []string{"alice@example.com"},
+	})
+	if status.Code(err) != codes.Internal {
+		t.Errorf("Error %v, want error code %v", err, codes.Internal)
+	}
+}
+
+// fakeSMTP starts SMTP server accepting all emails and sending their content to mails.
+func fakeSMTP(t *testing.T) (string, chan string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start fake SMTP server: %v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	mails := make(chan string, 100)
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				fmt.Fprintf(conn, "220 localhost\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+					case strings.HasPrefix(cmd, "DATA"):
+						fmt.Fprintf(conn, "354 Go ahead\r\n")
+						var mail strings.Builder
+						for {
+							line, err := r.ReadString('\n')
+							if err != nil || line == ".\r\n" {
+								break
+							}
+							mail.WriteString(line)
+						}
+						mails <- mail.String()
+						fmt.Fprintf(conn, "250 OK\r\n")
+					case strings.HasPrefix(cmd, "QUIT"):
+						fmt.Fprintf(conn, "221 Bye\r\n")
+						return
+					default:
+						fmt.Fprintf(conn, "250 OK\r\n")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return lis.Addr().String(), mails
+}
+
+// pollOrDefault returns id of poll from test data, or id of poll created by
+// the test, if test data doesn't specify poll.
+func pollOrDefault(id, created string) string {
+	if id == "" {
+		return created
+	}
+	return id
+}
+
+// validPollID checks if id returned with err is a random identifier of a poll.
+func validPollID(id string, err error) bool {
+	if err != nil {
+		return id == ""
+	}
+	if len(id) != 26 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= '2' && c <= '7') {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutRevoteKey returns copy of vote reply without random revote key,
+// so it can be compared with test data.
+func withoutRevoteKey(vr *query.VoteReply) *query.VoteReply {
+	if vr == nil {
+		return nil
+	}
+	vr = proto.Clone(vr).(*query.VoteReply)
+	vr.RevoteKey = nil
+	return vr
+}
+
+// linkSig returns signature of token from voting link of poll with given id,
+// or empty string if there is no such poll.
+func linkSig(s *server, id, token string) string {
+	pollid, err := store.PollNumber(s.data, id)
+	if err != nil {
+		return ""
+	}
+	key, err := store.GetLinkKey(s.data, pollid)
+	if err != nil {
+		return ""
+	}
+	return links.Sign(key, id, token)
+}
+
+// adminContext returns context of a request sent with admin key.
+func adminContext(key string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(query.AdminKeyHeader, key))
+}
+
+func ownerContext(key string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(query.OwnerKeyHeader, key))
+}
+
 func TestEntireProtocol(t *testing.T) {
 	test := testsEntireProtocol
 	t.Run("Full Test", func(t *testing.T) {
@@ -136,11 +625,14 @@ func TestEntireProtocol(t *testing.T) {
 			return
 		}
 		ctx := context.Background()
-		_, err = s.PollInit(ctx, test.schema)
+		poll, err := s.PollInit(ctx, &query.PollInitRequest{Schema: test.schema})
 		if err != nil {
 			t.Errorf("PollInit failed, error: %v", err)
 			return
 		}
+		test.pollreq.Pollid = poll.Id
+		test.envelope.Pollid = poll.Id
+		test.votereq.Pollid = poll.Id
 		pwk, err := s.GetPoll(ctx, test.pollreq)
 		if err != nil {
 			t.Errorf("GetPoll failed, error: %v", err)
@@ -156,26 +648,15 @@ func TestEntireProtocol(t *testing.T) {
 			t.Errorf("SaveToken failed, error: %v", err)
 			return
 		}
-		// Generate ballot to be signed.
-		ballot, err := rand.Int(rand.Reader, key.N)
-		if err != nil {
-			t.Errorf("Rand.Int failed, error: %v", err)
-			return
-		}
-		// We are hashing ballot.
-		hash := sha256.Sum256([]byte(ballot.Text(10)))
-		m := new(big.Int).SetBytes(hash[:])
-		// Get random blinding factor.
-		r, err := rand.Int(rand.Reader, key.N)
+		// Ballot to be signed is a commitment to answers.
+		ballot := test.votereq.Answers.Commitment(test.votereq.Nonce)
+		envelope, inv, err := bsign.Blind(key, ballot)
 		if err != nil {
-			t.Errorf("Rand.Int failed, error: %v", err)
+			t.Errorf("Blind failed, error: %v", err)
 			return
 		}
-		// We want to send m*r^e mod N to server.
-		bfactor := new(big.Int).Exp(r, big.NewInt(int64(key.E)), key.N)
-		// blinded = m*(r^e) mod N
-		blinded := bfactor.Mod(bfactor.Mul(bfactor, m), key.N)
-		test.envelope.Envelope = blinded.Bytes()
+		test.envelope.Envelope = envelope
+		test.envelope.Sig = linkSig(s, poll.Id, test.envelope.Token)
 
 		se, err := s.SignBallot(ctx, test.envelope)
 		if err != nil {
@@ -183,15 +664,14 @@ func TestEntireProtocol(t *testing.T) {
 			return
 		}
 
-		// Having (m^d)*r mod N we are removing blinding factor r,
-		smi := new(big.Int).SetBytes(se.Sign)
-		revr := new(big.Int).ModInverse(r, key.N)
-		smirevr := new(big.Int).Mul(revr, smi)
-		// Now we can calculate second part of sign.
-		// sign = smirevr mod N = m^d mod N
-		sign := new(big.Int).Mod(smirevr, key.N)
-		test.votereq.Sign.Ballot = ballot.Bytes()
-		test.votereq.Sign.Sign = sign.Bytes()
+		// Finalize removes blinding factor and verifies sign.
+		sign, err := bsign.Finalize(key, ballot, se.Sign, inv)
+		if err != nil {
+			t.Errorf("Finalize failed, error: %v", err)
+			return
+		}
+		test.votereq.Sign.Ballot = ballot
+		test.votereq.Sign.Sign = sign
 		_, err = s.PollVote(ctx, test.votereq)
 		if err != nil {
 			t.Errorf("PollVote failed, error: %v", err)
@@ -199,3 +679,543 @@ func TestEntireProtocol(t *testing.T) {
 		}
 	})
 }
+
+// dialServer serves s through in-memory connection and returns client connected to it.
+func dialServer(s *server) (*grpc.ClientConn, func(), error) {
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	query.RegisterQueryServer(gs, s)
+	go gs.Serve(lis)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.Dial()
+		}),
+		grpc.WithInsecure())
+	if err != nil {
+		gs.Stop()
+		return nil, nil, err
+	}
+	return conn, func() {
+		conn.Close()
+		gs.Stop()
+	}, nil
+}
+
+func TestClient(t *testing.T) {
+	in := testsClient
+	for i, test := range in {
+
+		s, _ := serverInit("testCL" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			ctx := context.Background()
+			poll, _ := s.PollInit(ctx, &query.PollInitRequest{Schema: test.schema})
+			store.SaveToken(s.data, "Good token", 1)
+
+			conn, stop, err := dialServer(s)
+			if err != nil {
+				t.Errorf("Dial failed, error: %v", err)
+				return
+			}
+			defer stop()
+
+			c := voteclient.New(conn)
+			sig := test.sig
+			if sig == "" {
+				sig = linkSig(s, poll.Id, test.token)
+			}
+			vr, err := c.Vote(ctx, pollOrDefault(test.pollid, poll.Id), test.token, sig, test.answers)
+			if err != nil {
+				if err.Error() != test.exp_err {
+					t.Errorf("Error %v, want error %v", err, test.exp_err)
+				}
+				return
+			}
+			if test.exp_err != "" || !proto.Equal(withoutRevoteKey(vr), test.exp_out) {
+				t.Errorf("Output %v, want output %v", vr, test.exp_out)
+				t.Errorf("Error %v, want error %v", err, test.exp_err)
+			}
+		})
+		s.data.Close()
+	}
+}
+
+func TestWeightedVotes(t *testing.T) {
+	in := testsWeightedVotes
+	for i, test := range in {
+
+		s, _ := serverInit("testWV" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			sch := &query.PollSchema{
+				Questions: []*query.PollSchema_QA{
+					{
+						Question: "Do you agree?",
+						Options:  []string{"yes", "no"},
+						Type:     query.PollSchema_CLOSE,
+						Answers:  []string{"0", "0"},
+					},
+				},
+			}
+			poll, _ := s.PollInit(context.Background(), &query.PollInitRequest{Schema: sch})
+			it, err := s.IssueTokens(adminContext(poll.AdminKey), &query.IssueTokensRequest{
+				Pollid: poll.Id,
+				Count:  1,
+				Weight: test.weight,
+			})
+			if err != nil {
+				t.Fatalf("IssueTokens failed, error: %v", err)
+			}
+
+			conn, stop, err := dialServer(s)
+			if err != nil {
+				t.Fatalf("Dial failed, error: %v", err)
+			}
+			defer stop()
+
+			ctx := context.Background()
+			c := voteclient.New(conn)
+			vp, err := c.GetPoll(ctx, poll.Id)
+			if err != nil {
+				t.Fatalf("GetPoll failed, error: %v", err)
+			}
+			answers := &query.PollSchema{
+				Questions: []*query.PollSchema_QA{
+					{
+						Question: "Do you agree?",
+						Options:  []string{"yes", "no"},
+						Type:     query.PollSchema_CLOSE,
+						Answers:  []string{"true", "false"},
+					},
+				},
+			}
+			nonce, _ := voteclient.NewNonce()
+			sign, weight, err := c.Authorize(ctx, vp, it.Tokens[0], linkSig(s, poll.Id, it.Tokens[0]), answers.Commitment(nonce))
+			if err != nil {
+				t.Fatalf("Authorize failed, error: %v", err)
+			}
+			if test.claim != 0 {
+				weight = test.claim
+			}
+			_, err = c.Send(ctx, vp, answers, nonce, sign, weight)
+			if (err != nil) != test.exp_err {
+				t.Errorf("Error %v, want error: %v", err, test.exp_err)
+			}
+
+			ps, err := s.GetSummary(adminContext(poll.AdminKey), &query.SummaryRequest{Pollid: poll.Id})
+			if err != nil || ps.Schema.Questions[0].Answers[0] != test.exp_count {
+				t.Errorf("Count of yes %v, want %v", ps.GetSchema().GetQuestions(), test.exp_count)
+				t.Errorf("Error %v, want nil error", err)
+			}
+		})
+		s.data.Close()
+	}
+}
+
+func TestRevote(t *testing.T) {
+	in := testsRevote
+	for i, test := range in {
+
+		s, _ := serverInit("testRV" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			ctx := context.Background()
+			question := &query.PollSchema_QA{
+				Question: "Do you agree?",
+				Options:  []string{"yes", "no"},
+				Type:     query.PollSchema_CLOSE,
+			}
+			p, _ := s.PollInit(ctx, &query.PollInitRequest{Schema: &query.PollSchema{
+				Questions: []*query.PollSchema_QA{question},
+				Policy:    test.policy,
+			}})
+			store.SaveToken(s.data, "Good token", 1)
+
+			conn, stop, err := dialServer(s)
+			if err != nil {
+				t.Fatalf("Dial failed, error: %v", err)
+			}
+			defer stop()
+
+			c := voteclient.New(conn)
+			poll, err := c.GetPoll(ctx, p.Id)
+			if err != nil {
+				t.Fatalf("GetPoll failed, error: %v", err)
+			}
+			answers := &query.PollSchema{Questions: []*query.PollSchema_QA{proto.Clone(question).(*query.PollSchema_QA)}}
+			answers.Questions[0].Answers = []string{"true", "false"}
+			b := &query.Ballot{
+				Version: query.BallotVersion,
+				Answers: []*query.Ballot_Answer{{Question: 0, Selected: []int32{0}}},
+			}
+			nonce, _ := voteclient.NewNonce()
+			ballot := answers.Commitment(nonce)
+			if test.ballot {
+				ballot = b.Commitment(nonce)
+			}
+			sign, weight, err := c.Authorize(ctx, poll, "Good token", linkSig(s, poll.Id, "Good token"), ballot)
+			if err != nil {
+				t.Fatalf("Authorize failed, error: %v", err)
+			}
+			var vr *query.VoteReply
+			if test.ballot {
+				vr, err = c.SendBallot(ctx, poll, b, nonce, sign, weight)
+			} else {
+				vr, err = c.Send(ctx, poll, answers, nonce, sign, weight)
+			}
+			if err != nil {
+				t.Fatalf("Send failed, error: %v", err)
+			}
+			if (len(vr.RevoteKey) != 0) != (test.policy != query.PollSchema_REJECT) {
+				t.Errorf("Revote key %v returned in poll with policy %v", vr.RevoteKey, test.policy)
+			}
+
+			key := vr.RevoteKey
+			switch test.key {
+			case "wrong":
+				key = []byte("wrong key")
+			case "none":
+				key = nil
+			}
+			if test.ballot {
+				b.Answers[0].Selected = []int32{1}
+				vr, err = c.RevoteBallot(ctx, poll, b, sign, weight, key)
+			} else {
+				answers.Questions[0].Answers = []string{"false", "true"}
+				vr, err = c.Revote(ctx, poll, answers, sign, weight, key)
+			}
+			if (err != nil) != test.exp_err || err == nil && vr.Status != test.exp_status {
+				t.Errorf("Output %v, want status %v", vr, test.exp_status)
+				t.Errorf("Error %v, want error: %v", err, test.exp_err)
+			}
+
+			ps, err := s.GetSummary(adminContext(p.AdminKey), &query.SummaryRequest{Pollid: p.Id})
+			if err != nil || ps.Schema.Questions[0].Answers[0] != test.exp_yes {
+				t.Errorf("Count of yes %v, want %v", ps.GetSchema().GetQuestions(), test.exp_yes)
+				t.Errorf("Error %v, want nil error", err)
+			}
+		})
+		s.data.Close()
+	}
+}
+
+// voteWith creates poll with schema and sends vote to it, signed with valid token.
+//
+// Vote contains answers either in legacy form or as a ballot, other fields are
+// filled in here. Commitment of signed is authorized instead of commitment of
+// sent answers, if it is not nil. Server is called directly, so status of
+// returned error is not wrapped by client.
+func voteWith(t *testing.T, s *server, schema *query.PollSchema, vote *query.VoteRequest, signed *query.Ballot) error {
+	t.Helper()
+	ctx := context.Background()
+	p, err := s.PollInit(ctx, &query.PollInitRequest{Schema: schema})
+	if err != nil {
+		t.Fatalf("PollInit failed, error: %v", err)
+	}
+	store.SaveToken(s.data, "Good token", 1)
+
+	conn, stop, err := dialServer(s)
+	if err != nil {
+		t.Fatalf("Dial failed, error: %v", err)
+	}
+	defer stop()
+
+	c := voteclient.New(conn)
+	poll, err := c.GetPoll(ctx, p.Id)
+	if err != nil {
+		t.Fatalf("GetPoll failed, error: %v", err)
+	}
+	vote = proto.Clone(vote).(*query.VoteRequest)
+	vote.Pollid = poll.Id
+	vote.Nonce, _ = voteclient.NewNonce()
+	ballot := vote.Answers.Commitment(vote.Nonce)
+	switch {
+	case signed != nil:
+		ballot = signed.Commitment(vote.Nonce)
+	case vote.Ballot != nil:
+		ballot = vote.Ballot.Commitment(vote.Nonce)
+	}
+	vote.Sign, vote.Weight, err = c.Authorize(ctx, poll, "Good token", linkSig(s, poll.Id, "Good token"), ballot)
+	if err != nil {
+		t.Fatalf("Authorize failed, error: %v", err)
+	}
+	_, err = s.PollVote(ctx, vote)
+	return err
+}
+
+func TestConstraints(t *testing.T) {
+	in := testsConstraints
+	for i, test := range in {
+
+		s, _ := serverInit("testCO" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			test.question.Question = "Question"
+			schema := &query.PollSchema{Questions: []*query.PollSchema_QA{test.question}}
+			answers := proto.Clone(schema).(*query.PollSchema)
+			answers.Questions[0].Answers = test.answers
+			err := voteWith(t, s, schema, &query.VoteRequest{Answers: answers}, nil)
+			if status.Code(err) != test.exp_err {
+				t.Errorf("Error %v, want error code %v", err, test.exp_err)
+			}
+		})
+		s.data.Close()
+	}
+}
+
+func TestValidateAnswers(t *testing.T) {
+	in := testsValidateAnswers
+	for i, test := range in {
+
+		s, _ := serverInit("testVA" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			answers := &query.PollSchema{Questions: test.answers}
+			err := voteWith(t, s, validationSchema, &query.VoteRequest{Answers: answers}, nil)
+			if status.Code(err) != test.exp_err {
+				t.Errorf("Error %v, want error code %v", err, test.exp_err)
+			}
+		})
+		s.data.Close()
+	}
+}
+
+func TestMalformedVote(t *testing.T) {
+	s, _ := serverInit("testMV.db")
+	defer s.data.Close()
+	p, _ := s.PollInit(context.Background(), &query.PollInitRequest{Schema: validationSchema})
+	for i, test := range testsMalformedVote {
+
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			in := proto.Clone(test.in).(*query.VoteRequest)
+			in.Pollid = p.Id
+			_, err := s.PollVote(context.Background(), in)
+			if !reflect.DeepEqual(err, test.exp_err) {
+				t.Errorf("Error %v, want error %v", err, test.exp_err)
+			}
+		})
+	}
+}
+
+func TestBallotVote(t *testing.T) {
+	in := testsBallotVote
+	for i, test := range in {
+
+		s, _ := serverInit("testBV" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			sent := test.ballot
+			if test.sent != nil {
+				sent = test.sent
+			}
+			err := voteWith(t, s, validationSchema, &query.VoteRequest{Ballot: sent}, test.ballot)
+			if status.Code(err) != test.exp_err {
+				t.Errorf("Error %v, want error code %v", err, test.exp_err)
+			}
+		})
+		s.data.Close()
+	}
+}
+
+func TestConditionalVote(t *testing.T) {
+	in := testsConditionalVote
+	for i, test := range in {
+
+		s, _ := serverInit("testCV" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			b := &query.Ballot{Version: query.BallotVersion, Answers: test.answers}
+			err := voteWith(t, s, conditionalSchema, &query.VoteRequest{Ballot: b}, nil)
+			if status.Code(err) != test.exp_err {
+				t.Errorf("Error %v, want error code %v", err, test.exp_err)
+			}
+		})
+		s.data.Close()
+	}
+}
+
+func TestPollMetadata(t *testing.T) {
+	in := testsPollMetadata
+	for i, test := range in {
+
+		s, _ := serverInit("testPM" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			ctx := context.Background()
+			poll, err := s.PollInit(ctx, &query.PollInitRequest{
+				Schema:   validationSchema,
+				Metadata: test.md,
+			})
+			if status.Code(err) != test.exp_err {
+				t.Fatalf("Error %v, want error code %v", err, test.exp_err)
+			}
+			if err != nil {
+				return
+			}
+
+			pwk, err := s.GetPoll(ctx, &query.GetPollRequest{Pollid: poll.Id})
+			if err != nil {
+				t.Fatalf("GetPoll failed, error: %v", err)
+			}
+			md := pwk.GetMetadata()
+			if test.md != nil && md.GetCreated() == 0 {
+				t.Errorf("Created %v, want time of creation", md.GetCreated())
+			}
+			md.Created = 0
+			exp := test.md
+			if exp == nil {
+				exp = &query.PollMetadata{}
+			}
+			if !proto.Equal(md, exp) {
+				t.Errorf("Metadata %v, want %v", md, exp)
+			}
+		})
+		s.data.Close()
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	in := testsTemplates
+	for i, test := range in {
+
+		s, _ := serverInit("testTM" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			ctx := context.Background()
+			sch := proto.Clone(validationSchema).(*query.PollSchema)
+			sch.Closes = 1
+			md := &query.PollMetadata{Title: "Board vote"}
+			poll, err := s.PollInit(ctx, &query.PollInitRequest{Schema: sch, Metadata: md})
+			if err != nil {
+				t.Fatalf("PollInit failed, error: %v", err)
+			}
+			octx := ownerContext(poll.OwnerKey)
+			if _, err := s.SaveTemplate(ctx, &query.SaveTemplateRequest{Name: "Board", Schema: sch}); status.Code(err) != codes.Unauthenticated {
+				t.Errorf("SaveTemplate without owner key returned error %v, want Unauthenticated", err)
+			}
+			tmpl, err := s.SaveTemplate(octx, &query.SaveTemplateRequest{Name: "Board", Schema: sch, Metadata: md})
+			if err != nil {
+				t.Fatalf("SaveTemplate failed, error: %v", err)
+			}
+			list, err := s.ListTemplates(octx, &query.ListTemplatesRequest{})
+			if err != nil || len(list.Templates) != 1 || !proto.Equal(list.Templates[0], tmpl) {
+				t.Errorf("Templates %v, want %v", list.GetTemplates(), tmpl)
+			}
+			// Admin key of a poll doesn't identify its owner.
+			if _, err := s.ListTemplates(ownerContext(poll.AdminKey), &query.ListTemplatesRequest{}); status.Code(err) != codes.PermissionDenied {
+				t.Errorf("ListTemplates with admin key returned error %v, want PermissionDenied", err)
+			}
+
+			cctx := ctx
+			if test.authorized && test.clone {
+				cctx = adminContext(poll.AdminKey)
+			} else if test.authorized {
+				cctx = octx
+			}
+			if test.other_key {
+				other, err := s.PollInit(ctx, &query.PollInitRequest{Schema: sch})
+				if err != nil {
+					t.Fatalf("PollInit failed, error: %v", err)
+				}
+				cctx = ownerContext(other.OwnerKey)
+				// Templates of other owners are not listed.
+				list, err := s.ListTemplates(cctx, &query.ListTemplatesRequest{})
+				if err != nil || len(list.Templates) != 0 {
+					t.Errorf("Templates %v, want no templates", list.GetTemplates())
+				}
+			}
+			var reply *query.PollInitReply
+			if test.clone {
+				reply, err = s.CloneFromPoll(cctx, &query.CloneRequest{Pollid: poll.Id, Tokens: test.tokens})
+			} else {
+				reply, err = s.CreateFromTemplate(cctx, &query.CreateFromTemplateRequest{TemplateId: tmpl.Id, Tokens: test.tokens})
+			}
+			if status.Code(err) != test.exp_err {
+				t.Fatalf("Error %v, want error code %v", err, test.exp_err)
+			}
+			if err != nil {
+				return
+			}
+
+			// New poll has its own keys and tokens, no closing time and the same owner.
+			pwk, err := s.GetPoll(ctx, &query.GetPollRequest{Pollid: reply.Id})
+			if err != nil || reply.Id == poll.Id || reply.AdminKey == poll.AdminKey || reply.OwnerKey != "" {
+				t.Fatalf("GetPoll of new poll %v failed, error: %v", reply.Id, err)
+			}
+			owner, _ := store.PollOwner(s.data, 1)
+			if newowner, err := store.PollOwner(s.data, 2); err != nil || owner == nil || !bytes.Equal(newowner, owner) {
+				t.Errorf("New poll has owner %v, want %v, error %v", newowner, owner, err)
+			}
+			sch.Closes = 0
+			if !proto.Equal(pwk.Poll, sch) || pwk.GetMetadata().GetTitle() != md.Title {
+				t.Errorf("Poll %v with metadata %v, want %v", pwk.Poll, pwk.Metadata, sch)
+			}
+			tokens, err := store.GetTokens(s.data, 2)
+			if err != nil || len(tokens) != int(test.tokens) {
+				t.Errorf("Got %v tokens, want %v tokens", len(tokens), test.tokens)
+			}
+		})
+		s.data.Close()
+	}
+}
+
+func TestListPolls(t *testing.T) {
+	in := testsListPolls
+	for i, test := range in {
+
+		s, _ := serverInit("testLP" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			ctx := context.Background()
+			listed := proto.Clone(validationSchema).(*query.PollSchema)
+			listed.Listed = true
+			board, err := s.PollInit(ctx, &query.PollInitRequest{
+				Schema:   listed,
+				Metadata: &query.PollMetadata{Title: "Board vote"},
+			})
+			if err != nil {
+				t.Fatalf("PollInit failed, error: %v", err)
+			}
+			// Poll created with owner key of the first one has the same owner.
+			// The last poll is not listed.
+			for _, p := range []struct {
+				ctx   context.Context
+				sch   *query.PollSchema
+				title string
+			}{{ctx, listed, "Lunch"}, {ownerContext(board.OwnerKey), validationSchema, "Board elections"}} {
+				reply, err := s.PollInit(p.ctx, &query.PollInitRequest{
+					Schema:   p.sch,
+					Metadata: &query.PollMetadata{Title: p.title},
+				})
+				if err != nil {
+					t.Fatalf("PollInit failed, error: %v", err)
+				}
+				// Every poll has its own admin key, owner key is sent only to new owner.
+				if reply.AdminKey == board.AdminKey || (reply.OwnerKey == "") != (p.ctx != ctx) {
+					t.Errorf("Poll %v has keys %v and %v, first poll has %v", p.title, reply.AdminKey, reply.OwnerKey, board.AdminKey)
+				}
+			}
+
+			lctx := ctx
+			switch test.owner_key {
+			case "owner":
+				lctx = ownerContext(board.OwnerKey)
+			case "bad":
+				lctx = ownerContext(board.AdminKey)
+			}
+			list, err := s.ListPolls(lctx, test.req)
+			if status.Code(err) != test.exp_err {
+				t.Fatalf("Error %v, want error code %v", err, test.exp_err)
+			}
+			if err != nil {
+				return
+			}
+			if list.NextPageToken != "" && list.NextPageToken != list.Polls[len(list.Polls)-1].Id {
+				t.Errorf("Page token %q, want id of the last listed poll", list.NextPageToken)
+			}
+			var titles []string
+			for _, pl := range list.Polls {
+				titles = append(titles, pl.GetMetadata().GetTitle())
+				// Listing contains only public data.
+				if !validPollID(pl.Id, nil) || pl.GetStatus().GetPollid() != pl.Id {
+					t.Errorf("Listing %v, want id and status", pl)
+				}
+			}
+			if !reflect.DeepEqual(titles, test.exp_titles) {
+				t.Errorf("Listed %v, want %v", titles, test.exp_titles)
+			}
+		})
+		s.data.Close()
+	}
+}
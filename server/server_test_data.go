@@ -1,10 +1,12 @@
 package main
 
 import (
-	"encoding/hex"
 	"fmt"
+	"time"
 
 	"github.com/ememak/Projekt-Rada/query"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var testsPollInitIn = []*query.PollSchema{
@@ -28,7 +30,7 @@ var testsPollInitIn = []*query.PollSchema{
 			},
 			{
 				Question: "Why?",
-				Type:     3, // wrong type!
+				Type:     9, // wrong type!
 			},
 		},
 	},
@@ -64,7 +66,6 @@ var testsPollInitOutEmpty = []struct {
 }{
 	{
 		exp_out: &query.PollQuestion{
-			Id: 1,
 			Schema: &query.PollSchema{
 				Questions: []*query.PollSchema_QA{
 					{
@@ -90,7 +91,6 @@ var testsPollInitOutEmpty = []struct {
 	},
 	{
 		exp_out: &query.PollQuestion{
-			Id: 1,
 			Schema: &query.PollSchema{
 				Questions: []*query.PollSchema_QA{
 					{
@@ -114,7 +114,6 @@ var testsPollInitOut1Poll = []struct {
 }{
 	{
 		exp_out: &query.PollQuestion{
-			Id: 2,
 			Schema: &query.PollSchema{
 				Questions: []*query.PollSchema_QA{
 					{
@@ -140,7 +139,6 @@ var testsPollInitOut1Poll = []struct {
 	},
 	{
 		exp_out: &query.PollQuestion{
-			Id: 2,
 			Schema: &query.PollSchema{
 				Questions: []*query.PollSchema_QA{
 					{
@@ -158,6 +156,38 @@ var testsPollInitOut1Poll = []struct {
 	},
 }
 
+var testsPollInitTokens = []struct {
+	tokens    int32
+	maxTokens int
+	exp_out   int // Number of returned tokens.
+	exp_err   codes.Code
+}{
+	{ // test0 - positive, default number of tokens
+		tokens:    0,
+		maxTokens: defaultMaxTokens,
+		exp_out:   defaultTokens,
+		exp_err:   codes.OK,
+	},
+	{ // test1 - positive
+		tokens:    5,
+		maxTokens: 10,
+		exp_out:   5,
+		exp_err:   codes.OK,
+	},
+	{ // test2 - negative, too many tokens
+		tokens:    11,
+		maxTokens: 10,
+		exp_out:   0,
+		exp_err:   codes.InvalidArgument,
+	},
+	{ // test3 - negative, negative number of tokens
+		tokens:    -1,
+		maxTokens: 10,
+		exp_out:   0,
+		exp_err:   codes.InvalidArgument,
+	},
+}
+
 var testsGetPollIn = []struct {
 	schema  *query.PollSchema
 	pollreq *query.GetPollRequest
@@ -175,9 +205,7 @@ var testsGetPollIn = []struct {
 				},
 			},
 		},
-		pollreq: &query.GetPollRequest{
-			Pollid: 1,
-		},
+		pollreq: &query.GetPollRequest{},
 	},
 	{ // test1 - negative, wrong poll requested
 		schema: &query.PollSchema{
@@ -193,7 +221,7 @@ var testsGetPollIn = []struct {
 			},
 		},
 		pollreq: &query.GetPollRequest{
-			Pollid: 2,
+			Pollid: "nosuchpoll",
 		},
 	},
 	{ // test2 - negative, wrong poll requested
@@ -206,7 +234,7 @@ var testsGetPollIn = []struct {
 			},
 		},
 		pollreq: &query.GetPollRequest{
-			Pollid: -10000,
+			Pollid: "aaaaaaaaaaaaaaaaaaaaaaaaaa",
 		},
 	},
 	{ // test3 - negative, wrong type - poll won't be saved in database
@@ -222,9 +250,7 @@ var testsGetPollIn = []struct {
 				},
 			},
 		},
-		pollreq: &query.GetPollRequest{
-			Pollid: 1,
-		},
+		pollreq: &query.GetPollRequest{},
 	},
 }
 
@@ -249,15 +275,15 @@ var testsGetPollOut = []struct {
 	},
 	{
 		exp_out: nil,
-		exp_err: fmt.Errorf("Error in GetPoll while retrieving key from database: %w", fmt.Errorf("No key for this poll in database.")),
+		exp_err: status.Errorf(codes.NotFound, "Error while reading poll: No such poll: nosuchpoll"),
 	},
 	{
 		exp_out: nil,
-		exp_err: fmt.Errorf("Error in GetPoll while retrieving key from database: %w", fmt.Errorf("No key for this poll in database.")),
+		exp_err: status.Errorf(codes.NotFound, "Error while reading poll: No such poll: aaaaaaaaaaaaaaaaaaaaaaaaaa"),
 	},
 	{
 		exp_out: nil,
-		exp_err: fmt.Errorf("Error in GetPoll while retrieving key from database: %w", fmt.Errorf("No key for this poll in database.")),
+		exp_err: status.Errorf(codes.NotFound, "Error while reading poll: No such poll: "),
 	},
 }
 
@@ -270,7 +296,6 @@ var testsSignBallot = []struct {
 		schema: &query.PollSchema{},
 		envelope: &query.EnvelopeToSign{
 			Envelope: []byte{1, 3, 4, 5, 6, 7, 8, 9, 0},
-			Pollid:   1,
 			Token:    "Good token",
 		},
 		exp_err: nil,
@@ -279,25 +304,24 @@ var testsSignBallot = []struct {
 		schema: &query.PollSchema{},
 		envelope: &query.EnvelopeToSign{
 			Envelope: []byte{1, 3, 4, 5, 6, 7, 8, 9, 0},
-			Pollid:   2,
+			Pollid:   "nosuchpoll",
 			Token:    "Good token",
 		},
-		exp_err: fmt.Errorf("No such poll: 2"),
+		exp_err: status.Errorf(codes.NotFound, "Error while reading poll: No such poll: nosuchpoll"),
 	},
-	{ // test2 - negative, wrong poll requested
+	{ // test2 - negative, wrong poll requested, id looks like a poll id
 		schema: &query.PollSchema{},
 		envelope: &query.EnvelopeToSign{
 			Envelope: []byte{1, 3, 4, 5, 6, 7, 8, 9, 0},
-			Pollid:   -3,
+			Pollid:   "aaaaaaaaaaaaaaaaaaaaaaaaaa",
 			Token:    "Good token",
 		},
-		exp_err: fmt.Errorf("No such poll: -3"),
+		exp_err: status.Errorf(codes.NotFound, "Error while reading poll: No such poll: aaaaaaaaaaaaaaaaaaaaaaaaaa"),
 	},
 	{ // test3 - negative, token not valid (only valid token is "Good token")
 		schema: &query.PollSchema{},
 		envelope: &query.EnvelopeToSign{
 			Envelope: []byte{1, 3, 4, 5, 6, 7, 8, 9, 0},
-			Pollid:   1,
 			Token:    "Bad token",
 		},
 		exp_err: fmt.Errorf("No such token"),
@@ -306,34 +330,36 @@ var testsSignBallot = []struct {
 		schema: &query.PollSchema{},
 		envelope: &query.EnvelopeToSign{
 			Envelope: nil,
-			Pollid:   1,
 			Token:    "Good token",
 		},
-		exp_err: fmt.Errorf("Error in SignBallot, envelope shouldn't be null"),
+		exp_err: fmt.Errorf("Error in SignBallot while signing envelope: %w", fmt.Errorf("Error! Envelope is empty.")),
 	},
 	{ // test5 - positive
 		schema: &query.PollSchema{},
 		envelope: &query.EnvelopeToSign{
 			Envelope: []byte("Some random value\x01\x10!@#$%^&*()_+{}"),
-			Pollid:   1,
 			Token:    "Good token",
 		},
 		exp_err: nil,
+	}, { // test6 - negative, token without signature from voting link
+		schema: &query.PollSchema{},
+		envelope: &query.EnvelopeToSign{
+			Envelope: []byte{1, 3, 4, 5, 6, 7, 8, 9, 0},
+			Token:    "Good token",
+			Sig:      "bad signature",
+		},
+		exp_err: status.Errorf(codes.PermissionDenied, "Token is not from a valid voting link"),
 	},
 }
 
-// For simplicity there is no blinding in this tests.
-// Hash of "12345678" treated as integer with base 256
-var hash, _ = hex.DecodeString("d95259c12bc298fd38ff8e43436e61e31281d22eb3fa37eb7956cf03f3a1081b")
-
-// Hash of "rvrbhd54":^V(B)*TBytvw.ucq<{_@x-mzua" treated as integer with base 256
-var hash2, _ = hex.DecodeString("c09a91f0964f321c9d8ba8506a8cf2743ce46cd1db2772d876da23b6c476b3a5")
-
-//"563b5c8ae85cabe26529b9857d4b503e6da069389bbb94490cf1873176d7ff94")
-
+// In PollVote tests ballot is calculated as commitment to signed answers
+// (answers from votereq if signed is nil), then it's blinded, signed and unblinded.
+// Ballot and signature in votereq are then replaced with the result,
+// unless ballot is already set in votereq.
 var testsPollVote = []struct {
 	schema   *query.PollSchema
 	envelope *query.EnvelopeToSign
+	signed   *query.PollSchema
 	votereq  *query.VoteRequest
 	exp_out  *query.VoteReply
 	exp_err  error
@@ -341,16 +367,13 @@ var testsPollVote = []struct {
 	{ // test0 - positive
 		schema: &query.PollSchema{},
 		envelope: &query.EnvelopeToSign{
-			Envelope: hash,
-			Pollid:   1,
+			Envelope: nil,
 			Token:    "Good token",
 		},
 		votereq: &query.VoteRequest{
-			Pollid:  1,
 			Answers: &query.PollSchema{},
-			Sign: &query.RSASignature{
-				Ballot: []byte("12345678"),
-			},
+			Sign:    &query.RSASignature{},
+			Nonce:   []byte("0123456789abcdef"),
 		},
 		exp_out: &query.VoteReply{
 			Mess: "Thank you for your vote!",
@@ -360,16 +383,13 @@ var testsPollVote = []struct {
 	{ // test1 - positive
 		schema: &query.PollSchema{},
 		envelope: &query.EnvelopeToSign{
-			Envelope: hash2,
-			Pollid:   1,
+			Envelope: nil,
 			Token:    "Good token",
 		},
 		votereq: &query.VoteRequest{
-			Pollid:  1,
 			Answers: &query.PollSchema{},
-			Sign: &query.RSASignature{
-				Ballot: []byte("rvrbhd54\":^V(B)*TBytvw.ucq<{_@x-mzua"),
-			},
+			Sign:    &query.RSASignature{},
+			Nonce:   []byte("rvrbhd54\":^V(B)*TBytvw.ucq<{_@x-mzua"),
 		},
 		exp_out: &query.VoteReply{
 			Mess: "Thank you for your vote!",
@@ -379,50 +399,52 @@ var testsPollVote = []struct {
 	{ // test2 - negative, wrong pollid in votereq
 		schema: &query.PollSchema{},
 		envelope: &query.EnvelopeToSign{
-			Envelope: hash2,
-			Pollid:   1,
+			Envelope: nil,
 			Token:    "Good token",
 		},
 		votereq: &query.VoteRequest{
-			Pollid:  0,
+			Pollid:  "nosuchpoll",
 			Answers: &query.PollSchema{},
-			Sign: &query.RSASignature{
-				Ballot: []byte("rvrbhd54\":^V(B)*TBytvw.ucq<{_@x-mzua"),
-			},
+			Sign:    &query.RSASignature{},
+			Nonce:   []byte("0123456789abcdef"),
 		},
 		exp_out: &query.VoteReply{
 			Mess: "Error in PollVote",
 		},
-		exp_err: fmt.Errorf("Error in PollVote while retrieving key from database: %w", fmt.Errorf("No key for this poll in database.")),
+		exp_err: status.Errorf(codes.NotFound, "Error while reading poll: No such poll: nosuchpoll"),
 	},
 	{ // test3 - negative, wrong pollid in votereq
 		schema: &query.PollSchema{},
 		envelope: &query.EnvelopeToSign{
-			Envelope: hash,
-			Pollid:   1,
+			Envelope: nil,
 			Token:    "Good token",
 		},
 		votereq: &query.VoteRequest{
-			Pollid:  1,
 			Answers: &query.PollSchema{},
 			Sign: &query.RSASignature{
 				Ballot: []byte("Some value"),
 			},
+			Nonce: []byte("0123456789abcdef"),
 		},
 		exp_out: &query.VoteReply{
 			Mess: "Error in PollVote",
 		},
 		exp_err: fmt.Errorf("Error in PollVte, Sign invalid!"),
 	},
-	{ // test4 - negative, wrong characters
-		schema: &query.PollSchema{},
+	{ // test4 - negative, question doesn't match poll
+		schema: &query.PollSchema{
+			Questions: []*query.PollSchema_QA{
+				{
+					Question: "Question",
+					Type:     query.PollSchema_OPEN,
+				},
+			},
+		},
 		envelope: &query.EnvelopeToSign{
-			Envelope: hash,
-			Pollid:   1,
+			Envelope: nil,
 			Token:    "Good token",
 		},
 		votereq: &query.VoteRequest{
-			Pollid: 1,
 			Answers: &query.PollSchema{
 				Questions: []*query.PollSchema_QA{
 					{
@@ -431,24 +453,28 @@ var testsPollVote = []struct {
 					},
 				},
 			},
-			Sign: &query.RSASignature{
-				Ballot: []byte("12345678"),
-			},
+			Sign:  &query.RSASignature{},
+			Nonce: []byte("0123456789abcdef"),
 		},
 		exp_out: &query.VoteReply{
 			Mess: "Error in PollVote",
 		},
-		exp_err: fmt.Errorf("Error in PollVote while saving key in database: %w", fmt.Errorf("Error! Question contains invalid characters.")),
+		exp_err: status.Errorf(codes.InvalidArgument, "Error in PollVote: Error in question 1: Error! Question doesn't match poll."),
 	},
 	{ // test5 - negative, wrong characters
-		schema: &query.PollSchema{},
+		schema: &query.PollSchema{
+			Questions: []*query.PollSchema_QA{
+				{
+					Question: "Question",
+					Type:     query.PollSchema_OPEN,
+				},
+			},
+		},
 		envelope: &query.EnvelopeToSign{
-			Envelope: hash,
-			Pollid:   1,
+			Envelope: nil,
 			Token:    "Good token",
 		},
 		votereq: &query.VoteRequest{
-			Pollid: 1,
 			Answers: &query.PollSchema{
 				Questions: []*query.PollSchema_QA{
 					{
@@ -458,24 +484,28 @@ var testsPollVote = []struct {
 					},
 				},
 			},
-			Sign: &query.RSASignature{
-				Ballot: []byte("12345678"),
-			},
+			Sign:  &query.RSASignature{},
+			Nonce: []byte("0123456789abcdef"),
 		},
 		exp_out: &query.VoteReply{
 			Mess: "Error in PollVote",
 		},
 		exp_err: fmt.Errorf("Error in PollVote while saving key in database: %w", fmt.Errorf("Error! Answer contains invalid characters.")),
 	},
-	{ // test6 - negative, wrong characters
-		schema: &query.PollSchema{},
+	{ // test6 - negative, type doesn't match poll
+		schema: &query.PollSchema{
+			Questions: []*query.PollSchema_QA{
+				{
+					Question: "Question",
+					Type:     query.PollSchema_OPEN,
+				},
+			},
+		},
 		envelope: &query.EnvelopeToSign{
-			Envelope: hash,
-			Pollid:   1,
+			Envelope: nil,
 			Token:    "Good token",
 		},
 		votereq: &query.VoteRequest{
-			Pollid: 1,
 			Answers: &query.PollSchema{
 				Questions: []*query.PollSchema_QA{
 					{
@@ -485,14 +515,62 @@ var testsPollVote = []struct {
 					},
 				},
 			},
-			Sign: &query.RSASignature{
-				Ballot: []byte("12345678"),
+			Sign:  &query.RSASignature{},
+			Nonce: []byte("0123456789abcdef"),
+		},
+		exp_out: &query.VoteReply{
+			Mess: "Error in PollVote",
+		},
+		exp_err: status.Errorf(codes.InvalidArgument, "Error in PollVote: Error in question 1: Error! Type of question doesn't match poll."),
+	},
+	{ // test7 - negative, nonce too short
+		schema: &query.PollSchema{},
+		envelope: &query.EnvelopeToSign{
+			Envelope: nil,
+			Token:    "Good token",
+		},
+		votereq: &query.VoteRequest{
+			Answers: &query.PollSchema{},
+			Sign:    &query.RSASignature{},
+			Nonce:   []byte("short"),
+		},
+		exp_out: &query.VoteReply{
+			Mess: "Error in PollVote",
+		},
+		exp_err: fmt.Errorf("Error in PollVote, nonce too short!"),
+	},
+	{ // test8 - negative, valid sign attached to different answers
+		schema: &query.PollSchema{},
+		envelope: &query.EnvelopeToSign{
+			Envelope: nil,
+			Token:    "Good token",
+		},
+		signed: &query.PollSchema{
+			Questions: []*query.PollSchema_QA{
+				{
+					Question: "Question",
+					Type:     query.PollSchema_OPEN,
+					Answers:  []string{"Signed answer"},
+				},
 			},
 		},
+		votereq: &query.VoteRequest{
+			Answers: &query.PollSchema{
+				Questions: []*query.PollSchema_QA{
+					{
+						Question: "Question",
+						Type:     query.PollSchema_OPEN,
+						Answers:  []string{"Different answer"},
+					},
+				},
+			},
+			Sign:  &query.RSASignature{},
+			Nonce: []byte("0123456789abcdef"),
+		},
 		exp_out: &query.VoteReply{
 			Mess: "Error in PollVote",
 		},
-		exp_err: fmt.Errorf("Error in PollVote while saving key in database: %w", fmt.Errorf("Error! Wrong question type.")),
+		exp_err: fmt.Errorf("Error in PollVote, ballot does not match answers!"),
 	},
 }
 
@@ -502,9 +580,7 @@ var testsEntireProtocol = struct {
 	envelope *query.EnvelopeToSign
 	votereq  *query.VoteRequest
 }{
-	pollreq: &query.GetPollRequest{
-		Pollid: 1,
-	},
+	pollreq: &query.GetPollRequest{},
 	schema: &query.PollSchema{
 		Questions: []*query.PollSchema_QA{
 			{
@@ -515,11 +591,9 @@ var testsEntireProtocol = struct {
 	},
 	envelope: &query.EnvelopeToSign{
 		Envelope: nil,
-		Pollid:   1,
 		Token:    "Good token",
 	},
 	votereq: &query.VoteRequest{
-		Pollid: 1,
 		Answers: &query.PollSchema{
 			Questions: []*query.PollSchema_QA{
 				{
@@ -529,8 +603,875 @@ var testsEntireProtocol = struct {
 				},
 			},
 		},
-		Sign: &query.RSASignature{
-			Ballot: []byte("12345678"),
+		Sign:  &query.RSASignature{},
+		Nonce: []byte("0123456789abcdef"),
+	},
+}
+
+// Client tests run whole protocol through voteclient package.
+// Only valid token is "Good token" in poll created by the test,
+// which is used if pollid is empty.
+var testsClient = []struct {
+	schema  *query.PollSchema
+	pollid  string
+	token   string
+	sig     string // Signature of token, if empty, signature from voting link is used.
+	answers *query.PollSchema
+	exp_out *query.VoteReply
+	exp_err string
+}{
+	{ // test0 - positive
+		schema: &query.PollSchema{
+			Questions: []*query.PollSchema_QA{
+				{
+					Question: "Question",
+					Type:     query.PollSchema_OPEN,
+				},
+			},
+		},
+		token: "Good token",
+		answers: &query.PollSchema{
+			Questions: []*query.PollSchema_QA{
+				{
+					Question: "Question",
+					Type:     query.PollSchema_OPEN,
+					Answers:  []string{"Answer"},
+				},
+			},
+		},
+		exp_out: &query.VoteReply{
+			Mess: "Thank you for your vote!",
+		},
+		exp_err: "",
+	},
+	{ // test1 - negative, wrong token
+		schema:  &query.PollSchema{},
+		token:   "Bad token",
+		answers: &query.PollSchema{},
+		exp_out: nil,
+		exp_err: "Error in Vote: Error in Authorize while requesting token weight: rpc error: code = NotFound desc = Error in GetTokenWeight: No such token",
+	},
+	{ // test2 - negative, wrong poll
+		schema:  &query.PollSchema{},
+		pollid:  "nosuchpoll",
+		token:   "Good token",
+		answers: &query.PollSchema{},
+		exp_out: nil,
+		exp_err: "Error in Vote: Error in GetPoll while requesting poll: rpc error: code = NotFound desc = " +
+			"Error while reading poll: No such poll: nosuchpoll",
+	},
+	{ // test3 - negative, token without signature from voting link
+		schema:  &query.PollSchema{},
+		token:   "Good token",
+		sig:     "bad signature",
+		answers: &query.PollSchema{},
+		exp_out: nil,
+		exp_err: "Error in Vote: Error in Authorize while requesting token weight: rpc error: code = PermissionDenied desc = " +
+			"Token is not from a valid voting link",
+	},
+}
+
+var testsPollState = []struct {
+	schema   *query.PollSchema
+	close    bool
+	envelope *query.EnvelopeToSign
+	exp_sb   codes.Code // Code returned by SignBallot.
+	exp_gs   codes.Code // Code returned by GetSummary.
+}{
+	{ // test0 - positive, open poll
+		schema: &query.PollSchema{},
+		close:  false,
+		envelope: &query.EnvelopeToSign{
+			Envelope: []byte{1, 3, 4, 5, 6, 7, 8, 9, 0},
+			Token:    "Good token",
+		},
+		exp_sb: codes.OK,
+		exp_gs: codes.OK,
+	},
+	{ // test1 - negative, closed poll doesn't sign ballots
+		schema: &query.PollSchema{},
+		close:  true,
+		envelope: &query.EnvelopeToSign{
+			Envelope: []byte{1, 3, 4, 5, 6, 7, 8, 9, 0},
+			Token:    "Good token",
+		},
+		exp_sb: codes.FailedPrecondition,
+		exp_gs: codes.OK,
+	},
+	{ // test2 - negative, poll is a draft until scheduled opening
+		schema: &query.PollSchema{
+			Opens: time.Now().Unix() + 3600,
+		},
+		close: false,
+		envelope: &query.EnvelopeToSign{
+			Envelope: []byte{1, 3, 4, 5, 6, 7, 8, 9, 0},
+			Token:    "Good token",
+		},
+		exp_sb: codes.FailedPrecondition,
+		exp_gs: codes.FailedPrecondition,
+	},
+}
+
+var testsResults = []struct {
+	schema *query.PollSchema
+	close  bool
+	owner  bool
+	exp_gs codes.Code // Code returned by GetSummary.
+}{
+	{ // test0 - positive, results always visible
+		schema: &query.PollSchema{
+			Results: query.PollSchema_ALWAYS,
+		},
+		close:  false,
+		exp_gs: codes.OK,
+	},
+	{ // test1 - negative, poll still open
+		schema: &query.PollSchema{
+			Results: query.PollSchema_AFTER_CLOSE,
+		},
+		close:  false,
+		exp_gs: codes.FailedPrecondition,
+	},
+	{ // test2 - positive, poll closed
+		schema: &query.PollSchema{
+			Results: query.PollSchema_AFTER_CLOSE,
+		},
+		close:  true,
+		exp_gs: codes.OK,
+	},
+	{ // test3 - negative, results only for owner
+		schema: &query.PollSchema{
+			Results: query.PollSchema_OWNER_ONLY,
+		},
+		close:  true,
+		exp_gs: codes.PermissionDenied,
+	},
+	{ // test4 - positive, owner can see results
+		schema: &query.PollSchema{
+			Results: query.PollSchema_OWNER_ONLY,
+		},
+		close:  false,
+		owner:  true,
+		exp_gs: codes.OK,
+	},
+}
+
+var testsAdminKey = []struct {
+	pollid      string // Poll created by the test if empty.
+	useAdminKey bool   // Send admin key returned by PollInit.
+	key         string // Key sent otherwise, none if empty.
+	exp_err     codes.Code
+}{
+	{ // test0 - positive, owner
+		useAdminKey: true,
+		exp_err:     codes.OK,
+	},
+	{ // test1 - negative, no key
+		exp_err: codes.Unauthenticated,
+	},
+	{ // test2 - negative, wrong key
+		key:     "Bad key",
+		exp_err: codes.PermissionDenied,
+	},
+	{ // test3 - negative, key of other poll
+		pollid:      "nosuchpoll",
+		useAdminKey: true,
+		exp_err:     codes.PermissionDenied,
+	},
+}
+
+var testsIssueTokens = []struct {
+	in      *query.IssueTokensRequest
+	owner   bool
+	exp_out int // Number of returned tokens.
+	exp_err codes.Code
+}{
+	{ // test0 - positive, generated tokens
+		in: &query.IssueTokensRequest{
+			Count: 3,
+		},
+		owner:   true,
+		exp_out: 3,
+		exp_err: codes.OK,
+	},
+	{ // test1 - positive, supplied tokens
+		in: &query.IssueTokensRequest{
+			Tokens: []string{"token1", "token2"},
+		},
+		owner:   true,
+		exp_out: 2,
+		exp_err: codes.OK,
+	},
+	{ // test2 - negative, token already exists
+		in: &query.IssueTokensRequest{
+			Tokens: []string{"token1", "Good token"},
+		},
+		owner:   true,
+		exp_out: 0,
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test3 - negative, no tokens requested
+		in:      &query.IssueTokensRequest{},
+		owner:   true,
+		exp_out: 0,
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test4 - negative, not an owner
+		in: &query.IssueTokensRequest{
+			Count: 3,
+		},
+		owner:   false,
+		exp_out: 0,
+		exp_err: codes.Unauthenticated,
+	},
+	{ // test5 - negative, weight above limit
+		in: &query.IssueTokensRequest{
+			Count:  3,
+			Weight: defaultMaxWeight + 1,
+		},
+		owner:   true,
+		exp_out: 0,
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test6 - negative, negative weight
+		in: &query.IssueTokensRequest{
+			Count:  3,
+			Weight: -1,
+		},
+		owner:   true,
+		exp_out: 0,
+		exp_err: codes.InvalidArgument,
+	},
+}
+
+var testsRevokeToken = []struct {
+	token     string // Token to revoke, token returned by PollInit if empty.
+	owner     bool
+	exp_err   codes.Code // Code returned by RevokeToken.
+	exp_lt    codes.Code // Code returned by ListTokens.
+	exp_state query.TokenStatus_State
+}{
+	{ // test0 - positive
+		owner:     true,
+		exp_err:   codes.OK,
+		exp_lt:    codes.OK,
+		exp_state: query.TokenStatus_REVOKED,
+	},
+	{ // test1 - negative, no such token
+		token:     "Bad token",
+		owner:     true,
+		exp_err:   codes.FailedPrecondition,
+		exp_lt:    codes.OK,
+		exp_state: query.TokenStatus_UNUSED,
+	},
+	{ // test2 - negative, not an owner
+		owner:   false,
+		exp_err: codes.Unauthenticated,
+		exp_lt:  codes.Unauthenticated,
+	},
+}
+
+var testsVotingLink = []struct {
+	token     string   // Token in link, token returned by PollInit if empty.
+	replace   []string // Pairs of strings replaced in link before checking it.
+	exp_err   codes.Code
+	exp_valid bool
+}{
+	{ // test0 - positive
+		exp_err:   codes.OK,
+		exp_valid: true,
+	},
+	{ // test1 - negative, changed token
+		replace:   []string{"token=", "token=1"},
+		exp_err:   codes.OK,
+		exp_valid: false,
+	},
+	{ // test2 - negative, changed poll
+		replace:   []string{"/vote/", "/vote/a"},
+		exp_err:   codes.OK,
+		exp_valid: false,
+	},
+	{ // test3 - negative, no such token
+		token:   "Bad token",
+		exp_err: codes.NotFound,
+	},
+}
+
+var testsExportVotingLinks = []struct {
+	format    query.ExportRequest_Format
+	exp_ext   string // Extension of file named after poll, no file if empty.
+	exp_files int    // Number of lines in CSV or files in ZIP.
+	exp_err   codes.Code
+}{
+	{ // test0 - positive, header and one line for each token
+		format:    query.ExportRequest_CSV,
+		exp_ext:   ".csv",
+		exp_files: 4,
+		exp_err:   codes.OK,
+	},
+	{ // test1 - positive, CSV file and PDF file for each token
+		format:    query.ExportRequest_ZIP,
+		exp_ext:   ".zip",
+		exp_files: 4,
+		exp_err:   codes.OK,
+	},
+	{ // test2 - negative, unknown format
+		format:    5,
+		exp_ext:   "",
+		exp_files: 0,
+		exp_err:   codes.InvalidArgument,
+	},
+}
+
+var testsInviteVoters = []struct {
+	in         *query.InviteRequest
+	exp_sent   int
+	exp_failed []string
+	exp_text   string // Text contained in every invitation.
+	exp_err    codes.Code
+}{
+	{ // test0 - positive, default template
+		in: &query.InviteRequest{
+			Addresses: []string{"alice@example.com", "Bob <bob@example.com>"},
+		},
+		exp_sent: 2,
+		exp_text: "You are invited to vote in poll ",
+		exp_err:  codes.OK,
+	},
+	{ // test1 - positive, own template and invalid address
+		in: &query.InviteRequest{
+			Addresses: []string{"carol@example.com", "not an address"},
+			Subject:   "Vote!",
+			Body:      "Vote here: {{.Link}}\n",
+		},
+		exp_sent:   1,
+		exp_failed: []string{"not an address"},
+		exp_text:   "Subject: Vote!",
+		exp_err:    codes.OK,
+	},
+	{ // test2 - positive, template with CRLF line endings
+		in: &query.InviteRequest{
+			Addresses: []string{"erin@example.com"},
+			Body:      "Vote here:\r\n{{.Link}}\r\nThanks\r",
+		},
+		exp_sent: 1,
+		exp_text: "Vote here:\r\nhttp://",
+		exp_err:  codes.OK,
+	},
+	{ // test3 - negative, invalid template
+		in: &query.InviteRequest{
+			Addresses: []string{"dave@example.com"},
+			Body:      "{{.Address}}",
+		},
+		exp_sent: 0,
+		exp_err:  codes.InvalidArgument,
+	},
+}
+
+var testsWeightedVotes = []struct {
+	weight    int32 // Weight of issued token.
+	claim     int32 // Weight sent with vote, if 0, weight returned by Authorize is sent.
+	exp_err   bool
+	exp_count string // Weighted count of "yes" answers.
+}{
+	{ // test0 - positive, default weight
+		weight:    0,
+		exp_count: "1",
+	},
+	{ // test1 - positive, weight 3
+		weight:    3,
+		exp_count: "3",
+	},
+	{ // test2 - negative, vote claims higher weight than token had
+		weight:    3,
+		claim:     5,
+		exp_err:   true,
+		exp_count: "0",
+	},
+	{ // test3 - negative, vote signed with weight 3 key claims weight 1
+		weight:    3,
+		claim:     1,
+		exp_err:   true,
+		exp_count: "0",
+	},
+}
+
+var testsRevote = []struct {
+	policy     query.PollSchema_VotePolicy
+	ballot     bool   // Whether votes are sent as query.Ballot instead of schema.
+	key        string // Which revote key is sent: "returned", "wrong" or "none".
+	exp_status query.VoteReply_Status
+	exp_err    bool
+	exp_yes    string // Count of "yes" answers after revote, the first vote is "yes".
+}{
+	{ // test0 - positive, vote is changed
+		policy:     query.PollSchema_REPLACE,
+		key:        "returned",
+		exp_status: query.VoteReply_REPLACED,
+		exp_yes:    "0",
+	},
+	{ // test1 - positive, vote is changed and the first one is kept in history
+		policy:     query.PollSchema_KEEP_ALL,
+		key:        "returned",
+		exp_status: query.VoteReply_APPENDED,
+		exp_yes:    "0",
+	},
+	{ // test2 - negative, wrong revote key
+		policy:  query.PollSchema_REPLACE,
+		key:     "wrong",
+		exp_err: true,
+		exp_yes: "1",
+	},
+	{ // test3 - negative, different answers without revote key
+		policy:  query.PollSchema_REPLACE,
+		key:     "none",
+		exp_err: true,
+		exp_yes: "1",
+	},
+	{ // test4 - negative, poll doesn't allow revoting
+		policy:  query.PollSchema_REJECT,
+		key:     "wrong",
+		exp_err: true,
+		exp_yes: "1",
+	},
+	{ // test5 - positive, ballot is changed
+		policy:     query.PollSchema_REPLACE,
+		ballot:     true,
+		key:        "returned",
+		exp_status: query.VoteReply_REPLACED,
+		exp_yes:    "0",
+	},
+	{ // test6 - negative, different ballot without revote key
+		policy:  query.PollSchema_REPLACE,
+		ballot:  true,
+		key:     "none",
+		exp_err: true,
+		exp_yes: "1",
+	},
+}
+
+var testsConstraints = []struct {
+	question *query.PollSchema_QA // Question of poll, answers are set in vote.
+	answers  []string
+	exp_err  codes.Code
+}{
+	{ // test0 - positive, one option of closed question
+		question: &query.PollSchema_QA{
+			Options:  []string{"yes", "no"},
+			Type:     query.PollSchema_CLOSE,
+			Required: true,
+		},
+		answers: []string{"false", "true"},
+		exp_err: codes.OK,
+	},
+	{ // test1 - negative, two options of closed question
+		question: &query.PollSchema_QA{
+			Options: []string{"yes", "no"},
+			Type:    query.PollSchema_CLOSE,
+		},
+		answers: []string{"true", "true"},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test2 - negative, required closed question not answered
+		question: &query.PollSchema_QA{
+			Options:  []string{"yes", "no"},
+			Type:     query.PollSchema_CLOSE,
+			Required: true,
+		},
+		answers: []string{"false", "false"},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test3 - positive, optional closed question not answered
+		question: &query.PollSchema_QA{
+			Options: []string{"yes", "no"},
+			Type:    query.PollSchema_CLOSE,
+		},
+		answers: []string{"false", "false"},
+		exp_err: codes.OK,
+	},
+	{ // test4 - negative, too many selections
+		question: &query.PollSchema_QA{
+			Options:       []string{"a", "b", "c"},
+			Type:          query.PollSchema_CHECKBOX,
+			MaxSelections: 2,
+		},
+		answers: []string{"true", "true", "true"},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test5 - negative, too few selections
+		question: &query.PollSchema_QA{
+			Options:       []string{"a", "b", "c"},
+			Type:          query.PollSchema_CHECKBOX,
+			MinSelections: 2,
+		},
+		answers: []string{"true", "false", "false"},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test6 - positive, selections within limits
+		question: &query.PollSchema_QA{
+			Options:       []string{"a", "b", "c"},
+			Type:          query.PollSchema_CHECKBOX,
+			MinSelections: 2,
+			MaxSelections: 2,
+		},
+		answers: []string{"true", "false", "true"},
+		exp_err: codes.OK,
+	},
+	{ // test7 - negative, open answer too long
+		question: &query.PollSchema_QA{
+			Type:      query.PollSchema_OPEN,
+			MaxLength: 5,
+		},
+		answers: []string{"Too long"},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test8 - positive, length is counted in characters
+		question: &query.PollSchema_QA{
+			Type:      query.PollSchema_OPEN,
+			MaxLength: 5,
+		},
+		answers: []string{"żółw"},
+		exp_err: codes.OK,
+	},
+	{ // test9 - negative, required open question left blank
+		question: &query.PollSchema_QA{
+			Type:     query.PollSchema_OPEN,
+			Required: true,
+		},
+		answers: []string{"  "},
+		exp_err: codes.InvalidArgument,
+	},
+}
+
+// validationSchema is a poll used in testsValidateAnswers.
+var validationSchema = &query.PollSchema{
+	Questions: []*query.PollSchema_QA{
+		{
+			Question: "Choose",
+			Options:  []string{"a", "b"},
+			Type:     query.PollSchema_CLOSE,
+		},
+		{
+			Question: "Why?",
+			Type:     query.PollSchema_OPEN,
+		},
+	},
+}
+
+var testsValidateAnswers = []struct {
+	answers []*query.PollSchema_QA
+	exp_err codes.Code
+}{
+	{ // test0 - positive
+		answers: []*query.PollSchema_QA{
+			{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CLOSE, Answers: []string{"true", "false"}},
+			{Question: "Why?", Type: query.PollSchema_OPEN, Answers: []string{"Because"}},
+		},
+		exp_err: codes.OK,
+	},
+	{ // test1 - positive, questions not answered
+		answers: []*query.PollSchema_QA{
+			{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CLOSE},
+			{Question: "Why?", Type: query.PollSchema_OPEN},
+		},
+		exp_err: codes.OK,
+	},
+	{ // test2 - negative, missing question
+		answers: []*query.PollSchema_QA{
+			{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CLOSE, Answers: []string{"true", "false"}},
+		},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test3 - negative, additional question
+		answers: []*query.PollSchema_QA{
+			{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CLOSE, Answers: []string{"true", "false"}},
+			{Question: "Why?", Type: query.PollSchema_OPEN, Answers: []string{"Because"}},
+			{Question: "Why not?", Type: query.PollSchema_OPEN, Answers: []string{"Because"}},
+		},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test4 - negative, changed option
+		answers: []*query.PollSchema_QA{
+			{Question: "Choose", Options: []string{"a", "c"}, Type: query.PollSchema_CLOSE, Answers: []string{"true", "false"}},
+			{Question: "Why?", Type: query.PollSchema_OPEN, Answers: []string{"Because"}},
+		},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test5 - negative, more answers than options
+		answers: []*query.PollSchema_QA{
+			{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CLOSE, Answers: []string{"false", "false", "true"}},
+			{Question: "Why?", Type: query.PollSchema_OPEN, Answers: []string{"Because"}},
+		},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test6 - negative, answer is not boolean
+		answers: []*query.PollSchema_QA{
+			{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CLOSE, Answers: []string{"yes", "no"}},
+			{Question: "Why?", Type: query.PollSchema_OPEN, Answers: []string{"Because"}},
+		},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test7 - negative, two answers to open question
+		answers: []*query.PollSchema_QA{
+			{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CLOSE, Answers: []string{"true", "false"}},
+			{Question: "Why?", Type: query.PollSchema_OPEN, Answers: []string{"Because", "Just because"}},
+		},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test8 - negative, questions in different order
+		answers: []*query.PollSchema_QA{
+			{Question: "Why?", Type: query.PollSchema_OPEN, Answers: []string{"Because"}},
+			{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CLOSE, Answers: []string{"true", "false"}},
+		},
+		exp_err: codes.InvalidArgument,
+	},
+}
+
+// Malformed votes are sent to poll with validationSchema.
+var testsMalformedVote = []struct {
+	in      *query.VoteRequest
+	exp_err error
+}{
+	{ // test0 - negative, vote without sign
+		in: &query.VoteRequest{
+			Answers: &query.PollSchema{},
+		},
+		exp_err: status.Errorf(codes.InvalidArgument, "Error in PollVote: vote is not signed"),
+	},
+	{ // test1 - negative, vote without answers and ballot
+		in: &query.VoteRequest{
+			Sign: &query.RSASignature{},
+		},
+		exp_err: status.Errorf(codes.InvalidArgument, "Error in PollVote: vote has no answers"),
+	},
+	{ // test2 - negative, empty request
+		in:      &query.VoteRequest{},
+		exp_err: status.Errorf(codes.InvalidArgument, "Error in PollVote: vote is not signed"),
+	},
+	{ // test3 - negative, empty sign
+		in: &query.VoteRequest{
+			Ballot: &query.Ballot{Version: query.BallotVersion},
+			Sign:   &query.RSASignature{},
+		},
+		exp_err: fmt.Errorf("Error in PollVte, Sign invalid!"),
+	},
+}
+
+var testsBallotVote = []struct {
+	ballot  *query.Ballot // Ballot which is signed.
+	sent    *query.Ballot // Ballot sent instead of signed one, if set.
+	exp_err codes.Code
+}{
+	{ // test0 - positive
+		ballot: &query.Ballot{
+			Version: query.BallotVersion,
+			Answers: []*query.Ballot_Answer{
+				{Question: 0, Selected: []int32{1}},
+				{Question: 1, Text: "Because"},
+			},
+		},
+		exp_err: codes.OK,
+	},
+	{ // test1 - positive, questions not answered
+		ballot:  &query.Ballot{Version: query.BallotVersion},
+		exp_err: codes.OK,
+	},
+	{ // test2 - negative, two options of closed question
+		ballot: &query.Ballot{
+			Version: query.BallotVersion,
+			Answers: []*query.Ballot_Answer{
+				{Question: 0, Selected: []int32{0, 1}},
+			},
+		},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test3 - negative, questions not in order
+		ballot: &query.Ballot{
+			Version: query.BallotVersion,
+			Answers: []*query.Ballot_Answer{
+				{Question: 1, Text: "Because"},
+				{Question: 0, Selected: []int32{1}},
+			},
+		},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test4 - negative, unknown version
+		ballot:  &query.Ballot{Version: query.BallotVersion + 1},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test5 - negative, sent ballot differs from signed one
+		ballot: &query.Ballot{
+			Version: query.BallotVersion,
+			Answers: []*query.Ballot_Answer{
+				{Question: 0, Selected: []int32{0}},
+			},
+		},
+		sent: &query.Ballot{
+			Version: query.BallotVersion,
+			Answers: []*query.Ballot_Answer{
+				{Question: 0, Selected: []int32{1}},
+			},
+		},
+		exp_err: codes.Unknown,
+	},
+}
+
+// Second question is required, but it is shown only to voters who chose yes.
+var conditionalSchema = &query.PollSchema{
+	Questions: []*query.PollSchema_QA{
+		{Question: "Do you have a pet?", Options: []string{"yes", "no"}, Type: query.PollSchema_CLOSE, Required: true},
+		{
+			Question: "Which pet?",
+			Type:     query.PollSchema_OPEN,
+			Required: true,
+			ShowIf:   &query.PollSchema_Condition{Question: 0, Options: []int32{0}},
+		},
+	},
+}
+
+var testsConditionalVote = []struct {
+	answers []*query.Ballot_Answer
+	exp_err codes.Code
+}{
+	{ // test0 - positive, shown question answered
+		answers: []*query.Ballot_Answer{
+			{Question: 0, Selected: []int32{0}},
+			{Question: 1, Text: "Cat"},
+		},
+		exp_err: codes.OK,
+	},
+	{ // test1 - positive, skipped question is not required
+		answers: []*query.Ballot_Answer{
+			{Question: 0, Selected: []int32{1}},
+		},
+		exp_err: codes.OK,
+	},
+	{ // test2 - negative, shown question is required
+		answers: []*query.Ballot_Answer{
+			{Question: 0, Selected: []int32{0}},
+		},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test3 - negative, skipped question answered
+		answers: []*query.Ballot_Answer{
+			{Question: 0, Selected: []int32{1}},
+			{Question: 1, Text: "Cat"},
+		},
+		exp_err: codes.InvalidArgument,
+	},
+}
+
+var testsPollMetadata = []struct {
+	md      *query.PollMetadata
+	exp_err codes.Code
+}{
+	{ // test0 - positive, poll without metadata
+		md:      nil,
+		exp_err: codes.OK,
+	},
+	{ // test1 - positive
+		md: &query.PollMetadata{
+			Title:       "Lunch",
+			Description: "Where do we go?",
+			Locale:      "en",
+			Translations: []*query.PollMetadata_Translation{
+				{Locale: "pl", Title: "Obiad"},
+			},
 		},
+		exp_err: codes.OK,
+	},
+	{ // test2 - negative, translation doesn't match schema
+		md: &query.PollMetadata{
+			Title: "Lunch",
+			Translations: []*query.PollMetadata_Translation{
+				{
+					Locale: "pl",
+					Questions: []*query.PollMetadata_QuestionTranslation{
+						{Question: "Gdzie?"},
+						{Question: "Dlaczego?"},
+						{Question: "Kiedy?"},
+					},
+				},
+			},
+		},
+		exp_err: codes.InvalidArgument,
+	},
+}
+
+// Template and poll cloned in templates tests have different times than original poll.
+var testsTemplates = []struct {
+	clone      bool  // Poll is cloned from previous poll instead of created from template.
+	authorized bool  // Admin key (for cloning) or owner key of previous poll is sent.
+	other_key  bool  // Owner key of another owner is sent.
+	tokens     int32 // Number of tokens of new poll.
+	exp_err    codes.Code
+}{
+	{ // test0 - positive, poll created from template by owner
+		authorized: true,
+		tokens:     10,
+		exp_err:    codes.OK,
+	},
+	{ // test1 - positive, poll cloned by owner
+		clone:      true,
+		authorized: true,
+		tokens:     10,
+		exp_err:    codes.OK,
+	},
+	{ // test2 - negative, poll cloned without admin key
+		clone:   true,
+		tokens:  10,
+		exp_err: codes.Unauthenticated,
+	},
+	{ // test3 - negative, too many tokens
+		authorized: true,
+		tokens:     1000000,
+		exp_err:    codes.InvalidArgument,
+	},
+	{ // test4 - negative, poll created from template without admin key
+		tokens:  10,
+		exp_err: codes.Unauthenticated,
+	},
+	{ // test5 - negative, poll created from template of another owner
+		other_key: true,
+		tokens:    10,
+		exp_err:   codes.NotFound,
+	},
+}
+
+var testsListPolls = []struct {
+	req        *query.ListPollsRequest
+	owner_key  string // Owner key sent with request: "owner" of the first poll, "bad" (admin key) or none.
+	exp_titles []string
+	exp_err    codes.Code
+}{
+	{ // test0 - positive, first page
+		req:        &query.ListPollsRequest{PageSize: 1},
+		exp_titles: []string{"Board vote"},
+		exp_err:    codes.OK,
+	},
+	{ // test1 - positive, filter by title
+		req:        &query.ListPollsRequest{Title: "lunch"},
+		exp_titles: []string{"Lunch"},
+		exp_err:    codes.OK,
+	},
+	{ // test2 - negative, invalid page token
+		req:     &query.ListPollsRequest{PageToken: "?"},
+		exp_err: codes.InvalidArgument,
+	},
+	{ // test3 - positive, polls of owner
+		req:        &query.ListPollsRequest{},
+		owner_key:  "owner",
+		exp_titles: []string{"Board vote", "Board elections"},
+		exp_err:    codes.OK,
+	},
+	{ // test4 - negative, admin key instead of owner key
+		req:       &query.ListPollsRequest{},
+		owner_key: "bad",
+		exp_err:   codes.PermissionDenied,
+	},
+	{ // test5 - positive, only listed polls without admin key
+		req:        &query.ListPollsRequest{},
+		exp_titles: []string{"Board vote", "Lunch"},
+		exp_err:    codes.OK,
 	},
 }
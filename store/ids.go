@@ -0,0 +1,103 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// pollIDSize is a number of random bytes in external identifier of poll.
+const pollIDSize = 16
+
+// pollIDEncoding encodes external identifiers of polls. Identifiers are
+// lowercase, so they look well in voting links.
+var pollIDEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newPollID generates random external identifier of poll.
+func newPollID() (string, error) {
+	binid := make([]byte, pollIDSize)
+	if _, err := rand.Read(binid); err != nil {
+		return "", fmt.Errorf("Failed to generate poll ID: %w", err)
+	}
+	return strings.ToLower(pollIDEncoding.EncodeToString(binid)), nil
+}
+
+// PollNumber returns number of poll with given external identifier.
+//
+// Number is used only inside of database, clients see polls by their
+// random identifiers, so they can't enumerate polls.
+func PollNumber(db *bolt.DB, id string) (int32, error) {
+	var number int32
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		number, err = readPollNumber(tx, id)
+		return err
+	})
+	return number, err
+}
+
+// readPollNumber reads number of poll with given external identifier from PollIDsBucket.
+func readPollNumber(tx *bolt.Tx, id string) (int32, error) {
+	v := tx.Bucket([]byte("PollIDsBucket")).Get([]byte(id))
+	if v == nil {
+		return 0, fmt.Errorf("No such poll: %v", id)
+	}
+	number, err := strconv.Atoi(string(v))
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read poll number from database: %w", err)
+	}
+	return int32(number), nil
+}
+
+// savePollID generates external identifier for poll of given number stored
+// in pbuck and saves it both in poll bucket and in PollIDsBucket.
+func savePollID(tx *bolt.Tx, pbuck *bolt.Bucket, number int32) (string, error) {
+	idsbuck := tx.Bucket([]byte("PollIDsBucket"))
+	id, err := newPollID()
+	if err != nil {
+		return "", err
+	}
+	if idsbuck.Get([]byte(id)) != nil {
+		return "", fmt.Errorf("Poll ID %v is already used", id)
+	}
+	if err = pbuck.Put([]byte("ID"), []byte(id)); err != nil {
+		return "", err
+	}
+	return id, idsbuck.Put([]byte(id), []byte(strconv.Itoa(int(number))))
+}
+
+// pollExternalID reads external identifier of poll stored in pbuck.
+func pollExternalID(pbuck *bolt.Bucket) string {
+	return string(pbuck.Get([]byte("ID")))
+}
+
+// migratePollIDs gives external identifiers to polls created before they were introduced.
+func migratePollIDs(tx *bolt.Tx) error {
+	pollsbuck := tx.Bucket([]byte("PollsBucket"))
+	var numbers []int32
+	err := pollsbuck.ForEach(func(k, v []byte) error {
+		number, ok := pollNumber(k)
+		if v != nil || !ok {
+			return nil
+		}
+		if pollsbuck.Bucket(k).Get([]byte("ID")) == nil {
+			numbers = append(numbers, number)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Buckets can't be modified while iterating over them.
+	for _, number := range numbers {
+		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(number)) + "Bucket"))
+		if _, err = savePollID(tx, pbuck, number); err != nil {
+			return fmt.Errorf("Failed to migrate poll %v: %w", number, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ememak/Projekt-Rada/query"
+	"github.com/golang/protobuf/proto"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultPageSize is a number of polls listed by ListPolls, if page size is not set.
+const DefaultPageSize = 20
+
+// MaxPageSize is a maximal number of polls listed by ListPolls at once.
+const MaxPageSize = 100
+
+// ListPolls reads page of polls matching filters from req.
+//
+// Polls are listed in order of creation, which is order of their numbers.
+// Page token is an id of the last poll of previous page, so pages stay
+// consistent when new polls are created and numbers of polls are not revealed.
+// If owner is not nil, only polls of the owner are listed, otherwise only
+// polls with listed schema. Only public data of polls (metadata and status)
+// is returned.
+func ListPolls(db *bolt.DB, req *query.ListPollsRequest, owner []byte) (*query.PollList, error) {
+	size := int(req.PageSize)
+	if size < 0 {
+		return nil, fmt.Errorf("Error! Negative page size.")
+	}
+	if size == 0 {
+		size = DefaultPageSize
+	}
+	if size > MaxPageSize {
+		size = MaxPageSize
+	}
+	list := &query.PollList{}
+	err := db.View(func(tx *bolt.Tx) error {
+		pollsbuck := tx.Bucket([]byte("PollsBucket"))
+
+		after := 0
+		if req.PageToken != "" {
+			number, err := readPollNumber(tx, req.PageToken)
+			if err != nil {
+				return fmt.Errorf("Error! Invalid page token.")
+			}
+			after = int(number)
+		}
+
+		// Numbers of polls are given by sequence of PollsBucket. Buckets
+		// are iterated by number, as cursor would put Poll10Bucket before
+		// Poll2Bucket.
+		for n := after + 1; n <= int(pollsbuck.Sequence()); n++ {
+			pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(n) + "Bucket"))
+			if pbuck == nil {
+				continue
+			}
+			visible, err := isVisible(pbuck, owner)
+			if err != nil {
+				return err
+			}
+			if !visible {
+				continue
+			}
+			pl, err := readListing(pbuck)
+			if err != nil {
+				return err
+			}
+			if !matchesFilters(pl, req) {
+				continue
+			}
+			if len(list.Polls) == size {
+				list.NextPageToken = list.Polls[size-1].Id
+				return nil
+			}
+			list.Polls = append(list.Polls, pl)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// pollNumber reads number of poll from name of its bucket.
+func pollNumber(k []byte) (int32, bool) {
+	name := string(k)
+	if !strings.HasPrefix(name, "Poll") || !strings.HasSuffix(name, "Bucket") {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "Poll"), "Bucket"))
+	if err != nil {
+		return 0, false
+	}
+	return int32(id), true
+}
+
+// isVisible checks if poll stored in pbuck is listed to owner, or to
+// everyone if owner is nil.
+func isVisible(pbuck *bolt.Bucket, owner []byte) (bool, error) {
+	if owner != nil {
+		return subtle.ConstantTimeCompare(pbuck.Get([]byte("Owner")), owner) == 1, nil
+	}
+	sch := &query.PollSchema{}
+	if err := proto.Unmarshal(pbuck.Get([]byte("Schema")), sch); err != nil {
+		return false, fmt.Errorf("Failed to read poll from database in ListPolls: %w", err)
+	}
+	return sch.Listed, nil
+}
+
+// readListing reads metadata and status of poll stored in pbuck.
+func readListing(pbuck *bolt.Bucket) (*query.PollListing, error) {
+	md := &query.PollMetadata{}
+	if err := proto.Unmarshal(pbuck.Get([]byte("Metadata")), md); err != nil {
+		return nil, fmt.Errorf("Failed to read metadata from database in ListPolls: %w", err)
+	}
+	ps, err := readStatus(pbuck)
+	if err != nil {
+		return nil, err
+	}
+	return &query.PollListing{
+		Id:       pollExternalID(pbuck),
+		Metadata: md,
+		Status:   ps,
+	}, nil
+}
+
+// matchesFilters checks if poll pl passes filters of req.
+func matchesFilters(pl *query.PollListing, req *query.ListPollsRequest) bool {
+	if len(req.States) > 0 {
+		found := false
+		for _, state := range req.States {
+			if pl.Status.State == state {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if req.CreatedAfter != 0 && pl.Metadata.Created <= req.CreatedAfter {
+		return false
+	}
+	if req.Title != "" && !strings.Contains(strings.ToLower(pl.Metadata.Title), strings.ToLower(req.Title)) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"math"
+	"sort"
+
+	"github.com/ememak/Projekt-Rada/query"
+)
+
+// numberBins is a number of bins in histograms of NUMBER questions.
+const numberBins = 10
+
+// numericVote is an answer to NUMBER or SCALE question together with its weight.
+type numericVote struct {
+	value  float64
+	weight int32
+}
+
+// numericStats calculates statistics of answers to NUMBER or SCALE question qa.
+//
+// Statistics are described in query.NumericResult. Number of question is not set.
+func numericStats(qa *query.PollSchema_QA, votes []numericVote) *query.NumericResult {
+	res := &query.NumericResult{}
+	sort.Slice(votes, func(i, j int) bool { return votes[i].value < votes[j].value })
+
+	var sum float64
+	for _, v := range votes {
+		res.Count += int64(v.weight)
+		sum += float64(v.weight) * v.value
+	}
+	if res.Count > 0 {
+		res.Mean = sum / float64(res.Count)
+		var sq float64
+		for _, v := range votes {
+			d := v.value - res.Mean
+			sq += float64(v.weight) * d * d
+		}
+		res.Stddev = math.Sqrt(sq / float64(res.Count))
+		// Median is a mean of two middle values, which are equal if count is odd.
+		res.Median = (weightedNth(votes, (res.Count-1)/2) + weightedNth(votes, res.Count/2)) / 2
+	}
+
+	if qa.Type == query.PollSchema_SCALE {
+		values := qa.ScaleValues()
+		for _, val := range values {
+			res.Histogram = append(res.Histogram, &query.NumericResult_Bin{From: val, To: val})
+		}
+		if len(values) < 2 {
+			return res
+		}
+		step := values[1] - values[0]
+		for _, v := range votes {
+			k := int(math.Round((v.value - qa.Min) / step))
+			if 0 <= k && k < len(res.Histogram) {
+				res.Histogram[k].Count += int64(v.weight)
+			}
+		}
+		return res
+	}
+
+	lo, hi := qa.Min, qa.Max
+	if lo >= hi {
+		if len(votes) == 0 {
+			return res
+		}
+		lo, hi = votes[0].value, votes[len(votes)-1].value
+	}
+	if lo == hi {
+		res.Histogram = []*query.NumericResult_Bin{{From: lo, To: hi, Count: res.Count}}
+		return res
+	}
+	// Range of extreme values can overflow, histogram is skipped then.
+	width := (hi - lo) / numberBins
+	if math.IsInf(width, 0) || math.IsNaN(width) || width <= 0 {
+		return res
+	}
+	for k := 0; k < numberBins; k++ {
+		res.Histogram = append(res.Histogram, &query.NumericResult_Bin{
+			From: lo + float64(k)*width,
+			To:   lo + float64(k+1)*width,
+		})
+	}
+	res.Histogram[numberBins-1].To = hi
+	for _, v := range votes {
+		k := numberBins - 1
+		if f := (v.value - lo) / width; f < numberBins {
+			k = int(f)
+		}
+		if k < 0 {
+			k = 0
+		}
+		res.Histogram[k].Count += int64(v.weight)
+	}
+	return res
+}
+
+// weightedNth returns n-th (counted from 0) of sorted values, each repeated weight times.
+func weightedNth(votes []numericVote, n int64) float64 {
+	for _, v := range votes {
+		if n < int64(v.weight) {
+			return v.value
+		}
+		n -= int64(v.weight)
+	}
+	return votes[len(votes)-1].value
+}
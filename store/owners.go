@@ -0,0 +1,83 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ownerKeySize is a number of random bytes in owner key.
+const ownerKeySize = 32
+
+// NewOwner creates new owner of polls and templates.
+//
+// Owner key is generated randomly and only its hash is saved in OwnersBucket,
+// with time of creation. Hash identifies owner inside database and is
+// returned together with the key.
+func NewOwner(db *bolt.DB) (string, []byte, error) {
+	binkey := make([]byte, ownerKeySize)
+	if _, err := rand.Read(binkey); err != nil {
+		return "", nil, fmt.Errorf("Failed to generate owner key in NewOwner: %w", err)
+	}
+	key := base64.RawURLEncoding.EncodeToString(binkey)
+	owner := ownerID(key)
+	err := db.Update(func(tx *bolt.Tx) error {
+		obuck := tx.Bucket([]byte("OwnersBucket"))
+		if obuck.Get(owner) != nil {
+			return fmt.Errorf("Owner key is already used")
+		}
+		return obuck.Put(owner, []byte(strconv.FormatInt(time.Now().Unix(), 10)))
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return key, owner, nil
+}
+
+// CheckOwner returns identifier of owner with given owner key.
+//
+// Owners are looked up by hash of their key, so the key is never compared
+// with stored data directly.
+func CheckOwner(db *bolt.DB, key string) ([]byte, error) {
+	owner := ownerID(key)
+	err := db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("OwnersBucket")).Get(owner) == nil {
+			return fmt.Errorf("Invalid owner key")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return owner, nil
+}
+
+// PollOwner returns identifier of owner of poll, which is nil if poll has no owner.
+func PollOwner(db *bolt.DB, pollid int32) ([]byte, error) {
+	var owner []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		pollsbuck := tx.Bucket([]byte("PollsBucket"))
+
+		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
+		if pbuck == nil {
+			return fmt.Errorf("No such poll: %v", pollid)
+		}
+		owner = append([]byte(nil), pbuck.Get([]byte("Owner"))...)
+		if len(owner) == 0 {
+			owner = nil
+		}
+		return nil
+	})
+	return owner, err
+}
+
+// ownerID returns identifier of owner with given key, which is a SHA-256 hash of the key.
+func ownerID(key string) []byte {
+	hash := sha256.Sum256([]byte(key))
+	return hash[:]
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"github.com/ememak/Projekt-Rada/query"
+)
+
+// rankedVote is a ranking of options from one vote together with its weight.
+type rankedVote struct {
+	ranking []int
+	weight  int32
+}
+
+// instantRunoff tallies votes for RANKED question with n options.
+//
+// Rounds are described in query.RankedResult. Number of question is not set.
+func instantRunoff(n int, votes []rankedVote) *query.RankedResult {
+	res := &query.RankedResult{Winner: -1}
+	eliminated := make([]bool, n)
+	for remaining := n; remaining > 0; remaining-- {
+		round := &query.RankedResult_Round{
+			Counts:     make([]int64, n),
+			Eliminated: -1,
+		}
+		var total int64
+		for _, v := range votes {
+			top := -1
+			for _, opt := range v.ranking {
+				if !eliminated[opt] {
+					top = opt
+					break
+				}
+			}
+			if top < 0 {
+				round.Exhausted += int64(v.weight)
+				continue
+			}
+			round.Counts[top] += int64(v.weight)
+			total += int64(v.weight)
+		}
+		res.Rounds = append(res.Rounds, round)
+		if total == 0 {
+			return res
+		}
+
+		// Leader has majority if he has more than a half of votes, which still count.
+		leader, last := -1, -1
+		for opt := 0; opt < n; opt++ {
+			if eliminated[opt] {
+				continue
+			}
+			if leader < 0 || round.Counts[opt] > round.Counts[leader] {
+				leader = opt
+			}
+			if last < 0 || round.Counts[opt] <= round.Counts[last] {
+				last = opt
+			}
+		}
+		if 2*round.Counts[leader] > total || remaining == 1 {
+			res.Winner = int32(leader)
+			return res
+		}
+		eliminated[last] = true
+		round.Eliminated = int32(last)
+	}
+	return res
+}
@@ -6,9 +6,11 @@
 //
 //   KeysBucket is storing keys for polls.
 //   Each key is stored in pair (keyid, key), where id is number of poll
-//   and key is PKCS1 encoding of key.
+//   and key is PKCS1 encoding of key. Keys of weight classes other than 1
+//   are stored with label keyidwweight.
 //   * KeysBucket
 //     - (keyid, key)
+//     - (keyidwweight, key)
 //
 //   PollsBucket is storing data of polls: schema, tokens and votes.
 //   * PollsBucket
@@ -17,35 +19,91 @@
 //     Id in name is its number (starting with 1!).
 //     - PollidBucket
 //
+//       ID is a random identifier of poll, by which poll is known outside
+//       of database (see PollIDsBucket).
+//       + ("ID", id)
+//
 //       Schema structure stores poll questions.
 //       It is stored in database encoded using proto.Marshal function.
 //       + ("Schema", struct)
 //
+//       Metadata is a PollMetadata structure encoded using proto.Marshal
+//       function. Polls created without metadata don't have it.
+//       + ("Metadata", struct)
+//
+//       AdminKey is a SHA-256 hash of poll's admin key. Polls created before
+//       admin keys were introduced have no owner.
+//       + ("AdminKey", hash)
+//
+//       LinkKey is a random key used for signing voting links. Polls created
+//       before voting links were introduced get it when it is needed first time.
+//       + ("LinkKey", key)
+//
+//       State is a number of PollStatus.State, which was set last time.
+//       Current state depends also on opening and closing times from schema.
+//       + ("State", state)
+//
 //       TokensBucket is storing tokens to poll.
-//       Each is stored as its value as key and bool value specifying if it was used.
+//       Each is stored as its value as key and TokenStatus structure without
+//       token encoded using proto.Marshal function. Tokens saved before token
+//       states were introduced have a single byte value: 1 if unused, 0 if used.
+//       Tokens without weight have weight 1.
 //       + TokensBucket
-//         - (token, used)
+//         - (token, struct)
 //
 //       VotesBucket stores votes for poll.
 //       + VotesBucket
 //
 //         Each vote is stored in a bucket named after ballot used to signing it.
 //         Ballot and sign are first and second value of RSASignature used in voting.
+//         Nonce is a value used to calculate ballot from answers.
 //         Answer is a PollSchema containing questions and answers encoded using
-//         proto.Marshal function.
+//         proto.Marshal function. Votes sent in compact form have Ballot
+//         structure encoded the same way instead of it.
+//         Weight is a weight class of key used for signing, votes saved
+//         without it have weight 1.
+//         Time is a unix time of the last submission. In polls with KEEP_ALL
+//         vote policy all submissions (PollAnswer structures) are also kept in
+//         History bucket, under consecutive numbers starting with 1.
+//         RevoteKey is a SHA-256 hash of key allowing to change answers, it is
+//         saved only in polls with REPLACE or KEEP_ALL vote policy.
 //         - Ballot
 //           + ("Sign", sign)
-//           + ("Answer", structure)
+//           + ("RevoteKey", hash)
+//           + ("Nonce", nonce)
+//           + ("Answer", structure) or ("Ballot", structure)
+//           + ("Weight", weight)
+//           + ("Time", time)
+//           + History
+//             - (nr, struct)
+//
+//   PollIDsBucket maps random identifiers of polls to their numbers.
+//   Polls created before identifiers were introduced get them in DBInit.
+//   * PollIDsBucket
+//     - (id, number)
+//
+//   TemplatesBucket is storing templates of polls. Each template is stored
+//   as PollTemplate structure encoded using proto.Marshal function, under
+//   its id (starting with 1).
+//   * TemplatesBucket
+//     - (id, struct)
 //
 // Each number value is stored using strconv.Itoa function.
 package store
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/x509"
+	"encoding/base64"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ememak/Projekt-Rada/query"
 	"github.com/golang/protobuf/proto"
@@ -53,6 +111,22 @@ import (
 	bolt "go.etcd.io/bbolt"
 )
 
+// adminKeySize is a number of random bytes in admin key.
+const adminKeySize = 32
+
+// revoteKeySize is a number of random bytes in key allowing to change a vote.
+const revoteKeySize = 32
+
+// linkKeySize is a number of random bytes in key used for signing voting links.
+const linkKeySize = 32
+
+// tokenBatchSize is a maximal number of tokens saved in one transaction.
+const tokenBatchSize = 1000
+
+// tokenUsePrecision is a precision in seconds of saved time of token use.
+// Exact time would allow to match tokens with votes by their times.
+const tokenUsePrecision = 24 * 60 * 60
+
 // DBInit Opens database and create buckets for data.
 //
 // This function have to be called before any other database related function.
@@ -70,7 +144,22 @@ func DBInit(filename string) (*bolt.DB, error) {
 			return err
 		}
 		_, err = tx.CreateBucketIfNotExists([]byte("PollsBucket"))
-		return err
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("PollIDsBucket"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("TemplatesBucket"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("OwnersBucket"))
+		if err != nil {
+			return err
+		}
+		return migratePollIDs(tx)
 	})
 	return db, err
 }
@@ -81,11 +170,18 @@ func DBInit(filename string) (*bolt.DB, error) {
 // If keyid is not in database, nil is returned.
 // Key is stored in PKCS1 format.
 func GetKey(db *bolt.DB, pollid int32) (*rsa.PrivateKey, error) {
+	return GetWeightedKey(db, pollid, 1)
+}
+
+// GetWeightedKey reads key used for signing ballots of given weight class.
+//
+// Key of weight 1 is the same as key returned by GetKey.
+func GetWeightedKey(db *bolt.DB, pollid int32, weight int32) (*rsa.PrivateKey, error) {
 	var bkeycpy []byte
 	// Database db should be open before this call.
 	err := db.View(func(tx *bolt.Tx) error {
 		kbuck := tx.Bucket([]byte("KeyBucket"))
-		bkey := kbuck.Get([]byte("key" + strconv.Itoa(int(pollid))))
+		bkey := kbuck.Get(keyName(pollid, weight))
 		if bkey == nil {
 			return fmt.Errorf("No key for this poll in database.")
 		}
@@ -121,22 +217,134 @@ func SaveKey(db *bolt.DB, pollid int, key *rsa.PrivateKey) error {
 	bkey := x509.MarshalPKCS1PrivateKey(key)
 	return db.Update(func(tx *bolt.Tx) error {
 		keybuck := tx.Bucket([]byte("KeyBucket"))
-		return keybuck.Put([]byte("key"+strconv.Itoa(pollid)), bkey)
+		return keybuck.Put(keyName(int32(pollid), 1), bkey)
 	})
 }
 
-// NewPoll creates bucket for new poll.
+// AddWeightedKey saves key for weight class of poll, if the class has no key yet.
 //
-// Return values is an id of poll in database and error returned by database.
-func NewPoll(db *bolt.DB, sch *query.PollSchema) (*query.PollQuestion, error) {
+// Returned key is the one stored in database after call, so it is an
+// earlier key if there was one.
+func AddWeightedKey(db *bolt.DB, pollid int32, weight int32, key *rsa.PrivateKey) (*rsa.PrivateKey, error) {
+	if key == nil {
+		return nil, fmt.Errorf("Error! Private key is nil!")
+	}
+	if weight < 1 {
+		return nil, fmt.Errorf("Error! Weight has to be positive.")
+	}
+	if err := key.Validate(); err != nil {
+		return nil, err
+	}
+	var bkeycpy []byte
+	err := db.Update(func(tx *bolt.Tx) error {
+		keybuck := tx.Bucket([]byte("KeyBucket"))
+		if bkey := keybuck.Get(keyName(pollid, weight)); bkey != nil {
+			bkeycpy = append([]byte(nil), bkey...)
+			return nil
+		}
+		return keybuck.Put(keyName(pollid, weight), x509.MarshalPKCS1PrivateKey(key))
+	})
+	if err != nil || bkeycpy == nil {
+		return key, err
+	}
+
+	key, err = x509.ParsePKCS1PrivateKey(bkeycpy)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to convert key from binary: %w", err)
+	}
+	return key, nil
+}
+
+// GetWeights returns sorted weight classes, which have keys in a poll.
+func GetWeights(db *bolt.DB, pollid int32) ([]int32, error) {
+	var weights []int32
+	prefix := keyName(pollid, 1)
+	err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("KeyBucket")).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			rest := string(k[len(prefix):])
+			if rest == "" {
+				weights = append(weights, 1)
+				continue
+			}
+			// Labels of other polls may share the prefix, e.g. key1 and key12.
+			if !strings.HasPrefix(rest, "w") {
+				continue
+			}
+			w, err := strconv.Atoi(rest[1:])
+			if err != nil {
+				return fmt.Errorf("Failed to read weight of key in GetWeights: %w", err)
+			}
+			weights = append(weights, int32(w))
+		}
+		return nil
+	})
+	sort.Slice(weights, func(i, j int) bool { return weights[i] < weights[j] })
+	return weights, err
+}
+
+// keyName returns label of key of weight class in KeyBucket.
+func keyName(pollid int32, weight int32) []byte {
+	name := "key" + strconv.Itoa(int(pollid))
+	if weight > 1 {
+		name += "w" + strconv.Itoa(int(weight))
+	}
+	return []byte(name)
+}
+
+// NewPoll creates bucket for new poll with given number of tokens.
+//
+// Return values is a poll with its random id and number in database, and
+// error returned by database.
+// Returned poll contains admin key, only its hash is saved in database.
+// Tokens are generated using GenerateTokens after poll is created.
+// Poll has no metadata, see NewPollWithMetadata.
+func NewPoll(db *bolt.DB, sch *query.PollSchema, tokens int) (*query.PollQuestion, error) {
+	return NewPollWithMetadata(db, sch, nil, tokens)
+}
+
+// NewPollWithMetadata creates new poll like NewPoll and saves its metadata next to schema.
+//
+// Time of creation is set in saved metadata, md itself is not modified.
+// If md is nil, no metadata is saved.
+func NewPollWithMetadata(db *bolt.DB, sch *query.PollSchema, md *query.PollMetadata, tokens int) (*query.PollQuestion, error) {
+	return newPoll(db, sch, md, nil, nil, tokens)
+}
+
+// NewPollWithKey creates new poll like NewPollWithMetadata together with its key.
+//
+// Key is saved like in SaveKey, but in the same transaction as poll, so
+// there is never a poll without a key in database. Owner is an identifier of
+// poll's owner returned by NewOwner or CheckOwner, poll has no owner if it is nil.
+func NewPollWithKey(db *bolt.DB, sch *query.PollSchema, md *query.PollMetadata, key *rsa.PrivateKey, owner []byte, tokens int) (*query.PollQuestion, error) {
+	if key == nil {
+		return &query.PollQuestion{}, fmt.Errorf("Error! Private key is nil!")
+	}
+	if err := key.Validate(); err != nil {
+		return &query.PollQuestion{}, err
+	}
+	return newPoll(db, sch, md, key, owner, tokens)
+}
+
+// newPoll creates new poll, key and owner are saved only if they are not nil.
+func newPoll(db *bolt.DB, sch *query.PollSchema, md *query.PollMetadata, key *rsa.PrivateKey, owner []byte, tokens int) (*query.PollQuestion, error) {
+	if tokens < 0 {
+		return &query.PollQuestion{}, fmt.Errorf("Error! Negative number of tokens.")
+	}
 	poll := &query.PollQuestion{
 		Schema: sch,
 	}
+	binadmin := make([]byte, adminKeySize)
+	if _, err := rand.Read(binadmin); err != nil {
+		return &query.PollQuestion{}, fmt.Errorf("Failed to generate admin key in NewPoll: %w", err)
+	}
+	poll.AdminKey = base64.RawURLEncoding.EncodeToString(binadmin)
+
 	err := db.Update(func(tx *bolt.Tx) error {
 		// All polls are stored in PollsBucket.
 		pollsbuck := tx.Bucket([]byte("PollsBucket"))
 		id, _ := pollsbuck.NextSequence()
-		poll.Id = int32(id)
+		poll.Number = int32(id)
 
 		// Each poll is contained in bucket named by its number.
 		pbuck, err := pollsbuck.CreateBucketIfNotExists([]byte("Poll" + strconv.Itoa(int(id)) + "Bucket"))
@@ -144,6 +352,12 @@ func NewPoll(db *bolt.DB, sch *query.PollSchema) (*query.PollQuestion, error) {
 			return err
 		}
 
+		// Clients know poll only by its random id.
+		poll.Id, err = savePollID(tx, pbuck, poll.Number)
+		if err != nil {
+			return err
+		}
+
 		// Inside of a poll bucket there are two buckets and one value:
 		// Value for schema, buckets for tokens and votes.
 
@@ -161,90 +375,413 @@ func NewPoll(db *bolt.DB, sch *query.PollSchema) (*query.PollQuestion, error) {
 			return err
 		}
 
-		tbuck, err := pbuck.CreateBucketIfNotExists([]byte("TokensBucket"))
+		if md != nil {
+			if err = md.IsValid(sch); err != nil {
+				return err
+			}
+			md = proto.Clone(md).(*query.PollMetadata)
+			md.Created = time.Now().Unix()
+			binmd, err := proto.Marshal(md)
+			if err != nil {
+				return err
+			}
+			err = pbuck.Put([]byte("Metadata"), binmd)
+			if err != nil {
+				return err
+			}
+		}
+
+		adminhash := sha256.Sum256([]byte(poll.AdminKey))
+		err = pbuck.Put([]byte("AdminKey"), adminhash[:])
+		if err != nil {
+			return err
+		}
+
+		if owner != nil {
+			if err = pbuck.Put([]byte("Owner"), owner); err != nil {
+				return err
+			}
+		}
+
+		if _, err = newLinkKey(pbuck); err != nil {
+			return err
+		}
+
+		// Poll with scheduled opening waits for it as a draft.
+		state := query.PollStatus_OPEN
+		if sch.Opens != 0 {
+			state = query.PollStatus_DRAFT
+		}
+		err = pbuck.Put([]byte("State"), []byte(strconv.Itoa(int(state))))
 		if err != nil {
 			return err
 		}
-		for i := 0; i < 100; i++ {
-			uid := uuid.NewString()
-			tbuck.Put([]byte(uid), []byte{1})
-			poll.Tokens = append(poll.Tokens, uid)
+
+		_, err = pbuck.CreateBucketIfNotExists([]byte("TokensBucket"))
+		if err != nil {
+			return err
 		}
 
 		_, err = pbuck.CreateBucketIfNotExists([]byte("VotesBucket"))
-		return err
+		if err != nil || key == nil {
+			return err
+		}
+
+		keybuck := tx.Bucket([]byte("KeyBucket"))
+		return keybuck.Put(keyName(poll.Number, 1), x509.MarshalPKCS1PrivateKey(key))
 	})
 	if err != nil {
 		return &query.PollQuestion{}, err
 	}
-	return poll, err
+
+	poll.Tokens, err = GenerateTokens(db, poll.Number, tokens, 1)
+	if err != nil {
+		return &query.PollQuestion{}, fmt.Errorf("Failed to generate tokens in NewPoll: %w", err)
+	}
+	return poll, nil
 }
 
-// GetPoll reads poll from database.
-func GetPoll(db *bolt.DB, pollid int32) (query.PollQuestion, error) {
-	q := query.PollQuestion{
-		Id:     pollid,
-		Schema: &query.PollSchema{},
+// GenerateTokens creates n new random tokens of given weight for a poll.
+//
+// Tokens are saved in batches of tokenBatchSize, each in separate transaction,
+// so big polls don't block database for a long time. If error occurs,
+// tokens saved in earlier batches stay in database.
+func GenerateTokens(db *bolt.DB, pollid int32, n int, weight int32) ([]string, error) {
+	tokens := make([]string, 0, n)
+	for len(tokens) < n {
+		batch := n - len(tokens)
+		if batch > tokenBatchSize {
+			batch = tokenBatchSize
+		}
+		err := db.Update(func(tx *bolt.Tx) error {
+			pollsbuck := tx.Bucket([]byte("PollsBucket"))
+
+			pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
+			if pbuck == nil {
+				return fmt.Errorf("No such poll: %v", pollid)
+			}
+
+			tbuck := pbuck.Bucket([]byte("TokensBucket"))
+			for i := 0; i < batch; i++ {
+				uid := uuid.NewString()
+				if err := writeToken(tbuck, newToken(uid, weight)); err != nil {
+					return err
+				}
+				tokens = append(tokens, uid)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
-	// Database db should be open before this call.
+	return tokens, nil
+}
+
+// CheckAdminKey checks if key is an admin key of a poll.
+//
+// If returned error is nil, key is valid.
+func CheckAdminKey(db *bolt.DB, pollid int32, key string) error {
+	return db.View(func(tx *bolt.Tx) error {
+		pollsbuck := tx.Bucket([]byte("PollsBucket"))
+
+		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
+		if pbuck == nil {
+			return fmt.Errorf("No such poll: %v", pollid)
+		}
+
+		adminhash := pbuck.Get([]byte("AdminKey"))
+		if adminhash == nil {
+			return fmt.Errorf("Poll has no owner")
+		}
+		keyhash := sha256.Sum256([]byte(key))
+		if subtle.ConstantTimeCompare(adminhash, keyhash[:]) != 1 {
+			return fmt.Errorf("Invalid admin key")
+		}
+		return nil
+	})
+}
+
+// GetLinkKey reads key used for signing voting links of a poll.
+//
+// If poll has no key yet, new one is generated and saved.
+func GetLinkKey(db *bolt.DB, pollid int32) ([]byte, error) {
+	var key []byte
 	err := db.View(func(tx *bolt.Tx) error {
 		pollsbuck := tx.Bucket([]byte("PollsBucket"))
 
 		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
 		if pbuck == nil {
-			return fmt.Errorf("Poll ID does not exist in database. GetPoll: %v", pollid)
+			return fmt.Errorf("No such poll: %v", pollid)
+		}
+		if v := pbuck.Get([]byte("LinkKey")); v != nil {
+			key = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil || key != nil {
+		return key, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		pollsbuck := tx.Bucket([]byte("PollsBucket"))
+
+		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
+		// Key could be generated in the meantime by other call.
+		if v := pbuck.Get([]byte("LinkKey")); v != nil {
+			key = append([]byte(nil), v...)
+			return nil
 		}
+		var err error
+		key, err = newLinkKey(pbuck)
+		return err
+	})
+	return key, err
+}
 
-		// Read Schema stored as bytes converted via proto.Marchal.
-		binschema := pbuck.Get([]byte("Schema"))
-		err := proto.Unmarshal(binschema, q.Schema)
+// newLinkKey generates key for signing voting links and saves it in poll bucket.
+func newLinkKey(pbuck *bolt.Bucket) ([]byte, error) {
+	key := make([]byte, linkKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("Failed to generate link key: %w", err)
+	}
+	return key, pbuck.Put([]byte("LinkKey"), key)
+}
+
+// GetSchema reads schema of a poll.
+func GetSchema(db *bolt.DB, pollid int32) (*query.PollSchema, error) {
+	sch := &query.PollSchema{}
+	err := db.View(func(tx *bolt.Tx) error {
+		pollsbuck := tx.Bucket([]byte("PollsBucket"))
+
+		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
+		if pbuck == nil {
+			return fmt.Errorf("No such poll: %v", pollid)
+		}
+
+		err := proto.Unmarshal(pbuck.Get([]byte("Schema")), sch)
 		if err != nil {
-			return fmt.Errorf("Failed to read schema from database in GetPoll: %w", err)
+			return fmt.Errorf("Failed to read schema from database in GetSchema: %w", err)
+		}
+		return nil
+	})
+	return sch, err
+}
+
+// GetMetadata reads metadata of a poll.
+//
+// Polls created without metadata have empty one.
+func GetMetadata(db *bolt.DB, pollid int32) (*query.PollMetadata, error) {
+	md := &query.PollMetadata{}
+	err := db.View(func(tx *bolt.Tx) error {
+		pollsbuck := tx.Bucket([]byte("PollsBucket"))
+
+		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
+		if pbuck == nil {
+			return fmt.Errorf("No such poll: %v", pollid)
+		}
+
+		err := proto.Unmarshal(pbuck.Get([]byte("Metadata")), md)
+		if err != nil {
+			return fmt.Errorf("Failed to read metadata from database in GetMetadata: %w", err)
+		}
+		return nil
+	})
+	return md, err
+}
+
+// GetStatus reads state of a poll.
+//
+// State stored in database is updated with scheduled opening and closing times,
+// so returned state is valid at the moment of call.
+// Polls created before states were introduced have no state and are open.
+func GetStatus(db *bolt.DB, pollid int32) (*query.PollStatus, error) {
+	var ps *query.PollStatus
+	err := db.View(func(tx *bolt.Tx) error {
+		pollsbuck := tx.Bucket([]byte("PollsBucket"))
+
+		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
+		if pbuck == nil {
+			return fmt.Errorf("No such poll: %v", pollid)
+		}
+
+		var err error
+		ps, err = readStatus(pbuck)
+		return err
+	})
+	return ps, err
+}
+
+// readStatus reads current state of poll stored in pbuck.
+func readStatus(pbuck *bolt.Bucket) (*query.PollStatus, error) {
+	sch := &query.PollSchema{}
+	err := proto.Unmarshal(pbuck.Get([]byte("Schema")), sch)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read schema from database in GetStatus: %w", err)
+	}
+
+	ps := &query.PollStatus{
+		Pollid: pollExternalID(pbuck),
+		State:  query.PollStatus_OPEN,
+		Opens:  sch.Opens,
+		Closes: sch.Closes,
+	}
+	if v := pbuck.Get([]byte("State")); v != nil {
+		state, err := strconv.Atoi(string(v))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read state from database in GetStatus: %w", err)
+		}
+		ps.State = query.PollStatus_State(state)
+	}
+
+	now := time.Now().Unix()
+	if ps.State == query.PollStatus_DRAFT && ps.Opens != 0 && now >= ps.Opens {
+		ps.State = query.PollStatus_OPEN
+	}
+	if ps.State == query.PollStatus_OPEN && ps.Closes != 0 && now >= ps.Closes {
+		ps.State = query.PollStatus_CLOSED
+	}
+	return ps, nil
+}
+
+// SetState changes state of a poll.
+//
+// Poll can only move forward: from draft to open, from draft or open to closed,
+// and from closed to archived.
+func SetState(db *bolt.DB, pollid int32, state query.PollStatus_State) (*query.PollStatus, error) {
+	var ps *query.PollStatus
+	err := db.Update(func(tx *bolt.Tx) error {
+		pollsbuck := tx.Bucket([]byte("PollsBucket"))
+
+		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
+		if pbuck == nil {
+			return fmt.Errorf("No such poll: %v", pollid)
+		}
+
+		var err error
+		ps, err = readStatus(pbuck)
+		if err != nil {
+			return err
+		}
+
+		allowed := false
+		switch state {
+		case query.PollStatus_OPEN:
+			allowed = ps.State == query.PollStatus_DRAFT
+		case query.PollStatus_CLOSED:
+			allowed = ps.State == query.PollStatus_DRAFT || ps.State == query.PollStatus_OPEN
+		case query.PollStatus_ARCHIVED:
+			allowed = ps.State == query.PollStatus_CLOSED
+		}
+		if !allowed {
+			return fmt.Errorf("Poll can't change state from %v to %v", ps.State, state)
 		}
 
-		// Tokens are stored as pairs (token, bool), where bool is true if token was not used.
-		// If used == false, token is not read from database.
+		ps.State = state
+		return pbuck.Put([]byte("State"), []byte(strconv.Itoa(int(state))))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// GetTokens reads unused tokens of a poll from database.
+func GetTokens(db *bolt.DB, pollid int32) ([]string, error) {
+	var tokens []string
+	// Database db should be open before this call.
+	err := db.View(func(tx *bolt.Tx) error {
+		pollsbuck := tx.Bucket([]byte("PollsBucket"))
+
+		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
+		if pbuck == nil {
+			return fmt.Errorf("Poll ID does not exist in database. GetTokens: %v", pollid)
+		}
+
+		// Only unused tokens are read from database.
 		tbuck := pbuck.Bucket([]byte("TokensBucket"))
 		c := tbuck.Cursor()
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			if !bytes.Equal(v, []byte{0}) {
-				q.Tokens = append(q.Tokens, string(k))
+			ts, err := readToken(string(k), v)
+			if err != nil {
+				return err
+			}
+			if ts.State == query.TokenStatus_UNUSED {
+				tokens = append(tokens, string(k))
 			}
 		}
+		return nil
+	})
+	return tokens, err
+}
+
+// GetVotes reads all votes of a poll from database.
+func GetVotes(db *bolt.DB, pollid int32) ([]*query.PollAnswer, error) {
+	var votes []*query.PollAnswer
+	// Database db should be open before this call.
+	err := db.View(func(tx *bolt.Tx) error {
+		pollsbuck := tx.Bucket([]byte("PollsBucket"))
+
+		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
+		if pbuck == nil {
+			return fmt.Errorf("Poll ID does not exist in database. GetVotes: %v", pollid)
+		}
 
 		// Votes are stored in VotesBucket.
-		// Each vote is a different bucket inside VotesBucket, with name Vote+nr.
+		// Each vote is a different bucket inside VotesBucket, named after its ballot.
 		vbuck := pbuck.Bucket([]byte("VotesBucket"))
 
-		c = vbuck.Cursor()
+		c := vbuck.Cursor()
 		for k, _ := c.First(); k != nil; k, _ = c.Next() {
 			ansbuck := vbuck.Bucket(k)
-			pa := query.PollAnswer{
+			pa := &query.PollAnswer{
 				Answers: &query.PollSchema{},
 			}
+			// Values read from database are valid only during transaction, so they are copied.
 			sign := ansbuck.Get([]byte("Sign"))
 			pa.Sign = &query.RSASignature{
-				Ballot: k,
-				Sign:   sign,
+				Ballot: append([]byte(nil), k...),
+				Sign:   append([]byte(nil), sign...),
 			}
+			pa.Nonce = append([]byte(nil), ansbuck.Get([]byte("Nonce"))...)
+			pa.Time, _ = strconv.ParseInt(string(ansbuck.Get([]byte("Time"))), 10, 64)
+			pa.Weight = readWeight(ansbuck)
 
+			// Votes sent in compact form are stored as ballots, the others as answers.
+			if binb := ansbuck.Get([]byte("Ballot")); binb != nil {
+				pa.Answers = nil
+				pa.Ballot = &query.Ballot{}
+				if err := proto.Unmarshal(binb, pa.Ballot); err != nil {
+					return fmt.Errorf("Failed to read vote from database in GetVotes: %w", err)
+				}
+				votes = append(votes, pa)
+				continue
+			}
 			binans := ansbuck.Get([]byte("Answer"))
 			// Read Answers stored as bytes converted via proto.Marchal.
-			err = proto.Unmarshal(binans, pa.Answers)
+			err := proto.Unmarshal(binans, pa.Answers)
 			if err != nil {
-				return fmt.Errorf("Failed to read vote from database in GetPoll: %w", err)
+				return fmt.Errorf("Failed to read vote from database in GetVotes: %w", err)
 			}
-			q.Votes = append(q.Votes, &pa)
+			votes = append(votes, pa)
 		}
 		return nil
 	})
-	return q, err
+	return votes, err
 }
 
 // SaveToken saves token for specified poll in database.
 //
 // Token is represented as string.
 func SaveToken(db *bolt.DB, token string, pollid int32) error {
+	return SaveTokens(db, pollid, []string{token}, 1)
+}
+
+// SaveTokens saves tokens of given weight for specified poll in database.
+//
+// Tokens are saved in one transaction. If any of them is invalid or already
+// exists in poll (even if it was used), none of them is saved.
+func SaveTokens(db *bolt.DB, pollid int32, tokens []string, weight int32) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		pollsbuck := tx.Bucket([]byte("PollsBucket"))
 
@@ -254,17 +791,32 @@ func SaveToken(db *bolt.DB, token string, pollid int32) error {
 		}
 
 		tbuck := pbuck.Bucket([]byte("TokensBucket"))
-		return tbuck.Put([]byte(token), []byte{1})
+		for _, token := range tokens {
+			if tbuck.Get([]byte(token)) != nil {
+				return fmt.Errorf("Token already exists: %v", token)
+			}
+			if err := writeToken(tbuck, newToken(token, weight)); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 }
 
 // AcceptToken checks if token sent by client is valid.
 //
 // Function returns true if token is present in database and
-// if this token was not used before.
-// If returned error is nil, token is accepted.
+// if this token was not used or revoked before.
+// If returned error is nil, token is accepted and marked as used.
 func AcceptToken(db *bolt.DB, token string, pollid int32) error {
-	return db.Update(func(tx *bolt.Tx) error {
+	_, err := AcceptWeightedToken(db, token, pollid)
+	return err
+}
+
+// AcceptWeightedToken works like AcceptToken and returns weight of accepted token.
+func AcceptWeightedToken(db *bolt.DB, token string, pollid int32) (int32, error) {
+	var weight int32
+	err := db.Update(func(tx *bolt.Tx) error {
 		pollsbuck := tx.Bucket([]byte("PollsBucket"))
 
 		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
@@ -275,33 +827,229 @@ func AcceptToken(db *bolt.DB, token string, pollid int32) error {
 		}
 		tbuck := pbuck.Bucket([]byte("TokensBucket"))
 
-		// We check if requested token exists. If so, v will have one element, else 0.
 		v := tbuck.Get([]byte(token))
 		if v == nil {
 			return fmt.Errorf("No such token")
 		}
-		if v[0] == 0 {
+		ts, err := readToken(token, v)
+		if err != nil {
+			return err
+		}
+		switch ts.State {
+		case query.TokenStatus_USED:
+			return fmt.Errorf("Token was used before")
+		case query.TokenStatus_REVOKED:
+			return fmt.Errorf("Token was revoked")
+		}
+
+		// Time of use is saved with lower precision, so it can't be matched with a vote.
+		now := time.Now().Unix()
+		ts.State = query.TokenStatus_USED
+		ts.Changed = now - now%tokenUsePrecision
+		weight = ts.Weight
+		return writeToken(tbuck, ts)
+	})
+	return weight, err
+}
+
+// GetTokenWeight returns weight of unused token.
+func GetTokenWeight(db *bolt.DB, token string, pollid int32) (int32, error) {
+	var weight int32
+	err := db.View(func(tx *bolt.Tx) error {
+		pollsbuck := tx.Bucket([]byte("PollsBucket"))
+
+		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
+		if pbuck == nil {
+			return fmt.Errorf("No such poll: %v", pollid)
+		}
+
+		v := pbuck.Bucket([]byte("TokensBucket")).Get([]byte(token))
+		if v == nil {
+			return fmt.Errorf("No such token")
+		}
+		ts, err := readToken(token, v)
+		if err != nil {
+			return err
+		}
+		if ts.State != query.TokenStatus_UNUSED {
+			return fmt.Errorf("Token can't be used")
+		}
+		weight = ts.Weight
+		return nil
+	})
+	return weight, err
+}
+
+// RevokeToken invalidates unused token, so it can't be used for voting.
+func RevokeToken(db *bolt.DB, token string, pollid int32) (*query.TokenStatus, error) {
+	var ts *query.TokenStatus
+	err := db.Update(func(tx *bolt.Tx) error {
+		pollsbuck := tx.Bucket([]byte("PollsBucket"))
+
+		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
+		if pbuck == nil {
+			return fmt.Errorf("No such poll: %v", pollid)
+		}
+		tbuck := pbuck.Bucket([]byte("TokensBucket"))
+
+		v := tbuck.Get([]byte(token))
+		if v == nil {
+			return fmt.Errorf("No such token")
+		}
+		var err error
+		ts, err = readToken(token, v)
+		if err != nil {
+			return err
+		}
+		switch ts.State {
+		case query.TokenStatus_USED:
 			return fmt.Errorf("Token was used before")
+		case query.TokenStatus_REVOKED:
+			return fmt.Errorf("Token was revoked")
+		}
+
+		ts.State = query.TokenStatus_REVOKED
+		ts.Changed = time.Now().Unix()
+		return writeToken(tbuck, ts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// ListTokens reads all tokens of a poll with their states.
+func ListTokens(db *bolt.DB, pollid int32) ([]*query.TokenStatus, error) {
+	var tokens []*query.TokenStatus
+	err := db.View(func(tx *bolt.Tx) error {
+		pollsbuck := tx.Bucket([]byte("PollsBucket"))
+
+		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
+		if pbuck == nil {
+			return fmt.Errorf("No such poll: %v", pollid)
+		}
+
+		tbuck := pbuck.Bucket([]byte("TokensBucket"))
+		return tbuck.ForEach(func(k, v []byte) error {
+			ts, err := readToken(string(k), v)
+			if err != nil {
+				return err
+			}
+			tokens = append(tokens, ts)
+			return nil
+		})
+	})
+	return tokens, err
+}
+
+// newToken returns status of a token of given weight created now.
+func newToken(token string, weight int32) *query.TokenStatus {
+	ts := &query.TokenStatus{
+		Token:   token,
+		State:   query.TokenStatus_UNUSED,
+		Created: time.Now().Unix(),
+		Weight:  weight,
+	}
+	if weight < 1 {
+		ts.Weight = 1
+	}
+	return ts
+}
+
+// readToken decodes status of token from its value in TokensBucket.
+func readToken(token string, v []byte) (*query.TokenStatus, error) {
+	ts := &query.TokenStatus{}
+	// Tokens saved in old format have no timestamps.
+	if len(v) == 1 {
+		if v[0] == 0 {
+			ts.State = query.TokenStatus_USED
 		}
-		// After use we remove token from database by setting its value to 0.
-		return tbuck.Put([]byte(token), []byte{0})
+	} else if err := proto.Unmarshal(v, ts); err != nil {
+		return nil, fmt.Errorf("Failed to read token from database: %w", err)
+	}
+	ts.Token = token
+	if ts.Weight == 0 {
+		ts.Weight = 1
+	}
+	return ts, nil
+}
+
+// writeToken saves status of token in TokensBucket.
+//
+// Token is a key, so it is not repeated in value.
+func writeToken(tbuck *bolt.Bucket, ts *query.TokenStatus) error {
+	v, err := proto.Marshal(&query.TokenStatus{
+		State:   ts.State,
+		Created: ts.Created,
+		Changed: ts.Changed,
+		Weight:  ts.Weight,
 	})
+	if err != nil {
+		return err
+	}
+	return tbuck.Put([]byte(ts.Token), v)
 }
 
 // SaveVote is saving properly signed vote to database.
+//
+// What happens when the same signature was used before depends on poll's vote policy:
+// earlier vote is replaced, new vote is rejected, or vote is replaced and all
+// submissions are kept in vote's history. Only the last submission is counted.
+//
+// In polls which allow revoting, reply to the first vote contains revote key.
+// Request changing the vote has to contain this key. Matching of ballot with
+// answers is not checked here, it is a job of the caller.
 func SaveVote(db *bolt.DB, vr *query.VoteRequest) (*query.VoteReply, error) {
 	reply := &query.VoteReply{}
+	weight := vr.Weight
+	if weight < 1 {
+		weight = 1
+	}
+	revoteKey := make([]byte, revoteKeySize)
+	if _, err := rand.Read(revoteKey); err != nil {
+		return reply, fmt.Errorf("Failed to generate revote key in SaveVote: %w", err)
+	}
 	err := db.Update(func(tx *bolt.Tx) error {
 		pollsbuck := tx.Bucket([]byte("PollsBucket"))
 
-		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(vr.Pollid)) + "Bucket"))
-
-		// Check if poll of number vr.Pollid exists.
+		// Check if poll with id vr.Pollid exists.
+		pollid, err := readPollNumber(tx, vr.Pollid)
+		if err != nil {
+			return err
+		}
+		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
 		if pbuck == nil {
 			return fmt.Errorf("No such poll: %v", vr.Pollid)
 		}
 		vbuck := pbuck.Bucket([]byte("VotesBucket"))
 
+		// Vote policy is stored in poll's schema.
+		sch := &query.PollSchema{}
+		err = proto.Unmarshal(pbuck.Get([]byte("Schema")), sch)
+		if err != nil {
+			return fmt.Errorf("Failed to read schema from database in SaveVote: %w", err)
+		}
+
+		status := query.VoteReply_ACCEPTED
+		if earlier := vbuck.Bucket(vr.Sign.Ballot); earlier != nil {
+			switch sch.Policy {
+			case query.PollSchema_REJECT:
+				return fmt.Errorf("Vote with this signature was already saved")
+			case query.PollSchema_KEEP_ALL:
+				status = query.VoteReply_APPENDED
+			default:
+				status = query.VoteReply_REPLACED
+			}
+			if vr.RevoteKey != nil {
+				hash := sha256.Sum256(vr.RevoteKey)
+				if subtle.ConstantTimeCompare(hash[:], earlier.Get([]byte("RevoteKey"))) != 1 {
+					return fmt.Errorf("Error! Invalid revote key.")
+				}
+			}
+		} else if vr.RevoteKey != nil {
+			return fmt.Errorf("No vote with this signature to change")
+		}
+
 		// Save vote. Vote is stored as a bucket.
 		// Name of this bucket is ballot used for signing it.
 		ansbuck, err := vbuck.CreateBucketIfNotExists(vr.Sign.Ballot)
@@ -309,36 +1057,153 @@ func SaveVote(db *bolt.DB, vr *query.VoteRequest) (*query.VoteReply, error) {
 			return err
 		}
 
+		// The first vote gets a key, which allows to change it later.
+		if status == query.VoteReply_ACCEPTED && sch.Policy != query.PollSchema_REJECT {
+			hash := sha256.Sum256(revoteKey)
+			if err = ansbuck.Put([]byte("RevoteKey"), hash[:]); err != nil {
+				return err
+			}
+			reply.RevoteKey = revoteKey
+		}
+
 		err = ansbuck.Put([]byte("Sign"), vr.Sign.Sign)
 		if err != nil {
 			return err
 		}
 
-		// Check if Vote is valid (in sense of valid characters etc.).
-		if err = vr.Answers.IsValid(); err != nil {
+		err = ansbuck.Put([]byte("Nonce"), vr.Nonce)
+		if err != nil {
+			return err
+		}
+
+		// Answers are stored as a ballot if they were sent in compact form.
+		// Replaced vote could be sent in the other form, so its answers are removed.
+		key, other := []byte("Answer"), []byte("Ballot")
+		var binans []byte
+		if vr.Ballot != nil {
+			key, other = other, key
+			if err = sch.ValidateBallot(vr.Ballot); err != nil {
+				return err
+			}
+			binans, err = proto.Marshal(vr.Ballot)
+		} else {
+			// Check if Vote is valid (in sense of valid characters etc.).
+			if err = vr.Answers.IsValid(); err != nil {
+				return err
+			}
+			binans, err = proto.Marshal(vr.Answers)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = ansbuck.Put(key, binans)
+		if err != nil {
+			return err
+		}
+		err = ansbuck.Delete(other)
+		if err != nil {
 			return err
 		}
 
-		binans, err := proto.Marshal(vr.Answers)
+		err = ansbuck.Put([]byte("Weight"), []byte(strconv.Itoa(int(weight))))
 		if err != nil {
 			return err
 		}
 
-		err = ansbuck.Put([]byte("Answer"), binans)
+		now := time.Now().Unix()
+		err = ansbuck.Put([]byte("Time"), []byte(strconv.FormatInt(now, 10)))
 		if err != nil {
 			return err
 		}
 
+		if sch.Policy == query.PollSchema_KEEP_ALL {
+			hbuck, err := ansbuck.CreateBucketIfNotExists([]byte("History"))
+			if err != nil {
+				return err
+			}
+			sub := &query.PollAnswer{
+				Answers: vr.Answers,
+				Ballot:  vr.Ballot,
+				Sign:    vr.Sign,
+				Nonce:   vr.Nonce,
+				Time:    now,
+				Weight:  weight,
+			}
+			if vr.Ballot != nil {
+				sub.Answers = nil
+			}
+			binsub, err := proto.Marshal(sub)
+			if err != nil {
+				return err
+			}
+			seq, _ := hbuck.NextSequence()
+			err = hbuck.Put([]byte(strconv.Itoa(int(seq))), binsub)
+			if err != nil {
+				return err
+			}
+		}
+
 		reply.Mess = "Thank you for your vote!"
+		reply.Status = status
+		reply.Policy = sch.Policy
 		return nil
 	})
+	if err != nil {
+		// Key of rolled back vote is not valid.
+		reply.RevoteKey = nil
+	}
 	return reply, err
 }
 
+// GetHistory reads all submissions of a vote signed with ballot.
+//
+// History is kept only in polls with KEEP_ALL vote policy.
+// Submissions are sorted from the oldest one.
+func GetHistory(db *bolt.DB, pollid int32, ballot []byte) ([]*query.PollAnswer, error) {
+	var history []*query.PollAnswer
+	err := db.View(func(tx *bolt.Tx) error {
+		pollsbuck := tx.Bucket([]byte("PollsBucket"))
+
+		pbuck := pollsbuck.Bucket([]byte("Poll" + strconv.Itoa(int(pollid)) + "Bucket"))
+		if pbuck == nil {
+			return fmt.Errorf("No such poll: %v", pollid)
+		}
+
+		ansbuck := pbuck.Bucket([]byte("VotesBucket")).Bucket(ballot)
+		if ansbuck == nil {
+			return fmt.Errorf("No vote with this ballot")
+		}
+		hbuck := ansbuck.Bucket([]byte("History"))
+		if hbuck == nil {
+			return nil
+		}
+
+		// Keys are sequence numbers stored as text, so we can't rely on order of cursor.
+		for i := 1; ; i++ {
+			binsub := hbuck.Get([]byte(strconv.Itoa(i)))
+			if binsub == nil {
+				break
+			}
+			pa := &query.PollAnswer{}
+			if err := proto.Unmarshal(binsub, pa); err != nil {
+				return fmt.Errorf("Failed to read vote from database in GetHistory: %w", err)
+			}
+			history = append(history, pa)
+		}
+		return nil
+	})
+	return history, err
+}
+
 // GetSummary reads poll's answers from database.
+//
+// Each vote counts as many times as its weight.
+// RANKED questions are tallied using instant-runoff method, for NUMBER
+// and SCALE questions statistics of answers are calculated.
+// Votes, which don't match poll's schema, are not counted.
 func GetSummary(db *bolt.DB, pollid int32) (*query.PollSummary, error) {
 	s := &query.PollSummary{
-		Id:         pollid,
 		VotesCount: 0,
 		Schema:     &query.PollSchema{},
 	}
@@ -350,6 +1215,7 @@ func GetSummary(db *bolt.DB, pollid int32) (*query.PollSummary, error) {
 		if pbuck == nil {
 			return fmt.Errorf("Poll ID does not exist in database. GetPoll: %v", pollid)
 		}
+		s.Id = pollExternalID(pbuck)
 
 		// Read Schema stored as bytes converted via proto.Marchal.
 		binschema := pbuck.Get([]byte("Schema"))
@@ -361,12 +1227,24 @@ func GetSummary(db *bolt.DB, pollid int32) (*query.PollSummary, error) {
 		// We want this schema to contain number of true votes for every answer (converted to string).
 		// So for start we want to have there zero value.
 		for _, qa := range s.Schema.Questions {
+			if qa.Type == query.PollSchema_CHECKBOX || qa.Type == query.PollSchema_CLOSE || qa.Type == query.PollSchema_RANKED {
+				// There is one counter for each option, ranked questions count first preferences.
+				qa.Answers = make([]string, len(qa.Options))
+			}
+			if qa.Type == query.PollSchema_NUMBER || qa.Type == query.PollSchema_SCALE {
+				// Statistics of numeric questions are returned separately.
+				qa.Answers = nil
+			}
 			if qa.Type != query.PollSchema_OPEN {
 				for j, _ := range qa.Answers {
 					qa.Answers[j] = "0"
 				}
 			}
 		}
+		s.Shown = make([]int32, len(s.Schema.Questions))
+		// Rankings and numbers are tallied after reading all votes.
+		rankings := make(map[int][]rankedVote)
+		numbers := make(map[int][]numericVote)
 
 		// Votes are stored in VotesBucket.
 		// Each vote is a different bucket inside VotesBucket, with name Vote+nr.
@@ -374,35 +1252,116 @@ func GetSummary(db *bolt.DB, pollid int32) (*query.PollSummary, error) {
 
 		c := vbuck.Cursor()
 		for k, _ := c.First(); k != nil; k, _ = c.Next() {
-			s.VotesCount += 1
 			ansbuck := vbuck.Bucket(k)
-			pa := &query.PollSchema{}
-
-			binans := ansbuck.Get([]byte("Answer"))
-			// Read Answers stored as bytes converted via proto.Marchal.
-			err := proto.Unmarshal(binans, pa)
+			b, err := readBallot(s.Schema, ansbuck)
 			if err != nil {
 				return fmt.Errorf("Failed to read vote from database in GetPoll: %w", err)
 			}
+			// Votes saved without checking them against schema may not match it.
+			if b == nil {
+				continue
+			}
+			s.VotesCount += 1
+			weight := readWeight(ansbuck)
+			s.WeightsCount += int64(weight)
 
-			for i, qa := range pa.Questions {
-				if qa.Type == query.PollSchema_OPEN {
-					s.Schema.Questions[i].Answers = append(s.Schema.Questions[i].Answers, qa.Answers[0])
-				} else {
-					for j, ans := range qa.Answers {
-						b, err := strconv.ParseBool(ans)
-						if err != nil {
-							return fmt.Errorf("Value not convertable to boolean in answer for closed or checkbox question: %w", err)
-						}
-						if b {
-							v, _ := strconv.Atoi(s.Schema.Questions[i].Answers[j])
-							s.Schema.Questions[i].Answers[j] = strconv.Itoa(v + 1)
-						}
+			answers := make(map[int32]*query.Ballot_Answer)
+			for _, ans := range b.Answers {
+				answers[ans.Question] = ans
+			}
+			// Questions skipped because of their conditions are not counted.
+			visible := s.Schema.Visible(b)
+			for i, qa := range s.Schema.Questions {
+				if !visible[i] {
+					continue
+				}
+				s.Shown[i] += 1
+				ans := answers[int32(i)]
+				// Votes without ranking still count as exhausted in every round.
+				if qa.Type == query.PollSchema_RANKED {
+					var ranking []int
+					for _, opt := range ans.GetSelected() {
+						ranking = append(ranking, int(opt))
+					}
+					if len(ranking) > 0 {
+						v, _ := strconv.Atoi(qa.Answers[ranking[0]])
+						qa.Answers[ranking[0]] = strconv.Itoa(v + int(weight))
+					}
+					rankings[i] = append(rankings[i], rankedVote{ranking: ranking, weight: weight})
+					continue
+				}
+				if ans == nil {
+					continue
+				}
+				switch qa.Type {
+				case query.PollSchema_OPEN:
+					qa.Answers = append(qa.Answers, ans.Text)
+				case query.PollSchema_NUMBER, query.PollSchema_SCALE:
+					numbers[i] = append(numbers[i], numericVote{value: ans.Number, weight: weight})
+				default:
+					for _, opt := range ans.Selected {
+						v, _ := strconv.Atoi(qa.Answers[opt])
+						qa.Answers[opt] = strconv.Itoa(v + int(weight))
 					}
 				}
 			}
 		}
+
+		for i, qa := range s.Schema.Questions {
+			if qa.Type == query.PollSchema_RANKED {
+				res := instantRunoff(len(qa.Options), rankings[i])
+				res.Question = int32(i)
+				s.Ranked = append(s.Ranked, res)
+			}
+			if qa.Type == query.PollSchema_NUMBER || qa.Type == query.PollSchema_SCALE {
+				res := numericStats(qa, numbers[i])
+				res.Question = int32(i)
+				s.Numeric = append(s.Numeric, res)
+			}
+		}
 		return nil
 	})
 	return s, err
 }
+
+// readBallot reads vote stored in ansbuck as a ballot for poll with schema sch.
+//
+// Votes saved in legacy form are converted with query.NewBallot, returned
+// ballot selects options by their positions. If vote doesn't match schema, nil is returned.
+func readBallot(sch *query.PollSchema, ansbuck *bolt.Bucket) (*query.Ballot, error) {
+	if binb := ansbuck.Get([]byte("Ballot")); binb != nil {
+		b := &query.Ballot{}
+		if err := proto.Unmarshal(binb, b); err != nil {
+			return nil, err
+		}
+		if sch.ValidateBallot(b) != nil {
+			return nil, nil
+		}
+		// Options are tallied by their positions in schema.
+		return sch.Positions(b)
+	}
+
+	pa := &query.PollSchema{}
+	if err := proto.Unmarshal(ansbuck.Get([]byte("Answer")), pa); err != nil {
+		return nil, err
+	}
+	if sch.ValidateAnswers(pa) != nil {
+		return nil, nil
+	}
+	b, err := query.NewBallot(pa)
+	if err != nil {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// readWeight reads weight of vote stored in ansbuck.
+//
+// Votes saved before weights were introduced have weight 1.
+func readWeight(ansbuck *bolt.Bucket) int32 {
+	w, err := strconv.Atoi(string(ansbuck.Get([]byte("Weight"))))
+	if err != nil || w < 1 {
+		return 1
+	}
+	return int32(w)
+}
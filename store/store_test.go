@@ -1,16 +1,42 @@
 package store
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"fmt"
+	"math"
+	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/ememak/Projekt-Rada/query"
 	"github.com/golang/protobuf/proto"
+	bolt "go.etcd.io/bbolt"
 )
 
+// sentTo returns copy of vr sent to poll p, if vr doesn't specify poll.
+func sentTo(vr *query.VoteRequest, p *query.PollQuestion) *query.VoteRequest {
+	vr = proto.Clone(vr).(*query.VoteRequest)
+	if vr.Pollid == "" {
+		vr.Pollid = p.Id
+	}
+	return vr
+}
+
+// withoutRevoteKey returns copy of vote reply without random revote key,
+// so it can be compared with test data.
+func withoutRevoteKey(vr *query.VoteReply) *query.VoteReply {
+	if vr == nil {
+		return nil
+	}
+	vr = proto.Clone(vr).(*query.VoteReply)
+	vr.RevoteKey = nil
+	return vr
+}
+
 func TestDBInit(t *testing.T) {
 	tests := testsDBInit
 	for i, test := range tests {
@@ -39,7 +65,7 @@ func TestNewPoll(t *testing.T) {
 
 		data, _ := DBInit("testNP" + strconv.Itoa(i) + ".db")
 		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
-			p, err := NewPoll(data, test.in)
+			p, err := NewPoll(data, test.in, test.tokens)
 			if !reflect.DeepEqual(err, test.exp_err) {
 				t.Errorf("Error %v, want error %v", err, test.exp_err)
 				return
@@ -48,11 +74,66 @@ func TestNewPoll(t *testing.T) {
 					return
 				}
 			}
-			o, err := GetPoll(data, p.Id)
-			if !(proto.Equal(o.Schema, test.in) && reflect.DeepEqual(err, nil)) {
-				t.Errorf("Output %v, want output %v", o.Schema, test.in)
+			sch, err := GetSchema(data, p.Number)
+			if !(proto.Equal(sch, test.in) && reflect.DeepEqual(err, nil)) {
+				t.Errorf("Output %v, want output %v", sch, test.in)
+				t.Errorf("Error %v, want nil error", err)
+			}
+			tokens, err := GetTokens(data, p.Number)
+			if len(p.Tokens) != test.tokens || len(tokens) != test.tokens || err != nil {
+				t.Errorf("Got %v and %v tokens, want %v tokens", len(p.Tokens), len(tokens), test.tokens)
+				t.Errorf("Error %v, want nil error", err)
+			}
+		})
+		data.Close()
+	}
+}
+
+func TestNewPollWithKey(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tests := append(testsNewPollWithKey, struct {
+		key     *rsa.PrivateKey
+		exp_err error
+	}{key, nil})
+	for i, test := range tests {
+
+		data, _ := DBInit("testNPK" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			p, err := NewPollWithKey(data, testsNewPoll[0].in, nil, test.key, nil, 1)
+			if !reflect.DeepEqual(err, test.exp_err) {
+				t.Errorf("Error %v, want error %v", err, test.exp_err)
+				return
+			}
+			if err != nil {
+				// Failed call leaves no poll without key in database.
+				data.View(func(tx *bolt.Tx) error {
+					if n := tx.Bucket([]byte("PollIDsBucket")).Stats().KeyN; n != 0 {
+						t.Errorf("%v polls in database, want 0", n)
+					}
+					return nil
+				})
+				return
+			}
+			keyret, err := GetKey(data, p.Number)
+			if err != nil || !key.Equal(keyret) {
+				t.Errorf("Output %v, want output %v", keyret, key)
+				t.Errorf("Error %v, want nil error", err)
+			}
+
+			if owner, err := PollOwner(data, p.Number); err != nil || owner != nil {
+				t.Errorf("Poll has owner %v, want no owner, error %v", owner, err)
+			}
+
+			// Poll of an owner gets its own admin key.
+			_, owner, _ := NewOwner(data)
+			p2, err := NewPollWithKey(data, testsNewPoll[0].in, nil, test.key, owner, 1)
+			if err != nil || p2.AdminKey == p.AdminKey || CheckAdminKey(data, p2.Number, p.AdminKey) == nil {
+				t.Errorf("Poll %v, want poll with new admin key", p2)
 				t.Errorf("Error %v, want nil error", err)
 			}
+			if owner2, err := PollOwner(data, p2.Number); err != nil || !bytes.Equal(owner2, owner) {
+				t.Errorf("Poll has owner %v, want %v, error %v", owner2, owner, err)
+			}
 		})
 		data.Close()
 	}
@@ -99,32 +180,56 @@ func TestSaveKey(t *testing.T) {
 	}
 }
 
+func TestSaveTokens(t *testing.T) {
+	in := testsSaveTokens
+	for i, test := range in {
+
+		data, _ := DBInit("testST" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			NewPoll(data, &query.PollSchema{}, 0)
+			SaveToken(data, "Used token", 1)
+			AcceptToken(data, "Used token", 1)
+
+			err := SaveTokens(data, test.pollid, test.tokens, 1)
+			if !reflect.DeepEqual(err, test.exp_err) {
+				t.Errorf("Error %v, want error %v", err, test.exp_err)
+			}
+			// Either all tokens are saved or none.
+			tokens, _ := GetTokens(data, 1)
+			if err == nil && len(tokens) != len(test.tokens) || err != nil && len(tokens) != 0 {
+				t.Errorf("Got %v unused tokens after saving %v", len(tokens), test.tokens)
+			}
+		})
+		data.Close()
+	}
+}
+
 func TestAcceptToken(t *testing.T) {
 	in := testsAcceptToken
 	for i, test := range in {
 
 		data, _ := DBInit("testAT" + strconv.Itoa(i) + ".db")
 		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
-			NewPoll(data, testsNewPoll[0].in)
+			NewPoll(data, testsNewPoll[0].in, 100)
 			err := SaveToken(data, test.token, test.pollid)
 			if !reflect.DeepEqual(err, test.st_err) {
 				t.Errorf("Error %v, want nil error", err, test.st_err)
 			}
 
-			pq, err := GetPoll(data, test.pollid)
+			tokens, err := GetTokens(data, test.pollid)
 			if !reflect.DeepEqual(err, test.gp_err) {
 				t.Errorf("Error %v, want error %v", err, test.gp_err)
 			}
 			if test.st_err == nil {
 				found := false
-				for _, tok := range pq.Tokens {
+				for _, tok := range tokens {
 					if reflect.DeepEqual(tok, test.token) {
 						found = true
 						break
 					}
 				}
 				if !found {
-					t.Errorf("Output %v, want output %v", pq.Tokens[0], test.token)
+					t.Errorf("Output %v, want output %v", tokens, test.token)
 				}
 			}
 
@@ -140,26 +245,26 @@ func TestAcceptToken(t *testing.T) {
 	rep_err := fmt.Errorf("Token was used before")
 	data, _ := DBInit("testAT" + strconv.Itoa(len(in)) + ".db")
 	t.Run("Test "+strconv.Itoa(len(in)), func(t *testing.T) {
-		NewPoll(data, testsNewPoll[0].in)
+		NewPoll(data, testsNewPoll[0].in, 100)
 		err := SaveToken(data, test.token, test.pollid)
 		if !reflect.DeepEqual(err, test.st_err) {
 			t.Errorf("Error %v, want error %v", err, test.st_err)
 		}
 
-		pq, err := GetPoll(data, test.pollid)
+		tokens, err := GetTokens(data, test.pollid)
 		if !reflect.DeepEqual(err, test.gp_err) {
 			t.Errorf("Error %v, want error %v", err, test.gp_err)
 		}
 		if test.st_err == nil {
 			found := false
-			for _, tok := range pq.Tokens {
+			for _, tok := range tokens {
 				if reflect.DeepEqual(tok, test.token) {
 					found = true
 					break
 				}
 			}
 			if !found {
-				t.Errorf("Output %v, want output %v", pq.Tokens[0], test.token)
+				t.Errorf("Output %v, want output %v", tokens, test.token)
 			}
 		}
 		err = AcceptToken(data, test.token, test.pollid)
@@ -174,28 +279,215 @@ func TestAcceptToken(t *testing.T) {
 	data.Close()
 }
 
+func TestRevokeToken(t *testing.T) {
+	in := testsRevokeToken
+	for i, test := range in {
+
+		data, _ := DBInit("testRT" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			NewPoll(data, &query.PollSchema{}, 0)
+			if test.legacy != nil {
+				// Token saved in format used before token states.
+				data.Update(func(tx *bolt.Tx) error {
+					pbuck := tx.Bucket([]byte("PollsBucket")).Bucket([]byte("Poll1Bucket"))
+					return pbuck.Bucket([]byte("TokensBucket")).Put([]byte("Good token"), test.legacy)
+				})
+			} else {
+				SaveToken(data, "Good token", 1)
+			}
+			if test.used {
+				AcceptToken(data, "Good token", 1)
+			}
+
+			_, err := RevokeToken(data, test.token, 1)
+			if !reflect.DeepEqual(err, test.exp_err) {
+				t.Errorf("Error %v, want error %v", err, test.exp_err)
+			}
+
+			tokens, err := ListTokens(data, 1)
+			if err != nil || len(tokens) != 1 || tokens[0].Token != "Good token" || tokens[0].State != test.exp_state {
+				t.Errorf("Tokens %v, want one token in state %v", tokens, test.exp_state)
+				t.Errorf("Error %v, want nil error", err)
+			}
+			err = AcceptToken(data, "Good token", 1)
+			if !reflect.DeepEqual(err, test.at_err) {
+				t.Errorf("Error %v, want error %v", err, test.at_err)
+			}
+		})
+		data.Close()
+	}
+}
+
 func TestSaveVote(t *testing.T) {
 	in := testsSaveVote
 	for i, test := range in {
 
 		data, _ := DBInit("testSV" + strconv.Itoa(i) + ".db")
 		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
-			NewPoll(data, testsNewPoll[0].in)
-			vr, err := SaveVote(data, test.in)
-			if !(reflect.DeepEqual(err, test.sv_err) && proto.Equal(vr, test.reply)) {
+			p, _ := NewPoll(data, testsNewPoll[0].in, 100)
+			vr, err := SaveVote(data, sentTo(test.in, p))
+			if !(reflect.DeepEqual(err, test.sv_err) && proto.Equal(withoutRevoteKey(vr), test.reply)) {
 				t.Errorf("Output %v, want output %v", vr, test.reply)
 				t.Errorf("Error %v, want error %v", err, test.sv_err)
 			}
 
-			pq, err := GetPoll(data, test.in.Pollid)
+			votes, err := GetVotes(data, p.Number)
 			if !reflect.DeepEqual(err, test.gp_err) {
 				t.Errorf("Error %v, want error %v", err, test.gp_err)
 			}
 			if test.sv_err == nil {
-				if !(proto.Equal(pq.Votes[0].Answers, test.in.Answers) && proto.Equal(pq.Votes[0].Sign, test.in.Sign)) {
-					t.Errorf("Answers %v, want output %v", pq.Votes[0].Answers, test.in.Answers)
-					t.Errorf("Sign %v, want output %v", pq.Votes[0].Sign, test.in.Sign)
+				if !(proto.Equal(votes[0].Answers, test.in.Answers) && proto.Equal(votes[0].Sign, test.in.Sign)) {
+					t.Errorf("Answers %v, want output %v", votes[0].Answers, test.in.Answers)
+					t.Errorf("Sign %v, want output %v", votes[0].Sign, test.in.Sign)
+				}
+				if !bytes.Equal(votes[0].Nonce, test.in.Nonce) {
+					t.Errorf("Nonce %v, want output %v", votes[0].Nonce, test.in.Nonce)
+				}
+			}
+		})
+		data.Close()
+	}
+}
+
+func TestSaveVotePolicy(t *testing.T) {
+	in := testsSaveVotePolicy
+	for i, test := range in {
+
+		data, _ := DBInit("testSVP" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			p, _ := NewPoll(data, &query.PollSchema{Policy: test.policy}, 100)
+			for j := 0; j < 2; j++ {
+				vr, err := SaveVote(data, sentTo(test.in, p))
+				// Only the first vote in polls allowing revoting gets revote key.
+				if (len(vr.RevoteKey) != 0) != (j == 0 && test.policy != query.PollSchema_REJECT) {
+					t.Errorf("Revote key %v in reply to vote %v", vr.RevoteKey, j)
+				}
+				vr.RevoteKey = nil
+				if !(reflect.DeepEqual(err, test.sv_errs[j]) && proto.Equal(vr, test.replies[j])) {
+					t.Errorf("Output %v, want output %v", vr, test.replies[j])
+					t.Errorf("Error %v, want error %v", err, test.sv_errs[j])
+				}
+			}
+
+			history, err := GetHistory(data, p.Number, test.in.Sign.Ballot)
+			if err != nil || len(history) != test.history {
+				t.Errorf("History length %v, want %v", len(history), test.history)
+				t.Errorf("Error %v, want nil error", err)
+			}
+		})
+		data.Close()
+	}
+}
+
+func TestRevoteKey(t *testing.T) {
+	data, _ := DBInit("testRK.db")
+	defer data.Close()
+
+	p, _ := NewPoll(data, &query.PollSchema{Policy: query.PollSchema_KEEP_ALL}, 0)
+	vr := sentTo(testsSaveVotePolicy[0].in, p)
+	first, err := SaveVote(data, vr)
+	if err != nil || len(first.RevoteKey) != revoteKeySize {
+		t.Fatalf("Revote key %v, error %v, want key and nil error", first.RevoteKey, err)
+	}
+
+	vr.RevoteKey = []byte("wrong key")
+	if _, err = SaveVote(data, vr); !reflect.DeepEqual(err, fmt.Errorf("Error! Invalid revote key.")) {
+		t.Errorf("Error %v, want invalid revote key", err)
+	}
+	vr.RevoteKey = first.RevoteKey
+	if reply, err := SaveVote(data, vr); err != nil || reply.Status != query.VoteReply_APPENDED || reply.RevoteKey != nil {
+		t.Errorf("Output %v, want appended vote without new key", reply)
+		t.Errorf("Error %v, want nil error", err)
+	}
+
+	other := proto.Clone(vr).(*query.VoteRequest)
+	other.Sign.Ballot = []byte{2}
+	if _, err = SaveVote(data, other); !reflect.DeepEqual(err, fmt.Errorf("No vote with this signature to change")) {
+		t.Errorf("Error %v, want error about missing vote", err)
+	}
+
+	history, err := GetHistory(data, p.Number, vr.Sign.Ballot)
+	if err != nil || len(history) != 2 {
+		t.Errorf("History length %v, want 2", len(history))
+		t.Errorf("Error %v, want nil error", err)
+	}
+}
+
+func TestPollState(t *testing.T) {
+	in := testsPollState
+	for i, test := range in {
+
+		data, _ := DBInit("testPS" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			p, err := NewPoll(data, test.schema, 100)
+			if err != nil {
+				t.Errorf("Error %v, want nil error", err)
+				return
+			}
+			ps, err := GetStatus(data, p.Number)
+			if err != nil || ps.State != test.initial {
+				t.Errorf("State %v, want state %v", ps.GetState(), test.initial)
+				t.Errorf("Error %v, want nil error", err)
+			}
+
+			for j, state := range test.states {
+				ps, err := SetState(data, p.Number, state)
+				if !reflect.DeepEqual(err, test.exp_errs[j]) {
+					t.Errorf("Error %v, want error %v", err, test.exp_errs[j])
 				}
+				if err == nil && ps.State != state {
+					t.Errorf("State %v, want state %v", ps.State, state)
+				}
+			}
+		})
+		data.Close()
+	}
+}
+
+func TestCheckAdminKey(t *testing.T) {
+	in := testsCheckAdminKey
+	for i, test := range in {
+
+		data, _ := DBInit("testAK" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			p, _ := NewPoll(data, &query.PollSchema{}, 100)
+			key := test.key
+			if test.useAdminKey {
+				key = p.AdminKey
+			}
+			err := CheckAdminKey(data, test.pollid, key)
+			if !reflect.DeepEqual(err, test.exp_err) {
+				t.Errorf("Error %v, want error %v", err, test.exp_err)
+			}
+		})
+		data.Close()
+	}
+}
+
+func TestCheckOwner(t *testing.T) {
+	in := testsCheckOwner
+	for i, test := range in {
+
+		data, _ := DBInit("testCO" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			key, owner, err := NewOwner(data)
+			if err != nil {
+				t.Fatalf("NewOwner failed, error: %v", err)
+			}
+			// Admin key of a poll doesn't identify owner.
+			p, _ := newPoll(data, &query.PollSchema{}, nil, nil, owner, 0)
+			switch {
+			case test.useOwnerKey:
+				test.key = key
+			case test.useAdminKey:
+				test.key = p.AdminKey
+			}
+			got, err := CheckOwner(data, test.key)
+			if !reflect.DeepEqual(err, test.exp_err) {
+				t.Errorf("Error %v, want error %v", err, test.exp_err)
+			}
+			if err == nil && !bytes.Equal(got, owner) {
+				t.Errorf("Owner %v, want %v", got, owner)
 			}
 		})
 		data.Close()
@@ -208,19 +500,689 @@ func TestGetSummary(t *testing.T) {
 
 		data, _ := DBInit("testGS" + strconv.Itoa(i) + ".db")
 		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
-			NewPoll(data, test.schema)
-			vr, err := SaveVote(data, test.in)
-			if !(reflect.DeepEqual(err, test.sv_err) && proto.Equal(vr, test.sv_out)) {
+			p, _ := NewPoll(data, test.schema, 100)
+			vr, err := SaveVote(data, sentTo(test.in, p))
+			if !(reflect.DeepEqual(err, test.sv_err) && proto.Equal(withoutRevoteKey(vr), test.sv_out)) {
 				t.Errorf("Output %v, want output %v", vr, test.sv_out)
 				t.Errorf("Error %v, want error %v", err, test.sv_err)
 			}
 
-			ps, err := GetSummary(data, test.in.Pollid)
-			if !reflect.DeepEqual(err, test.gs_err) || !reflect.DeepEqual(ps, test.gs_out) {
-				t.Errorf("Output %v, want output %v", ps, test.gs_out)
+			exp := proto.Clone(test.gs_out).(*query.PollSummary)
+			exp.Id = p.Id
+			ps, err := GetSummary(data, p.Number)
+			if !reflect.DeepEqual(err, test.gs_err) || !reflect.DeepEqual(ps, exp) {
+				t.Errorf("Output %v, want output %v", ps, exp)
 				t.Errorf("Error %v, want error %v", err, test.gs_err)
 			}
 		})
 		data.Close()
 	}
 }
+
+func TestWeightedVotes(t *testing.T) {
+	in := testsWeightedVotes
+	for i, test := range in {
+
+		data, _ := DBInit("testWV" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			sch := &query.PollSchema{
+				Questions: []*query.PollSchema_QA{
+					{
+						Question: "Do you agree?",
+						Options:  []string{"yes", "no"},
+						Type:     query.PollSchema_CLOSE,
+						Answers:  []string{"0", "0"},
+					},
+				},
+			}
+			p, _ := NewPoll(data, sch, 0)
+			for j, w := range test.weights {
+				token := "token" + strconv.Itoa(j)
+				if err := SaveTokens(data, 1, []string{token}, w); err != nil {
+					t.Fatalf("Error %v, want nil error", err)
+				}
+				exp := w
+				if exp == 0 {
+					exp = 1
+				}
+				if weight, err := GetTokenWeight(data, token, 1); weight != exp || err != nil {
+					t.Errorf("Weight %v, want weight %v", weight, exp)
+					t.Errorf("Error %v, want nil error", err)
+				}
+				weight, err := AcceptWeightedToken(data, token, 1)
+				if weight != exp || err != nil {
+					t.Errorf("Weight %v, want weight %v", weight, exp)
+					t.Errorf("Error %v, want nil error", err)
+				}
+				if _, err = GetTokenWeight(data, token, 1); err == nil {
+					t.Errorf("Used token has weight, want error")
+				}
+				_, err = SaveVote(data, &query.VoteRequest{
+					Pollid: p.Id,
+					Answers: &query.PollSchema{
+						Questions: []*query.PollSchema_QA{
+							{
+								Question: "Do you agree?",
+								Options:  []string{"yes", "no"},
+								Type:     query.PollSchema_CLOSE,
+								Answers:  []string{"true", "false"},
+							},
+						},
+					},
+					Sign: &query.RSASignature{
+						Ballot: []byte("ballot" + strconv.Itoa(j)),
+						Sign:   []byte("sign"),
+					},
+					Nonce:  []byte("nonce"),
+					Weight: weight,
+				})
+				if err != nil {
+					t.Errorf("Error %v, want nil error", err)
+				}
+			}
+
+			ps, err := GetSummary(data, 1)
+			if err != nil || ps.VotesCount != test.exp_votes || ps.WeightsCount != test.exp_weights {
+				t.Errorf("Counts %v and %v, want %v and %v", ps.VotesCount, ps.WeightsCount, test.exp_votes, test.exp_weights)
+				t.Errorf("Error %v, want nil error", err)
+			}
+			if ans := ps.Schema.Questions[0].Answers; len(ans) != 2 || ans[0] != test.exp_yes || ans[1] != "0" {
+				t.Errorf("Answers %v, want [%v 0]", ans, test.exp_yes)
+			}
+
+			votes, err := GetVotes(data, 1)
+			var sum int64
+			for _, v := range votes {
+				sum += int64(v.Weight)
+			}
+			if err != nil || sum != test.exp_weights {
+				t.Errorf("Sum of weights of votes %v, want %v", sum, test.exp_weights)
+				t.Errorf("Error %v, want nil error", err)
+			}
+		})
+		data.Close()
+	}
+}
+
+func TestWeightedKeys(t *testing.T) {
+	// Keys are never replaced, so database can't be left from earlier run.
+	data, _ := DBInit(filepath.Join(t.TempDir(), "testWK.db"))
+	defer data.Close()
+
+	key1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key3, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	SaveKey(data, 1, key1)
+	// Keys of other polls share prefix of label.
+	SaveKey(data, 12, other)
+
+	key, err := AddWeightedKey(data, 1, 3, key3)
+	if err != nil || !key3.Equal(key) {
+		t.Errorf("Error %v, want nil error and saved key", err)
+	}
+	// Existing key is not replaced.
+	key, err = AddWeightedKey(data, 1, 3, other)
+	if err != nil || !key3.Equal(key) {
+		t.Errorf("Error %v, want nil error and earlier key", err)
+	}
+	if _, err = AddWeightedKey(data, 1, 0, other); err == nil {
+		t.Errorf("Key of weight 0 saved, want error")
+	}
+
+	weights, err := GetWeights(data, 1)
+	if err != nil || !reflect.DeepEqual(weights, []int32{1, 3}) {
+		t.Errorf("Weights %v, want [1 3]", weights)
+		t.Errorf("Error %v, want nil error", err)
+	}
+	key, err = GetWeightedKey(data, 1, 1)
+	if err != nil || !key1.Equal(key) {
+		t.Errorf("Key of weight 1 is not key of poll, error %v", err)
+	}
+	if _, err = GetWeightedKey(data, 1, 2); err == nil {
+		t.Errorf("Key of weight 2 found, want error")
+	}
+}
+
+func TestPollIDs(t *testing.T) {
+	data, _ := DBInit("testPID.db")
+
+	p1, err1 := NewPoll(data, &query.PollSchema{}, 0)
+	p2, err2 := NewPoll(data, &query.PollSchema{}, 0)
+	if err1 != nil || err2 != nil || p1.Id == p2.Id || len(p1.Id) != 26 || p1.Id != strings.ToLower(p1.Id) {
+		t.Fatalf("Polls %q and %q, want distinct random ids", p1.Id, p2.Id)
+	}
+	for _, p := range []*query.PollQuestion{p1, p2} {
+		if number, err := PollNumber(data, p.Id); err != nil || number != p.Number {
+			t.Errorf("Number %v of poll %v, want %v", number, p.Id, p.Number)
+			t.Errorf("Error %v, want nil error", err)
+		}
+	}
+	if _, err := PollNumber(data, "1"); err == nil {
+		t.Errorf("Poll found by its number, want error")
+	}
+
+	// Poll saved before random ids were introduced.
+	data.Update(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte("PollIDsBucket")).Delete([]byte(p1.Id))
+		return tx.Bucket([]byte("PollsBucket")).Bucket([]byte("Poll1Bucket")).Delete([]byte("ID"))
+	})
+	data.Close()
+
+	data, err := DBInit("testPID.db")
+	if err != nil {
+		t.Fatalf("Migration failed, error: %v", err)
+	}
+	defer data.Close()
+	ps, err := GetStatus(data, 1)
+	if err != nil || len(ps.Pollid) != 26 || ps.Pollid == p1.Id {
+		t.Fatalf("Migrated poll has id %q, want new random id", ps.GetPollid())
+	}
+	if number, err := PollNumber(data, ps.Pollid); err != nil || number != 1 {
+		t.Errorf("Number %v of migrated poll, want 1, error: %v", number, err)
+	}
+	if number, err := PollNumber(data, p2.Id); err != nil || number != 2 {
+		t.Errorf("Id of poll 2 changed by migration, number %v, error: %v", number, err)
+	}
+}
+
+func TestRankedSummary(t *testing.T) {
+	in := testsRankedSummary
+	for i, test := range in {
+
+		data, _ := DBInit("testRS" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			options := []string{"A", "B", "C"}
+			p, err := NewPoll(data, &query.PollSchema{
+				Questions: []*query.PollSchema_QA{
+					{
+						Question: "Order candidates",
+						Options:  options,
+						Type:     query.PollSchema_RANKED,
+					},
+				},
+			}, 0)
+			if err != nil {
+				t.Fatalf("NewPoll failed, error: %v", err)
+			}
+			for j, v := range test.votes {
+				_, err := SaveVote(data, &query.VoteRequest{
+					Pollid: p.Id,
+					Answers: &query.PollSchema{
+						Questions: []*query.PollSchema_QA{
+							{
+								Question: "Order candidates",
+								Options:  options,
+								Type:     query.PollSchema_RANKED,
+								Answers:  v.answers,
+							},
+						},
+					},
+					Sign: &query.RSASignature{
+						Ballot: []byte("ballot" + strconv.Itoa(j)),
+						Sign:   []byte("sign"),
+					},
+					Nonce:  []byte("nonce"),
+					Weight: v.weight,
+				})
+				if (err == nil) != v.valid {
+					t.Errorf("Vote %v: error %v, want valid: %v", j, err, v.valid)
+				}
+			}
+
+			ps, err := GetSummary(data, 1)
+			if err != nil || len(ps.Ranked) != 1 {
+				t.Fatalf("Ranked results %v, want one result, error %v", ps.GetRanked(), err)
+			}
+			if !reflect.DeepEqual(ps.Schema.Questions[0].Answers, test.exp_first) {
+				t.Errorf("First preferences %v, want %v", ps.Schema.Questions[0].Answers, test.exp_first)
+			}
+			res := ps.Ranked[0]
+			if res.Question != 0 || res.Winner != test.exp_winner || len(res.Rounds) != len(test.exp_counts) {
+				t.Fatalf("Result %v, want winner %v after %v rounds", res, test.exp_winner, len(test.exp_counts))
+			}
+			for r, round := range res.Rounds {
+				if !reflect.DeepEqual(round.Counts, test.exp_counts[r]) ||
+					round.Exhausted != test.exp_exhausted[r] ||
+					round.Eliminated != test.exp_eliminated[r] {
+					t.Errorf("Round %v: %v, want counts %v, exhausted %v, eliminated %v",
+						r, round, test.exp_counts[r], test.exp_exhausted[r], test.exp_eliminated[r])
+				}
+			}
+		})
+		data.Close()
+	}
+}
+
+func TestNumericSummary(t *testing.T) {
+	in := testsNumericSummary
+	for i, test := range in {
+
+		data, _ := DBInit("testNS" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			test.question.Question = "How much?"
+			p, err := NewPoll(data, &query.PollSchema{
+				Questions: []*query.PollSchema_QA{test.question},
+			}, 0)
+			if !reflect.DeepEqual(err, test.schema_err) {
+				t.Fatalf("Error %v, want error %v", err, test.schema_err)
+			}
+			if err != nil {
+				return
+			}
+			for j, v := range test.votes {
+				qa := proto.Clone(test.question).(*query.PollSchema_QA)
+				qa.Answers = v.answers
+				_, err := SaveVote(data, &query.VoteRequest{
+					Pollid: p.Id,
+					Answers: &query.PollSchema{
+						Questions: []*query.PollSchema_QA{qa},
+					},
+					Sign: &query.RSASignature{
+						Ballot: []byte("ballot" + strconv.Itoa(j)),
+						Sign:   []byte("sign"),
+					},
+					Nonce:  []byte("nonce"),
+					Weight: v.weight,
+				})
+				if (err == nil) != v.valid {
+					t.Errorf("Vote %v: error %v, want valid: %v", j, err, v.valid)
+				}
+			}
+
+			ps, err := GetSummary(data, 1)
+			if err != nil || len(ps.Numeric) != 1 {
+				t.Fatalf("Numeric results %v, want one result, error %v", ps.GetNumeric(), err)
+			}
+			res := ps.Numeric[0]
+			if res.Count != test.exp_count || math.Abs(res.Mean-test.exp_mean) > 1e-9 ||
+				math.Abs(res.Median-test.exp_median) > 1e-9 || math.Abs(res.Stddev-test.exp_stddev) > 1e-9 {
+				t.Errorf("Result %v, want count %v, mean %v, median %v, stddev %v",
+					res, test.exp_count, test.exp_mean, test.exp_median, test.exp_stddev)
+			}
+			var hist []int64
+			for _, bin := range res.Histogram {
+				hist = append(hist, bin.Count)
+			}
+			if !reflect.DeepEqual(hist, test.exp_hist) {
+				t.Errorf("Histogram %v, want %v", hist, test.exp_hist)
+			}
+		})
+		data.Close()
+	}
+}
+
+func TestNumericOverflow(t *testing.T) {
+	for i, test := range testsNumericOverflow {
+
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			res := numericStats(test.question, test.votes)
+			if res.Count != test.exp_count || len(res.Histogram) != 0 {
+				t.Errorf("Result %v, want count %v and no histogram", res, test.exp_count)
+			}
+		})
+	}
+}
+
+func TestSummaryMalformed(t *testing.T) {
+	in := testsSummaryMalformed
+	for i, test := range in {
+
+		data, _ := DBInit("testSM" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			p, _ := NewPoll(data, &query.PollSchema{
+				Questions: []*query.PollSchema_QA{
+					{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CHECKBOX},
+					{Question: "Why?", Type: query.PollSchema_OPEN},
+				},
+			}, 0)
+			// Store doesn't check answers against schema, server does it.
+			_, err := SaveVote(data, &query.VoteRequest{
+				Pollid:  p.Id,
+				Answers: &query.PollSchema{Questions: test.answers},
+				Sign: &query.RSASignature{
+					Ballot: []byte("ballot"),
+					Sign:   []byte("sign"),
+				},
+				Nonce: []byte("nonce"),
+			})
+			if err != nil {
+				t.Fatalf("SaveVote failed, error: %v", err)
+			}
+
+			ps, err := GetSummary(data, 1)
+			if err != nil || ps.VotesCount != test.exp_votes {
+				t.Errorf("Counted %v votes, want %v", ps.GetVotesCount(), test.exp_votes)
+				t.Errorf("Error %v, want nil error", err)
+			}
+		})
+		data.Close()
+	}
+}
+
+func TestBallotSummary(t *testing.T) {
+	in := testsBallotSummary
+	for i, test := range in {
+
+		data, _ := DBInit("testBS" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			p, _ := NewPoll(data, &query.PollSchema{
+				Questions: []*query.PollSchema_QA{
+					{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CHECKBOX},
+					{Question: "Why?", Type: query.PollSchema_OPEN},
+				},
+			}, 0)
+			// Votes in legacy form are counted together with ballots.
+			_, err := SaveVote(data, &query.VoteRequest{
+				Pollid: p.Id,
+				Answers: &query.PollSchema{
+					Questions: []*query.PollSchema_QA{
+						{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CHECKBOX, Answers: []string{"true", "true"}},
+						{Question: "Why?", Type: query.PollSchema_OPEN, Answers: []string{"Legacy"}},
+					},
+				},
+				Sign: &query.RSASignature{
+					Ballot: []byte("legacy"),
+					Sign:   []byte("sign"),
+				},
+				Nonce: []byte("nonce"),
+			})
+			if err != nil {
+				t.Fatalf("SaveVote failed, error: %v", err)
+			}
+
+			_, err = SaveVote(data, &query.VoteRequest{
+				Pollid: p.Id,
+				Ballot: test.ballot,
+				Sign: &query.RSASignature{
+					Ballot: []byte("ballot"),
+					Sign:   []byte("sign"),
+				},
+				Nonce: []byte("nonce"),
+			})
+			if (err != nil) != test.exp_err {
+				t.Fatalf("Error %v, want error: %v", err, test.exp_err)
+			}
+			if test.exp_err {
+				return
+			}
+
+			votes, err := GetVotes(data, 1)
+			if err != nil || len(votes) != 2 || !proto.Equal(votes[0].Ballot, test.ballot) {
+				t.Errorf("Votes %v, want ballot %v", votes, test.ballot)
+				t.Errorf("Error %v, want nil error", err)
+			}
+
+			ps, err := GetSummary(data, 1)
+			if err != nil || ps.VotesCount != 2 || !proto.Equal(&query.PollSchema{Questions: test.exp_out}, ps.Schema) {
+				t.Errorf("Output %v, want output %v", ps.GetSchema(), test.exp_out)
+				t.Errorf("Error %v, want nil error", err)
+			}
+		})
+		data.Close()
+	}
+}
+
+func TestConditionalSummary(t *testing.T) {
+	in := testsConditionalSummary
+	for i, test := range in {
+
+		data, _ := DBInit("testCS" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			p, _ := NewPoll(data, conditionalSchema, 0)
+			// Store doesn't check constraints, so skipped questions can be answered here.
+			for j, answers := range test.ballots {
+				_, err := SaveVote(data, &query.VoteRequest{
+					Pollid: p.Id,
+					Ballot: &query.Ballot{Version: query.BallotVersion, Answers: answers},
+					Sign: &query.RSASignature{
+						Ballot: []byte("ballot" + strconv.Itoa(j)),
+						Sign:   []byte("sign"),
+					},
+					Nonce: []byte("nonce"),
+				})
+				if err != nil {
+					t.Fatalf("SaveVote failed, error: %v", err)
+				}
+			}
+
+			ps, err := GetSummary(data, 1)
+			if err != nil || !reflect.DeepEqual(ps.Shown, test.exp_shown) {
+				t.Errorf("Shown %v, want %v", ps.GetShown(), test.exp_shown)
+				t.Errorf("Error %v, want nil error", err)
+			}
+			for j, qa := range ps.GetSchema().GetQuestions() {
+				if !reflect.DeepEqual(qa.Answers, test.exp_out[j]) {
+					t.Errorf("Answers to question %v: %v, want %v", j, qa.Answers, test.exp_out[j])
+				}
+			}
+		})
+		data.Close()
+	}
+}
+
+func TestOptionIDs(t *testing.T) {
+	in := testsOptionIDs
+	for i, test := range in {
+
+		data, _ := DBInit("testOI" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			p, err := NewPoll(data, &query.PollSchema{
+				Questions: []*query.PollSchema_QA{
+					{
+						Question:  "Choose",
+						Options:   []string{"a", "b", "c"},
+						Type:      query.PollSchema_CLOSE,
+						Shuffle:   true,
+						OptionIds: []int32{30, 10, 20},
+					},
+				},
+			}, 0)
+			if err != nil {
+				t.Fatalf("NewPoll failed, error: %v", err)
+			}
+			_, err = SaveVote(data, &query.VoteRequest{
+				Pollid: p.Id,
+				Ballot: test.ballot,
+				Sign: &query.RSASignature{
+					Ballot: []byte("ballot"),
+					Sign:   []byte("sign"),
+				},
+				Nonce: []byte("nonce"),
+			})
+			if (err != nil) != test.exp_err {
+				t.Fatalf("Error %v, want error: %v", err, test.exp_err)
+			}
+			if test.exp_err {
+				return
+			}
+
+			ps, err := GetSummary(data, 1)
+			if err != nil || !reflect.DeepEqual(ps.GetSchema().GetQuestions()[0].Answers, test.exp_out) {
+				t.Errorf("Output %v, want output %v", ps.GetSchema(), test.exp_out)
+				t.Errorf("Error %v, want nil error", err)
+			}
+		})
+		data.Close()
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	in := testsMetadata
+	for i, test := range in {
+
+		data, _ := DBInit("testMD" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			sch := &query.PollSchema{
+				Questions: []*query.PollSchema_QA{
+					{Question: "Where?", Options: []string{"pizza place", "bar"}, Type: query.PollSchema_CLOSE},
+				},
+			}
+			p, err := NewPollWithMetadata(data, sch, test.md, 0)
+			if !reflect.DeepEqual(err, test.exp_err) {
+				t.Fatalf("Error %v, want error %v", err, test.exp_err)
+			}
+			if err != nil {
+				return
+			}
+
+			md, err := GetMetadata(data, p.Number)
+			if err != nil {
+				t.Fatalf("GetMetadata failed, error: %v", err)
+			}
+			// Time of creation is set only in saved metadata.
+			if test.md != nil && (md.Created == 0 || test.md.Created != 0) {
+				t.Errorf("Created %v, want time of creation", md.Created)
+			}
+			md.Created = 0
+			exp := test.md
+			if exp == nil {
+				exp = &query.PollMetadata{}
+			}
+			if !proto.Equal(md, exp) {
+				t.Errorf("Output %v, want output %v", md, exp)
+			}
+		})
+		data.Close()
+	}
+}
+
+func TestSaveTemplate(t *testing.T) {
+	in := testsSaveTemplate
+	for i, test := range in {
+
+		data, _ := DBInit("testST" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			// Template saved earlier gets the first id.
+			SaveTemplate(data, &query.PollTemplate{Name: "First", Schema: &query.PollSchema{}}, []byte("Owner"))
+
+			tmpl, err := SaveTemplate(data, test.tmpl, []byte("Owner"))
+			if !reflect.DeepEqual(err, test.exp_err) {
+				t.Fatalf("Error %v, want error %v", err, test.exp_err)
+			}
+			if err != nil {
+				return
+			}
+			if tmpl.Id != 2 || tmpl.Created == 0 || test.tmpl.Id != 0 {
+				t.Errorf("Template %v, want id 2 and time of creation", tmpl)
+			}
+
+			if tmpl.Owner != nil {
+				t.Errorf("Template %v, want no owner", tmpl)
+			}
+			// Template of another owner gets the third id.
+			SaveTemplate(data, &query.PollTemplate{Name: "Other", Schema: &query.PollSchema{}}, []byte("Other"))
+
+			saved, err := GetTemplate(data, tmpl.Id, []byte("Owner"))
+			if err != nil || !proto.Equal(saved, tmpl) {
+				t.Errorf("Output %v, want output %v", saved, tmpl)
+				t.Errorf("Error %v, want nil error", err)
+			}
+			templates, err := ListTemplates(data, []byte("Owner"))
+			if err != nil || len(templates) != 2 || templates[0].Name != "First" || !proto.Equal(templates[1], tmpl) {
+				t.Errorf("Templates %v, want First and %v", templates, tmpl)
+				t.Errorf("Error %v, want nil error", err)
+			}
+			if _, err = GetTemplate(data, tmpl.Id, []byte("Other")); err == nil {
+				t.Errorf("Template found with key of another owner, want error")
+			}
+			if _, err = GetTemplate(data, 4, []byte("Owner")); err == nil {
+				t.Errorf("Template 4 found, want error")
+			}
+		})
+		data.Close()
+	}
+}
+
+// createListedPolls creates polls described by listedPolls.
+func createListedPolls(data *bolt.DB) error {
+	for _, p := range listedPolls {
+		if _, err := newPoll(data, &query.PollSchema{Listed: p.listed}, p.md, nil, ownerID(p.owner), 0); err != nil {
+			return err
+		}
+	}
+	_, err := SetState(data, 2, query.PollStatus_CLOSED)
+	return err
+}
+
+func TestListPolls(t *testing.T) {
+	in := testsListPolls
+	for i, test := range in {
+
+		data, _ := DBInit("testLP" + strconv.Itoa(i) + ".db")
+		t.Run("Test "+strconv.Itoa(i), func(t *testing.T) {
+			if err := createListedPolls(data); err != nil {
+				t.Fatalf("Creating polls failed, error: %v", err)
+			}
+			var owner []byte
+			if test.owner != "" {
+				owner = ownerID(test.owner)
+			}
+			list, err := ListPolls(data, test.req, owner)
+			if (err != nil) != test.exp_err {
+				t.Fatalf("Error %v, want error: %v", err, test.exp_err)
+			}
+			if err != nil {
+				return
+			}
+			var ids []int32
+			for _, pl := range list.Polls {
+				number, err := PollNumber(data, pl.Id)
+				if err != nil {
+					t.Errorf("Listed poll %v not found, error: %v", pl.Id, err)
+				}
+				ids = append(ids, number)
+			}
+			if !reflect.DeepEqual(ids, test.exp_ids) || list.NextPageToken != "" {
+				t.Errorf("Listed %v with next page %q, want %v", ids, list.NextPageToken, test.exp_ids)
+			}
+		})
+		data.Close()
+	}
+}
+
+func TestListPollsPages(t *testing.T) {
+	for size := 1; size <= 6; size++ {
+
+		data, _ := DBInit("testLPP" + strconv.Itoa(size) + ".db")
+		t.Run("Size "+strconv.Itoa(size), func(t *testing.T) {
+			if err := createListedPolls(data); err != nil {
+				t.Fatalf("Creating polls failed, error: %v", err)
+			}
+			// Poll10Bucket is before Poll2Bucket in PollsBucket, but polls
+			// are listed in order of creation.
+			var want []int32
+			for n := 1; n <= 12; n++ {
+				if n > len(listedPolls) {
+					NewPoll(data, &query.PollSchema{Listed: true}, 0)
+				} else if !listedPolls[n-1].listed {
+					continue
+				}
+				want = append(want, int32(n))
+			}
+			req := &query.ListPollsRequest{PageSize: int32(size)}
+			var ids []int32
+			for pages := 1; ; pages++ {
+				list, err := ListPolls(data, req, nil)
+				if err != nil || len(list.Polls) > size || pages > 12 {
+					t.Fatalf("Page %v: %v, error: %v", pages, list, err)
+				}
+				for _, pl := range list.Polls {
+					number, _ := PollNumber(data, pl.Id)
+					ids = append(ids, number)
+				}
+				if list.NextPageToken == "" {
+					break
+				}
+				// Page token doesn't reveal number of poll.
+				if last := list.Polls[len(list.Polls)-1]; list.NextPageToken != last.Id {
+					t.Errorf("Page token %q, want id of the last poll %v", list.NextPageToken, last.Id)
+				}
+				req.PageToken = list.NextPageToken
+			}
+			if !reflect.DeepEqual(ids, want) {
+				t.Errorf("Listed %v, want %v", ids, want)
+			}
+		})
+		data.Close()
+	}
+}
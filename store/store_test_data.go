@@ -4,7 +4,9 @@ import (
 	"crypto/rsa"
 	"fmt"
 	"github.com/ememak/Projekt-Rada/query"
+	"math"
 	"math/big"
+	"time"
 )
 
 var testsDBInit = []struct {
@@ -31,6 +33,7 @@ var testsDBInit = []struct {
 
 var testsNewPoll = []struct {
 	in      *query.PollSchema
+	tokens  int
 	exp_err error
 }{
 	{
@@ -46,6 +49,7 @@ var testsNewPoll = []struct {
 				},
 			},
 		},
+		tokens:  100,
 		exp_err: nil,
 	},
 	{
@@ -64,7 +68,7 @@ var testsNewPoll = []struct {
 			Questions: []*query.PollSchema_QA{
 				{
 					Question: "Valid question\n!@#$%",
-					Type:     5,
+					Type:     9,
 				},
 			},
 		},
@@ -87,8 +91,157 @@ var testsNewPoll = []struct {
 				},
 			},
 		},
+		tokens:  0,
 		exp_err: nil,
 	},
+	{
+		in:      &query.PollSchema{}, // test4 - positive, tokens saved in many batches
+		tokens:  2500,
+		exp_err: nil,
+	},
+	{
+		in:      &query.PollSchema{}, // test5 - negative, negative number of tokens
+		tokens:  -1,
+		exp_err: fmt.Errorf("Error! Negative number of tokens."),
+	},
+	{
+		in: &query.PollSchema{ // test6 - negative, minimum of selections above maximum
+			Questions: []*query.PollSchema_QA{
+				{
+					Question:      "Choose",
+					Options:       []string{"a", "b", "c"},
+					Type:          query.PollSchema_CHECKBOX,
+					MinSelections: 3,
+					MaxSelections: 2,
+				},
+			},
+		},
+		tokens:  100,
+		exp_err: fmt.Errorf("Error! Minimal number of selections is greater than maximal."),
+	},
+	{
+		in: &query.PollSchema{ // test7 - negative, more selections required than options
+			Questions: []*query.PollSchema_QA{
+				{
+					Question:      "Choose",
+					Options:       []string{"a", "b"},
+					Type:          query.PollSchema_CHECKBOX,
+					MinSelections: 3,
+				},
+			},
+		},
+		tokens:  100,
+		exp_err: fmt.Errorf("Error! Minimal number of selections is greater than number of options."),
+	},
+	{
+		in: &query.PollSchema{ // test8 - positive, sections and condition
+			Sections: []*query.PollSchema_Section{
+				{Title: "About you"},
+				{Title: "Pets", Description: "Only for pet owners."},
+			},
+			Questions: []*query.PollSchema_QA{
+				{Question: "Do you have a pet?", Options: []string{"yes", "no"}, Type: query.PollSchema_CLOSE},
+				{
+					Question: "Which pet?",
+					Type:     query.PollSchema_OPEN,
+					Section:  1,
+					ShowIf:   &query.PollSchema_Condition{Question: 0, Options: []int32{0}},
+				},
+			},
+		},
+		tokens:  10,
+		exp_err: nil,
+	},
+	{
+		in: &query.PollSchema{ // test9 - negative, nonexistent section
+			Sections: []*query.PollSchema_Section{{Title: "About you"}},
+			Questions: []*query.PollSchema_QA{
+				{Question: "Why?", Type: query.PollSchema_OPEN, Section: 1},
+			},
+		},
+		tokens:  10,
+		exp_err: fmt.Errorf("Error! Question belongs to nonexistent section."),
+	},
+	{
+		in: &query.PollSchema{ // test10 - negative, section split by another one
+			Sections: []*query.PollSchema_Section{{Title: "First"}, {Title: "Second"}},
+			Questions: []*query.PollSchema_QA{
+				{Question: "One", Type: query.PollSchema_OPEN, Section: 1},
+				{Question: "Two", Type: query.PollSchema_OPEN, Section: 0},
+			},
+		},
+		tokens:  10,
+		exp_err: fmt.Errorf("Error! Questions of one section have to be next to each other."),
+	},
+	{
+		in: &query.PollSchema{ // test11 - negative, condition refers to itself
+			Questions: []*query.PollSchema_QA{
+				{
+					Question: "Choose",
+					Options:  []string{"a", "b"},
+					Type:     query.PollSchema_CHECKBOX,
+					ShowIf:   &query.PollSchema_Condition{Question: 0, Options: []int32{0}},
+				},
+			},
+		},
+		tokens:  10,
+		exp_err: fmt.Errorf("Error! Condition has to refer to earlier question."),
+	},
+	{
+		in: &query.PollSchema{ // test12 - negative, condition refers to open question
+			Questions: []*query.PollSchema_QA{
+				{Question: "Why?", Type: query.PollSchema_OPEN},
+				{
+					Question: "Really?",
+					Type:     query.PollSchema_OPEN,
+					ShowIf:   &query.PollSchema_Condition{Question: 0, Options: []int32{0}},
+				},
+			},
+		},
+		tokens:  10,
+		exp_err: fmt.Errorf("Error! Condition has to refer to checkbox or closed question."),
+	},
+	{
+		in: &query.PollSchema{ // test13 - negative, condition refers to nonexistent option
+			Questions: []*query.PollSchema_QA{
+				{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CLOSE},
+				{
+					Question: "Why?",
+					Type:     query.PollSchema_OPEN,
+					ShowIf:   &query.PollSchema_Condition{Question: 0, Options: []int32{2}},
+				},
+			},
+		},
+		tokens:  10,
+		exp_err: fmt.Errorf("Error! Condition refers to nonexistent option."),
+	},
+	{
+		in: &query.PollSchema{ // test14 - negative, option ID repeated
+			Questions: []*query.PollSchema_QA{
+				{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CLOSE, OptionIds: []int32{7, 7}},
+			},
+		},
+		tokens:  10,
+		exp_err: fmt.Errorf("Error! Option ID repeated."),
+	},
+	{
+		in: &query.PollSchema{ // test15 - negative, not every option has ID
+			Questions: []*query.PollSchema_QA{
+				{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CLOSE, OptionIds: []int32{7}},
+			},
+		},
+		tokens:  10,
+		exp_err: fmt.Errorf("Error! Number of option IDs doesn't match number of options."),
+	},
+	{
+		in: &query.PollSchema{ // test16 - negative, open question shuffled
+			Questions: []*query.PollSchema_QA{
+				{Question: "Why?", Type: query.PollSchema_OPEN, Shuffle: true},
+			},
+		},
+		tokens:  10,
+		exp_err: fmt.Errorf("Error! Only options of checkbox and closed questions can be shuffled."),
+	},
 }
 
 var testsSaveKey = []struct {
@@ -123,6 +276,17 @@ var testsSaveKey = []struct {
 	},
 }
 
+var testsNewPollWithKey = []struct {
+	key     *rsa.PrivateKey
+	exp_err error
+}{
+	{ // test0 - nil key, negative
+		key:     nil,
+		exp_err: fmt.Errorf("Error! Private key is nil!"),
+	},
+	// test1 - positive, generated key is added in test
+}
+
 var testsAcceptToken = []struct {
 	token  string
 	pollid int32
@@ -141,7 +305,7 @@ var testsAcceptToken = []struct {
 		token:  "GoodToken",
 		pollid: 2,
 		st_err: fmt.Errorf("Poll ID does not exist in database. SaveToken: 2"),
-		gp_err: fmt.Errorf("Poll ID does not exist in database. GetPoll: 2"),
+		gp_err: fmt.Errorf("Poll ID does not exist in database. GetTokens: 2"),
 		at_err: fmt.Errorf("No such poll: 2"),
 	},
 	{ // test2 - negative, token can't be empty
@@ -160,6 +324,7 @@ var testsAcceptToken = []struct {
 	},
 }
 
+// Votes in tests without pollid are sent to the poll created by the test (see sentTo).
 var testsSaveVote = []struct {
 	in     *query.VoteRequest
 	reply  *query.VoteReply
@@ -168,7 +333,6 @@ var testsSaveVote = []struct {
 }{
 	{ // test0 - positive
 		in: &query.VoteRequest{
-			Pollid: 1,
 			Answers: &query.PollSchema{
 				Questions: []*query.PollSchema_QA{
 					{
@@ -195,7 +359,7 @@ var testsSaveVote = []struct {
 	},
 	{ // test1 - negative, wrong pollid
 		in: &query.VoteRequest{
-			Pollid: 2,
+			Pollid: "nosuchpoll",
 			Answers: &query.PollSchema{
 				Questions: []*query.PollSchema_QA{
 					{
@@ -216,12 +380,11 @@ var testsSaveVote = []struct {
 			},
 		},
 		reply:  &query.VoteReply{},
-		sv_err: fmt.Errorf("No such poll: 2"),
-		gp_err: fmt.Errorf("Poll ID does not exist in database. GetPoll: 2"),
+		sv_err: fmt.Errorf("No such poll: nosuchpoll"),
+		gp_err: nil,
 	},
 	{ // test2 - negative, wrong characters in answer
 		in: &query.VoteRequest{
-			Pollid: 1,
 			Answers: &query.PollSchema{
 				Questions: []*query.PollSchema_QA{
 					{
@@ -247,7 +410,6 @@ var testsSaveVote = []struct {
 	},
 	{ // test3 - positive
 		in: &query.VoteRequest{
-			Pollid: 1,
 			Answers: &query.PollSchema{
 				Questions: []*query.PollSchema_QA{
 					{
@@ -260,6 +422,7 @@ var testsSaveVote = []struct {
 				Ballot: []byte{123, 34, 56, 4, 19},
 				Sign:   []byte{23, 6, 3, 0, 8},
 			},
+			Nonce: []byte("0123456789abcdef"),
 		},
 		reply: &query.VoteReply{
 			Mess: "Thank you for your vote!",
@@ -269,7 +432,6 @@ var testsSaveVote = []struct {
 	},
 	{ // test4 - negative, wrong characters in answer
 		in: &query.VoteRequest{
-			Pollid: 1,
 			Answers: &query.PollSchema{
 				Questions: []*query.PollSchema_QA{
 					{
@@ -319,7 +481,6 @@ var testsGetSummary = []struct {
 			},
 		},
 		in: &query.VoteRequest{
-			Pollid: 1,
 			Answers: &query.PollSchema{
 				Questions: []*query.PollSchema_QA{
 					{
@@ -345,8 +506,9 @@ var testsGetSummary = []struct {
 		},
 		sv_err: nil,
 		gs_out: &query.PollSummary{
-			Id:         1,
-			VotesCount: 1,
+			VotesCount:   1,
+			WeightsCount: 1,
+			Shown:        []int32{1, 1},
 			Schema: &query.PollSchema{
 				Questions: []*query.PollSchema_QA{
 					{
@@ -366,3 +528,842 @@ var testsGetSummary = []struct {
 		gs_err: nil,
 	},
 }
+
+// In vote policy tests the same vote is saved twice.
+var testsSaveVotePolicy = []struct {
+	policy  query.PollSchema_VotePolicy
+	in      *query.VoteRequest
+	replies [2]*query.VoteReply
+	sv_errs [2]error
+	history int
+}{
+	{ // test0 - positive, vote is replaced
+		policy: query.PollSchema_REPLACE,
+		in: &query.VoteRequest{
+			Answers: &query.PollSchema{},
+			Sign: &query.RSASignature{
+				Ballot: []byte{1},
+				Sign:   []byte{1},
+			},
+		},
+		replies: [2]*query.VoteReply{
+			{
+				Mess:   "Thank you for your vote!",
+				Status: query.VoteReply_ACCEPTED,
+				Policy: query.PollSchema_REPLACE,
+			},
+			{
+				Mess:   "Thank you for your vote!",
+				Status: query.VoteReply_REPLACED,
+				Policy: query.PollSchema_REPLACE,
+			},
+		},
+		sv_errs: [2]error{nil, nil},
+		history: 0,
+	},
+	{ // test1 - negative, second vote is rejected
+		policy: query.PollSchema_REJECT,
+		in: &query.VoteRequest{
+			Answers: &query.PollSchema{},
+			Sign: &query.RSASignature{
+				Ballot: []byte{1},
+				Sign:   []byte{1},
+			},
+		},
+		replies: [2]*query.VoteReply{
+			{
+				Mess:   "Thank you for your vote!",
+				Status: query.VoteReply_ACCEPTED,
+				Policy: query.PollSchema_REJECT,
+			},
+			{},
+		},
+		sv_errs: [2]error{nil, fmt.Errorf("Vote with this signature was already saved")},
+		history: 0,
+	},
+	{ // test2 - positive, both votes are kept
+		policy: query.PollSchema_KEEP_ALL,
+		in: &query.VoteRequest{
+			Answers: &query.PollSchema{},
+			Sign: &query.RSASignature{
+				Ballot: []byte{1},
+				Sign:   []byte{1},
+			},
+		},
+		replies: [2]*query.VoteReply{
+			{
+				Mess:   "Thank you for your vote!",
+				Status: query.VoteReply_ACCEPTED,
+				Policy: query.PollSchema_KEEP_ALL,
+			},
+			{
+				Mess:   "Thank you for your vote!",
+				Status: query.VoteReply_APPENDED,
+				Policy: query.PollSchema_KEEP_ALL,
+			},
+		},
+		sv_errs: [2]error{nil, nil},
+		history: 2,
+	},
+}
+
+var testNow = time.Now().Unix()
+
+// In poll state tests states are changed one by one.
+var testsPollState = []struct {
+	schema   *query.PollSchema
+	initial  query.PollStatus_State
+	states   []query.PollStatus_State
+	exp_errs []error
+}{
+	{ // test0 - positive, poll goes through all states
+		schema:  &query.PollSchema{},
+		initial: query.PollStatus_OPEN,
+		states: []query.PollStatus_State{
+			query.PollStatus_CLOSED,
+			query.PollStatus_ARCHIVED,
+		},
+		exp_errs: []error{nil, nil},
+	},
+	{ // test1 - positive, scheduled poll is a draft, which is opened by hand
+		schema: &query.PollSchema{
+			Opens: testNow + 3600,
+		},
+		initial: query.PollStatus_DRAFT,
+		states: []query.PollStatus_State{
+			query.PollStatus_OPEN,
+			query.PollStatus_CLOSED,
+		},
+		exp_errs: []error{nil, nil},
+	},
+	{ // test2 - negative, poll is already closed by schedule
+		schema: &query.PollSchema{
+			Opens:  testNow - 7200,
+			Closes: testNow - 3600,
+		},
+		initial: query.PollStatus_CLOSED,
+		states: []query.PollStatus_State{
+			query.PollStatus_OPEN,
+			query.PollStatus_CLOSED,
+			query.PollStatus_ARCHIVED,
+		},
+		exp_errs: []error{
+			fmt.Errorf("Poll can't change state from CLOSED to OPEN"),
+			fmt.Errorf("Poll can't change state from CLOSED to CLOSED"),
+			nil,
+		},
+	},
+	{ // test3 - negative, poll can't go back to draft
+		schema: &query.PollSchema{
+			Opens: testNow - 3600,
+		},
+		initial: query.PollStatus_OPEN,
+		states: []query.PollStatus_State{
+			query.PollStatus_DRAFT,
+			query.PollStatus_ARCHIVED,
+		},
+		exp_errs: []error{
+			fmt.Errorf("Poll can't change state from OPEN to DRAFT"),
+			fmt.Errorf("Poll can't change state from OPEN to ARCHIVED"),
+		},
+	},
+}
+
+var testsCheckAdminKey = []struct {
+	pollid      int32
+	useAdminKey bool   // Check admin key returned by NewPoll.
+	key         string // Key checked otherwise.
+	exp_err     error
+}{
+	{ // test0 - positive
+		pollid:      1,
+		useAdminKey: true,
+		exp_err:     nil,
+	},
+	{ // test1 - negative, wrong key
+		pollid:  1,
+		key:     "Bad key",
+		exp_err: fmt.Errorf("Invalid admin key"),
+	},
+	{ // test2 - negative, empty key
+		pollid:  1,
+		key:     "",
+		exp_err: fmt.Errorf("Invalid admin key"),
+	},
+	{ // test3 - negative, no such poll
+		pollid:      2,
+		useAdminKey: true,
+		exp_err:     fmt.Errorf("No such poll: 2"),
+	},
+}
+
+var testsCheckOwner = []struct {
+	useOwnerKey bool   // Check owner key returned by NewOwner.
+	useAdminKey bool   // Check admin key of owner's poll.
+	key         string // Key checked otherwise.
+	exp_err     error
+}{
+	{ // test0 - positive
+		useOwnerKey: true,
+		exp_err:     nil,
+	},
+	{ // test1 - negative, admin key of owner's poll
+		useAdminKey: true,
+		exp_err:     fmt.Errorf("Invalid owner key"),
+	},
+	{ // test2 - negative, wrong key
+		key:     "Bad key",
+		exp_err: fmt.Errorf("Invalid owner key"),
+	},
+	{ // test3 - negative, empty key
+		key:     "",
+		exp_err: fmt.Errorf("Invalid owner key"),
+	},
+}
+
+var testsSaveTokens = []struct {
+	pollid  int32
+	tokens  []string
+	exp_err error
+}{
+	{ // test0 - positive
+		pollid:  1,
+		tokens:  []string{"token1", "token2"},
+		exp_err: nil,
+	},
+	{ // test1 - negative, used token can't be saved again
+		pollid:  1,
+		tokens:  []string{"token1", "Used token"},
+		exp_err: fmt.Errorf("Token already exists: Used token"),
+	},
+	{ // test2 - negative, duplicated token
+		pollid:  1,
+		tokens:  []string{"token1", "token1"},
+		exp_err: fmt.Errorf("Token already exists: token1"),
+	},
+	{ // test3 - negative, empty token
+		pollid:  1,
+		tokens:  []string{""},
+		exp_err: fmt.Errorf("key required"),
+	},
+	{ // test4 - negative, no such poll
+		pollid:  2,
+		tokens:  []string{"token1"},
+		exp_err: fmt.Errorf("Poll ID does not exist in database. SaveToken: 2"),
+	},
+}
+
+var testsRevokeToken = []struct {
+	token     string
+	legacy    []byte // Value of token saved in old format, if not nil.
+	used      bool
+	exp_err   error
+	exp_state query.TokenStatus_State
+	at_err    error // Error returned by AcceptToken after revoking.
+}{
+	{ // test0 - positive
+		token:     "Good token",
+		exp_err:   nil,
+		exp_state: query.TokenStatus_REVOKED,
+		at_err:    fmt.Errorf("Token was revoked"),
+	},
+	{ // test1 - negative, used token can't be revoked
+		token:     "Good token",
+		used:      true,
+		exp_err:   fmt.Errorf("Token was used before"),
+		exp_state: query.TokenStatus_USED,
+		at_err:    fmt.Errorf("Token was used before"),
+	},
+	{ // test2 - negative, no such token
+		token:     "Bad token",
+		exp_err:   fmt.Errorf("No such token"),
+		exp_state: query.TokenStatus_UNUSED,
+		at_err:    nil,
+	},
+	{ // test3 - positive, unused token in old format
+		token:     "Good token",
+		legacy:    []byte{1},
+		exp_err:   nil,
+		exp_state: query.TokenStatus_REVOKED,
+		at_err:    fmt.Errorf("Token was revoked"),
+	},
+	{ // test4 - negative, used token in old format
+		token:     "Good token",
+		legacy:    []byte{0},
+		exp_err:   fmt.Errorf("Token was used before"),
+		exp_state: query.TokenStatus_USED,
+		at_err:    fmt.Errorf("Token was used before"),
+	},
+}
+
+var testsWeightedVotes = []struct {
+	weights     []int32 // Weights of tokens, each token votes "yes".
+	exp_votes   int32
+	exp_weights int64
+	exp_yes     string
+}{
+	{ // test0 - positive, weight 1 counts as before
+		weights:     []int32{1, 1},
+		exp_votes:   2,
+		exp_weights: 2,
+		exp_yes:     "2",
+	},
+	{ // test1 - positive, different weights
+		weights:     []int32{1, 3, 10},
+		exp_votes:   3,
+		exp_weights: 14,
+		exp_yes:     "14",
+	},
+	{ // test2 - positive, weight 0 means 1
+		weights:     []int32{0, 2},
+		exp_votes:   2,
+		exp_weights: 3,
+		exp_yes:     "3",
+	},
+}
+
+// testVote is an answer to the only question of a poll, sent with given weight.
+type testVote struct {
+	answers []string
+	weight  int32
+	valid   bool
+}
+
+var testsRankedSummary = []struct {
+	votes          []testVote
+	exp_first      []string  // Counts of first preferences.
+	exp_counts     [][]int64 // Counts in each round.
+	exp_exhausted  []int64
+	exp_eliminated []int32
+	exp_winner     int32
+}{
+	{ // test0 - positive, winner after elimination
+		votes: []testVote{
+			{answers: []string{"0", "1", "2"}, valid: true},
+			{answers: []string{"0", "1", "2"}, valid: true},
+			{answers: []string{"0", "1", "2"}, valid: true},
+			{answers: []string{"0", "1", "2"}, valid: true},
+			{answers: []string{"1", "2", "0"}, valid: true},
+			{answers: []string{"1", "2", "0"}, valid: true},
+			{answers: []string{"1", "2", "0"}, valid: true},
+			{answers: []string{"2", "1", "0"}, valid: true},
+			{answers: []string{"2", "1", "0"}, valid: true},
+		},
+		exp_first:      []string{"4", "3", "2"},
+		exp_counts:     [][]int64{{4, 3, 2}, {4, 5, 0}},
+		exp_exhausted:  []int64{0, 0},
+		exp_eliminated: []int32{2, -1},
+		exp_winner:     1,
+	},
+	{ // test1 - positive, weighted majority in first round
+		votes: []testVote{
+			{answers: []string{"0", "1", "2"}, weight: 5, valid: true},
+			{answers: []string{"1", "0", "2"}, valid: true},
+			{answers: []string{"1", "0", "2"}, valid: true},
+		},
+		exp_first:      []string{"5", "2", "0"},
+		exp_counts:     [][]int64{{5, 2, 0}},
+		exp_exhausted:  []int64{0},
+		exp_eliminated: []int32{-1},
+		exp_winner:     0,
+	},
+	{ // test2 - positive, ties and vote without ranking
+		votes: []testVote{
+			{answers: []string{"0", "1", "2"}, valid: true},
+			{answers: []string{"1", "0", "2"}, valid: true},
+			{answers: []string{"", "", ""}, valid: true},
+		},
+		exp_first:      []string{"1", "1", "0"},
+		exp_counts:     [][]int64{{1, 1, 0}, {1, 1, 0}, {2, 0, 0}},
+		exp_exhausted:  []int64{1, 1, 1},
+		exp_eliminated: []int32{2, 1, -1},
+		exp_winner:     0,
+	},
+	{ // test3 - negative, rankings which are not permutations
+		votes: []testVote{
+			{answers: []string{"0", "0", "1"}, valid: false},
+			{answers: []string{"0", "1"}, valid: false},
+			{answers: []string{"0", "1", "3"}, valid: false},
+			{answers: []string{"0", "", "1"}, valid: false},
+		},
+		exp_first:      []string{"0", "0", "0"},
+		exp_counts:     [][]int64{{0, 0, 0}},
+		exp_exhausted:  []int64{0},
+		exp_eliminated: []int32{-1},
+		exp_winner:     -1,
+	},
+}
+
+var testsNumericSummary = []struct {
+	question   *query.PollSchema_QA
+	schema_err error
+	votes      []testVote
+	exp_count  int64
+	exp_mean   float64
+	exp_median float64
+	exp_stddev float64
+	exp_hist   []int64
+}{
+	{ // test0 - positive, scale with default step
+		question: &query.PollSchema_QA{
+			Type: query.PollSchema_SCALE,
+			Min:  1,
+			Max:  5,
+		},
+		votes: []testVote{
+			{answers: []string{"1"}, valid: true},
+			{answers: []string{"2"}, valid: true},
+			{answers: []string{"2"}, valid: true},
+			{answers: []string{"5"}, valid: true},
+			{answers: []string{""}, valid: true},
+			{answers: []string{"6"}, valid: false},
+			{answers: []string{"2.5"}, valid: false},
+		},
+		exp_count:  4,
+		exp_mean:   2.5,
+		exp_median: 2,
+		exp_stddev: 1.5,
+		exp_hist:   []int64{1, 2, 0, 0, 1},
+	},
+	{ // test1 - positive, weighted unbounded number
+		question: &query.PollSchema_QA{
+			Type: query.PollSchema_NUMBER,
+		},
+		votes: []testVote{
+			{answers: []string{"10"}, weight: 3, valid: true},
+			{answers: []string{"20"}, valid: true},
+		},
+		exp_count:  4,
+		exp_mean:   12.5,
+		exp_median: 10,
+		exp_stddev: 4.330127018922194,
+		exp_hist:   []int64{3, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+	},
+	{ // test2 - negative, answers outside of range or step
+		question: &query.PollSchema_QA{
+			Type: query.PollSchema_NUMBER,
+			Min:  0,
+			Max:  100,
+			Step: 0.5,
+		},
+		votes: []testVote{
+			{answers: []string{"50.5"}, valid: true},
+			{answers: []string{"50.25"}, valid: false},
+			{answers: []string{"-1"}, valid: false},
+			{answers: []string{"abc"}, valid: false},
+			{answers: []string{"NaN"}, valid: false},
+			{answers: []string{"1", "2"}, valid: false},
+		},
+		exp_count:  1,
+		exp_mean:   50.5,
+		exp_median: 50.5,
+		exp_stddev: 0,
+		exp_hist:   []int64{0, 0, 0, 0, 0, 1, 0, 0, 0, 0},
+	},
+	{ // test3 - positive, no votes
+		question: &query.PollSchema_QA{
+			Type: query.PollSchema_SCALE,
+			Min:  0,
+			Max:  10,
+			Step: 5,
+		},
+		exp_hist: []int64{0, 0, 0},
+	},
+	{ // test4 - negative, step doesn't divide scale
+		question: &query.PollSchema_QA{
+			Type: query.PollSchema_SCALE,
+			Min:  1,
+			Max:  5,
+			Step: 3,
+		},
+		schema_err: fmt.Errorf("Error! Range of scale is not a multiple of step."),
+	},
+	{ // test5 - negative, minimum greater than maximum
+		question: &query.PollSchema_QA{
+			Type: query.PollSchema_NUMBER,
+			Min:  5,
+			Max:  1,
+		},
+		schema_err: fmt.Errorf("Error! Minimum is greater than maximum."),
+	},
+	{ // test6 - negative, extreme answers to unbounded number
+		question: &query.PollSchema_QA{
+			Type: query.PollSchema_NUMBER,
+		},
+		votes: []testVote{
+			{answers: []string{"1.7e308"}, valid: false},
+			{answers: []string{"-1.7e308"}, valid: false},
+			{answers: []string{"1e6"}, valid: true},
+			{answers: []string{"-1e6"}, valid: true},
+		},
+		exp_count:  2,
+		exp_mean:   0,
+		exp_median: 0,
+		exp_stddev: 1e6,
+		exp_hist:   []int64{1, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+	},
+}
+
+// Extreme values of numeric votes, which could be saved before answers were bounded.
+var testsNumericOverflow = []struct {
+	question  *query.PollSchema_QA
+	votes     []numericVote
+	exp_count int64
+}{
+	{ // test0 - unbounded number
+		question:  &query.PollSchema_QA{Type: query.PollSchema_NUMBER},
+		votes:     []numericVote{{value: -1.7e308, weight: 1}, {value: 1.7e308, weight: 1}},
+		exp_count: 2,
+	},
+	{ // test1 - number bounded by extreme values
+		question:  &query.PollSchema_QA{Type: query.PollSchema_NUMBER, Min: -math.MaxFloat64, Max: math.MaxFloat64},
+		votes:     []numericVote{{value: -1.7e308, weight: 1}, {value: 0, weight: 2}},
+		exp_count: 3,
+	},
+}
+
+var testsSummaryMalformed = []struct {
+	answers   []*query.PollSchema_QA
+	exp_votes int32
+}{
+	{ // test0 - positive, matching vote is counted
+		answers: []*query.PollSchema_QA{
+			{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CHECKBOX, Answers: []string{"true", "false"}},
+			{Question: "Why?", Type: query.PollSchema_OPEN, Answers: []string{"Because"}},
+		},
+		exp_votes: 1,
+	},
+	{ // test1 - positive, open question without answer
+		answers: []*query.PollSchema_QA{
+			{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CHECKBOX, Answers: []string{"true", "false"}},
+			{Question: "Why?", Type: query.PollSchema_OPEN},
+		},
+		exp_votes: 1,
+	},
+	{ // test2 - negative, more questions than in schema
+		answers: []*query.PollSchema_QA{
+			{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CHECKBOX, Answers: []string{"true", "false"}},
+			{Question: "Why?", Type: query.PollSchema_OPEN, Answers: []string{"Because"}},
+			{Question: "Extra", Type: query.PollSchema_OPEN, Answers: []string{"Extra"}},
+		},
+		exp_votes: 0,
+	},
+	{ // test3 - negative, more answers than options
+		answers: []*query.PollSchema_QA{
+			{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CHECKBOX, Answers: []string{"true", "false", "true"}},
+			{Question: "Why?", Type: query.PollSchema_OPEN, Answers: []string{"Because"}},
+		},
+		exp_votes: 0,
+	},
+}
+
+var testsBallotSummary = []struct {
+	ballot  *query.Ballot
+	exp_err bool
+	exp_out []*query.PollSchema_QA
+}{
+	{ // test0 - positive, ballot is counted together with legacy vote
+		ballot: &query.Ballot{
+			Version: query.BallotVersion,
+			Answers: []*query.Ballot_Answer{
+				{Question: 0, Selected: []int32{1}},
+				{Question: 1, Text: "Because"},
+			},
+		},
+		exp_out: []*query.PollSchema_QA{
+			{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CHECKBOX, Answers: []string{"1", "2"}},
+			{Question: "Why?", Type: query.PollSchema_OPEN, Answers: []string{"Because", "Legacy"}},
+		},
+	},
+	{ // test1 - positive, unanswered questions are omitted
+		ballot: &query.Ballot{
+			Version: query.BallotVersion,
+		},
+		exp_out: []*query.PollSchema_QA{
+			{Question: "Choose", Options: []string{"a", "b"}, Type: query.PollSchema_CHECKBOX, Answers: []string{"1", "1"}},
+			{Question: "Why?", Type: query.PollSchema_OPEN, Answers: []string{"Legacy"}},
+		},
+	},
+	{ // test2 - negative, option out of range
+		ballot: &query.Ballot{
+			Version: query.BallotVersion,
+			Answers: []*query.Ballot_Answer{
+				{Question: 0, Selected: []int32{2}},
+			},
+		},
+		exp_err: true,
+	},
+	{ // test3 - negative, question out of range
+		ballot: &query.Ballot{
+			Version: query.BallotVersion,
+			Answers: []*query.Ballot_Answer{
+				{Question: 2, Text: "Extra"},
+			},
+		},
+		exp_err: true,
+	},
+	{ // test4 - negative, text answer to checkbox question
+		ballot: &query.Ballot{
+			Version: query.BallotVersion,
+			Answers: []*query.Ballot_Answer{
+				{Question: 0, Text: "a"},
+			},
+		},
+		exp_err: true,
+	},
+	{ // test5 - negative, unknown version
+		ballot: &query.Ballot{
+			Version: query.BallotVersion + 1,
+		},
+		exp_err: true,
+	},
+}
+
+// Second question is shown only to voters who chose yes, third one to voters who chose no.
+var conditionalSchema = &query.PollSchema{
+	Questions: []*query.PollSchema_QA{
+		{Question: "Do you have a pet?", Options: []string{"yes", "no"}, Type: query.PollSchema_CLOSE},
+		{
+			Question: "Which pet?",
+			Type:     query.PollSchema_OPEN,
+			ShowIf:   &query.PollSchema_Condition{Question: 0, Options: []int32{0}},
+		},
+		{
+			Question: "Why not?",
+			Options:  []string{"allergy", "no time"},
+			Type:     query.PollSchema_CHECKBOX,
+			ShowIf:   &query.PollSchema_Condition{Question: 0, Options: []int32{1}},
+		},
+	},
+}
+
+var testsConditionalSummary = []struct {
+	ballots   [][]*query.Ballot_Answer
+	exp_shown []int32
+	exp_out   [][]string // Answers of questions in summary.
+}{
+	{ // test0 - positive, every voter sees questions according to his answer
+		ballots: [][]*query.Ballot_Answer{
+			{{Question: 0, Selected: []int32{0}}, {Question: 1, Text: "Cat"}},
+			{{Question: 0, Selected: []int32{1}}, {Question: 2, Selected: []int32{0, 1}}},
+			{{Question: 0, Selected: []int32{1}}},
+		},
+		exp_shown: []int32{3, 1, 2},
+		exp_out:   [][]string{{"1", "2"}, {"Cat"}, {"1", "1"}},
+	},
+	{ // test1 - positive, answers to skipped questions are not counted
+		ballots: [][]*query.Ballot_Answer{
+			{{Question: 0, Selected: []int32{0}}, {Question: 2, Selected: []int32{0}}},
+			{{Question: 1, Text: "Dog"}},
+		},
+		exp_shown: []int32{2, 1, 0},
+		exp_out:   [][]string{{"1", "0"}, nil, {"0", "0"}},
+	},
+}
+
+var testsOptionIDs = []struct {
+	ballot  *query.Ballot
+	exp_err bool
+	exp_out []string // Counts of options in summary.
+}{
+	{ // test0 - positive, option selected by ID
+		ballot: &query.Ballot{
+			Version: query.BallotVersionIDs,
+			Answers: []*query.Ballot_Answer{{Question: 0, Selected: []int32{10}}},
+		},
+		exp_out: []string{"0", "1", "0"},
+	},
+	{ // test1 - positive, option selected by position in old ballot
+		ballot: &query.Ballot{
+			Version: query.BallotVersionPositions,
+			Answers: []*query.Ballot_Answer{{Question: 0, Selected: []int32{2}}},
+		},
+		exp_out: []string{"0", "0", "1"},
+	},
+	{ // test2 - negative, position is not an ID
+		ballot: &query.Ballot{
+			Version: query.BallotVersionIDs,
+			Answers: []*query.Ballot_Answer{{Question: 0, Selected: []int32{1}}},
+		},
+		exp_err: true,
+	},
+}
+
+var testsMetadata = []struct {
+	md      *query.PollMetadata
+	exp_err error
+}{
+	{ // test0 - positive, poll without metadata
+		md:      nil,
+		exp_err: nil,
+	},
+	{ // test1 - positive
+		md: &query.PollMetadata{
+			Title:       "Lunch",
+			Description: "Where do we go?\n\n*Vote until Friday.*",
+			Locale:      "en-US",
+			Author:      "Office",
+			Translations: []*query.PollMetadata_Translation{
+				{
+					Locale: "pl",
+					Title:  "Obiad",
+					Questions: []*query.PollMetadata_QuestionTranslation{
+						{Question: "Gdzie?", Options: []string{"pizzeria", "bar"}},
+					},
+				},
+			},
+		},
+		exp_err: nil,
+	},
+	{ // test2 - negative, invalid locale
+		md:      &query.PollMetadata{Title: "Lunch", Locale: "english"},
+		exp_err: fmt.Errorf("Error! Invalid locale \"english\"."),
+	},
+	{ // test3 - negative, locale translated twice
+		md: &query.PollMetadata{
+			Locale: "en",
+			Translations: []*query.PollMetadata_Translation{
+				{Locale: "EN"},
+			},
+		},
+		exp_err: fmt.Errorf("Error! Locale \"EN\" translated more than once."),
+	},
+	{ // test4 - negative, translation of options doesn't match question
+		md: &query.PollMetadata{
+			Locale: "en",
+			Translations: []*query.PollMetadata_Translation{
+				{
+					Locale: "pl",
+					Questions: []*query.PollMetadata_QuestionTranslation{
+						{Question: "Gdzie?", Options: []string{"pizzeria"}},
+					},
+				},
+			},
+		},
+		exp_err: fmt.Errorf("Error! Number of translated options doesn't match question 1."),
+	},
+	{ // test5 - negative, title with invalid characters
+		md:      &query.PollMetadata{Title: "Lunch\x00"},
+		exp_err: fmt.Errorf("Error! Metadata contains invalid characters."),
+	},
+}
+
+var testsSaveTemplate = []struct {
+	tmpl    *query.PollTemplate
+	exp_err error
+}{
+	{ // test0 - positive
+		tmpl: &query.PollTemplate{
+			Name: "Board vote",
+			Schema: &query.PollSchema{
+				Questions: []*query.PollSchema_QA{
+					{Question: "Do you accept the report?", Options: []string{"yes", "no"}, Type: query.PollSchema_CLOSE},
+				},
+			},
+			Metadata: &query.PollMetadata{Title: "Monthly board vote", Locale: "en"},
+		},
+		exp_err: nil,
+	},
+	{ // test1 - positive, template without metadata
+		tmpl: &query.PollTemplate{
+			Name:   "Empty",
+			Schema: &query.PollSchema{},
+		},
+		exp_err: nil,
+	},
+	{ // test2 - negative, template without name
+		tmpl: &query.PollTemplate{
+			Schema: &query.PollSchema{},
+		},
+		exp_err: fmt.Errorf("Error! Template name is empty or contains invalid characters."),
+	},
+	{ // test3 - negative, template without schema
+		tmpl: &query.PollTemplate{
+			Name: "Board vote",
+		},
+		exp_err: fmt.Errorf("Error! Template has no schema."),
+	},
+	{ // test4 - negative, invalid schema
+		tmpl: &query.PollTemplate{
+			Name: "Board vote",
+			Schema: &query.PollSchema{
+				Questions: []*query.PollSchema_QA{{Question: "Why?", Type: 9}},
+			},
+		},
+		exp_err: fmt.Errorf("Error! Wrong question type."),
+	},
+}
+
+// Polls listed in list tests, the second one is closed and the last one has no metadata.
+// Polls are owned by owners of given owner keys, authors of polls don't matter.
+// Only listed polls are listed to everyone.
+var listedPolls = []struct {
+	md     *query.PollMetadata
+	owner  string
+	listed bool
+}{
+	{md: &query.PollMetadata{Title: "Board vote", Author: "board"}, owner: "Board key", listed: true},
+	{md: &query.PollMetadata{Title: "Lunch", Author: "office"}, owner: "Office key", listed: true},
+	{md: &query.PollMetadata{Title: "Board elections", Author: "office"}, owner: "Board key"},
+	{md: &query.PollMetadata{Title: "Office party", Author: "office"}, owner: "Office key", listed: true},
+	{md: nil, owner: "Board key", listed: true},
+}
+
+var testsListPolls = []struct {
+	req     *query.ListPollsRequest
+	owner   string // Owner key of owner of listed polls.
+	exp_ids []int32
+	exp_err bool
+}{
+	{ // test0 - positive, all listed polls
+		req:     &query.ListPollsRequest{},
+		exp_ids: []int32{1, 2, 4, 5},
+	},
+	{ // test1 - positive, all polls of owner
+		req:     &query.ListPollsRequest{},
+		owner:   "Board key",
+		exp_ids: []int32{1, 3, 5},
+	},
+	{ // test2 - positive, title substring in any case
+		req:     &query.ListPollsRequest{Title: "BOARD"},
+		exp_ids: []int32{1},
+	},
+	{ // test3 - positive, closed polls
+		req:     &query.ListPollsRequest{States: []query.PollStatus_State{query.PollStatus_CLOSED}},
+		exp_ids: []int32{2},
+	},
+	{ // test4 - positive, polls created after given time
+		req:     &query.ListPollsRequest{CreatedAfter: 1},
+		exp_ids: []int32{1, 2, 4},
+	},
+	{ // test5 - positive, many filters
+		req: &query.ListPollsRequest{
+			Title:  "party",
+			States: []query.PollStatus_State{query.PollStatus_OPEN, query.PollStatus_DRAFT},
+		},
+		owner:   "Office key",
+		exp_ids: []int32{4},
+	},
+	{ // test6 - positive, no polls of owner
+		req:     &query.ListPollsRequest{},
+		owner:   "Nobody key",
+		exp_ids: nil,
+	},
+	{ // test7 - positive, owner's poll which is not listed
+		req:     &query.ListPollsRequest{Title: "elections"},
+		owner:   "Board key",
+		exp_ids: []int32{3},
+	},
+	{ // test8 - negative, invalid page token
+		req:     &query.ListPollsRequest{PageToken: "!!!"},
+		exp_err: true,
+	},
+	{ // test9 - negative, page token which is not an id of poll
+		req:     &query.ListPollsRequest{PageToken: "2"},
+		exp_err: true,
+	},
+	{ // test10 - negative, negative page size
+		req:     &query.ListPollsRequest{PageSize: -1},
+		exp_err: true,
+	},
+}
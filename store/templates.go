@@ -0,0 +1,111 @@
+package store
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ememak/Projekt-Rada/query"
+	"github.com/golang/protobuf/proto"
+	bolt "go.etcd.io/bbolt"
+)
+
+// SaveTemplate saves new template of polls owned by owner, which is an
+// identifier returned by NewOwner or CheckOwner.
+//
+// Schema and metadata of template have to be valid, like in NewPollWithMetadata.
+// Returned template is a copy of tmpl with id and time of creation set, owner
+// is saved only in database.
+func SaveTemplate(db *bolt.DB, tmpl *query.PollTemplate, owner []byte) (*query.PollTemplate, error) {
+	if tmpl.Name == "" || !query.IsStringPrintable(tmpl.Name) {
+		return nil, fmt.Errorf("Error! Template name is empty or contains invalid characters.")
+	}
+	if tmpl.Schema == nil {
+		return nil, fmt.Errorf("Error! Template has no schema.")
+	}
+	if err := tmpl.Schema.IsValid(); err != nil {
+		return nil, err
+	}
+	if tmpl.Metadata != nil {
+		if err := tmpl.Metadata.IsValid(tmpl.Schema); err != nil {
+			return nil, err
+		}
+	}
+
+	tmpl = proto.Clone(tmpl).(*query.PollTemplate)
+	tmpl.Created = time.Now().Unix()
+	tmpl.Owner = owner
+	err := db.Update(func(tx *bolt.Tx) error {
+		tbuck := tx.Bucket([]byte("TemplatesBucket"))
+		id, _ := tbuck.NextSequence()
+		tmpl.Id = int32(id)
+
+		bintmpl, err := proto.Marshal(tmpl)
+		if err != nil {
+			return err
+		}
+		return tbuck.Put([]byte(strconv.Itoa(int(id))), bintmpl)
+	})
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Owner = nil
+	return tmpl, nil
+}
+
+// GetTemplate reads template with given id owned by owner.
+//
+// Templates of other owners are reported as missing.
+func GetTemplate(db *bolt.DB, id int32, owner []byte) (*query.PollTemplate, error) {
+	tmpl := &query.PollTemplate{}
+	err := db.View(func(tx *bolt.Tx) error {
+		tbuck := tx.Bucket([]byte("TemplatesBucket"))
+		bintmpl := tbuck.Get([]byte(strconv.Itoa(int(id))))
+		if bintmpl == nil {
+			return fmt.Errorf("No such template: %v", id)
+		}
+		if err := proto.Unmarshal(bintmpl, tmpl); err != nil {
+			return fmt.Errorf("Failed to read template from database in GetTemplate: %w", err)
+		}
+		if !ownedBy(tmpl, owner) {
+			return fmt.Errorf("No such template: %v", id)
+		}
+		return nil
+	})
+	tmpl.Owner = nil
+	return tmpl, err
+}
+
+// ListTemplates reads all templates owned by owner, sorted by their ids.
+func ListTemplates(db *bolt.DB, owner []byte) ([]*query.PollTemplate, error) {
+	var templates []*query.PollTemplate
+	err := db.View(func(tx *bolt.Tx) error {
+		tbuck := tx.Bucket([]byte("TemplatesBucket"))
+		return tbuck.ForEach(func(k, v []byte) error {
+			tmpl := &query.PollTemplate{}
+			if err := proto.Unmarshal(v, tmpl); err != nil {
+				return fmt.Errorf("Failed to read template from database in ListTemplates: %w", err)
+			}
+			if ownedBy(tmpl, owner) {
+				tmpl.Owner = nil
+				templates = append(templates, tmpl)
+			}
+			return nil
+		})
+	})
+	// Keys are compared as strings, so "10" would be before "9".
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Id < templates[j].Id
+	})
+	return templates, err
+}
+
+// ownedBy checks if template is owned by owner.
+//
+// Templates saved before owners were introduced have no owner and are not
+// available to anyone.
+func ownedBy(tmpl *query.PollTemplate, owner []byte) bool {
+	return len(tmpl.Owner) > 0 && subtle.ConstantTimeCompare(tmpl.Owner, owner) == 1
+}
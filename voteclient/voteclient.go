@@ -0,0 +1,268 @@
+// Package voteclient implements client side of Rada voting protocol.
+//
+// It is a Go counterpart of the web application in client/app/vote and is meant
+// to be used by bots and integration tests. Whole protocol looks as follows:
+//   1. GetPoll - download questions and RSA public keys of a poll.
+//   2. GetTokenWeight - learn weight class of token, it selects the key.
+//      Token is sent with its signature, sig parameter of voting link.
+//   3. Calculate ballot as commitment to answers and random nonce,
+//      then blind it using bsign.Blind.
+//   4. SignBallot - exchange token for signed envelope.
+//   5. Remove blinding factor with bsign.Finalize, which also verifies sign.
+//   6. PollVote - send answers together with ballot, its sign and weight.
+// Answers can be sent either in compact form as query.Ballot (VoteBallot,
+// SendBallot, RevoteBallot) or in legacy form as whole schema with answers
+// (Vote, Send, Revote).
+package voteclient
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/ememak/Projekt-Rada/bsign"
+	"github.com/ememak/Projekt-Rada/query"
+	"google.golang.org/grpc"
+)
+
+// NonceSize is a number of random bytes in generated nonces.
+const NonceSize = 32
+
+// Client talks to Query service.
+type Client struct {
+	query query.QueryClient
+}
+
+// Poll contains data needed to vote in a poll.
+//
+// Keys maps weight classes to their keys, Key is a key of weight 1.
+type Poll struct {
+	Id     string
+	Key    *rsa.PublicKey
+	Keys   map[int32]*rsa.PublicKey
+	Schema *query.PollSchema
+}
+
+// New creates client using given connection to server.
+func New(cc grpc.ClientConnInterface) *Client {
+	return &Client{
+		query: query.NewQueryClient(cc),
+	}
+}
+
+// GetPoll downloads poll and its public key from server.
+func (c *Client) GetPoll(ctx context.Context, pollid string) (*Poll, error) {
+	pwk, err := c.query.GetPoll(ctx, &query.GetPollRequest{Pollid: pollid})
+	if err != nil {
+		return nil, fmt.Errorf("Error in GetPoll while requesting poll: %w", err)
+	}
+	key, err := x509.ParsePKCS1PublicKey(pwk.Key.GetKey())
+	if err != nil {
+		return nil, fmt.Errorf("Error in GetPoll while parsing key: %w", err)
+	}
+	keys := map[int32]*rsa.PublicKey{1: key}
+	for _, wk := range pwk.WeightedKeys {
+		k, err := x509.ParsePKCS1PublicKey(wk.Key.GetKey())
+		if err != nil {
+			return nil, fmt.Errorf("Error in GetPoll while parsing key of weight %v: %w", wk.Weight, err)
+		}
+		keys[wk.Weight] = k
+	}
+	return &Poll{
+		Id:     pollid,
+		Key:    key,
+		Keys:   keys,
+		Schema: pwk.Poll,
+	}, nil
+}
+
+// NewNonce generates random nonce used in ballot commitment.
+func NewNonce() ([]byte, error) {
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// Authorize gets sign of ballot from server.
+//
+// Ballot is blinded before sending, so server does not learn its value.
+// Token is used up, even if returned sign turns out to be invalid.
+// Function returns also weight of the token, which has to be sent with vote.
+// Sig is a signature of token from its voting link.
+func (c *Client) Authorize(ctx context.Context, poll *Poll, token, sig string, ballot []byte) (*query.RSASignature, int32, error) {
+	tw, err := c.query.GetTokenWeight(ctx, &query.TokenRequest{
+		Pollid: poll.Id,
+		Token:  token,
+		Sig:    sig,
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error in Authorize while requesting token weight: %w", err)
+	}
+	weight := tw.Weight
+	if weight < 1 {
+		weight = 1
+	}
+	key, ok := poll.Keys[weight]
+	if !ok {
+		return nil, 0, fmt.Errorf("Error in Authorize: poll has no key of weight %v", weight)
+	}
+
+	envelope, inv, err := bsign.Blind(key, ballot)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error in Authorize while blinding ballot: %w", err)
+	}
+
+	se, err := c.query.SignBallot(ctx, &query.EnvelopeToSign{
+		Envelope: envelope,
+		Pollid:   poll.Id,
+		Token:    token,
+		Sig:      sig,
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error in Authorize while signing ballot: %w", err)
+	}
+
+	sign, err := bsign.Finalize(key, ballot, se.Sign, inv)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error in Authorize while removing blinding factor: %w", err)
+	}
+	return &query.RSASignature{
+		Ballot: ballot,
+		Sign:   sign,
+	}, weight, nil
+}
+
+// Send sends signed answers to server.
+//
+// Signed ballot has to be equal to answers.Commitment(nonce).
+// Weight is a weight returned by Authorize.
+func (c *Client) Send(ctx context.Context, poll *Poll, answers *query.PollSchema, nonce []byte, sign *query.RSASignature, weight int32) (*query.VoteReply, error) {
+	vr, err := c.query.PollVote(ctx, &query.VoteRequest{
+		Pollid:  poll.Id,
+		Answers: answers,
+		Sign:    sign,
+		Nonce:   nonce,
+		Weight:  weight,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error in Send while sending vote: %w", err)
+	}
+	return vr, nil
+}
+
+// SendBallot sends signed ballot to server.
+//
+// Signed ballot has to be equal to b.Commitment(nonce).
+// Weight is a weight returned by Authorize.
+func (c *Client) SendBallot(ctx context.Context, poll *Poll, b *query.Ballot, nonce []byte, sign *query.RSASignature, weight int32) (*query.VoteReply, error) {
+	vr, err := c.query.PollVote(ctx, &query.VoteRequest{
+		Pollid: poll.Id,
+		Ballot: b,
+		Sign:   sign,
+		Nonce:  nonce,
+		Weight: weight,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error in SendBallot while sending vote: %w", err)
+	}
+	return vr, nil
+}
+
+// Revote changes answers of a vote sent earlier with sign.
+//
+// Revote key is a key returned by server with the first vote, answers don't
+// have to match signed ballot then. Weight is a weight returned by Authorize.
+func (c *Client) Revote(ctx context.Context, poll *Poll, answers *query.PollSchema, sign *query.RSASignature, weight int32, revoteKey []byte) (*query.VoteReply, error) {
+	nonce, err := NewNonce()
+	if err != nil {
+		return nil, fmt.Errorf("Error in Revote while generating nonce: %w", err)
+	}
+	vr, err := c.query.PollVote(ctx, &query.VoteRequest{
+		Pollid:    poll.Id,
+		Answers:   answers,
+		Sign:      sign,
+		Nonce:     nonce,
+		Weight:    weight,
+		RevoteKey: revoteKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error in Revote while sending vote: %w", err)
+	}
+	return vr, nil
+}
+
+// RevoteBallot changes answers of a vote sent earlier with sign to ballot b.
+//
+// Revote key is a key returned by server with the first vote, ballot doesn't
+// have to match signed one then. Weight is a weight returned by Authorize.
+func (c *Client) RevoteBallot(ctx context.Context, poll *Poll, b *query.Ballot, sign *query.RSASignature, weight int32, revoteKey []byte) (*query.VoteReply, error) {
+	nonce, err := NewNonce()
+	if err != nil {
+		return nil, fmt.Errorf("Error in RevoteBallot while generating nonce: %w", err)
+	}
+	vr, err := c.query.PollVote(ctx, &query.VoteRequest{
+		Pollid:    poll.Id,
+		Ballot:    b,
+		Sign:      sign,
+		Nonce:     nonce,
+		Weight:    weight,
+		RevoteKey: revoteKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error in RevoteBallot while sending vote: %w", err)
+	}
+	return vr, nil
+}
+
+// VoteBallot runs the whole protocol: votes in poll with given ballot using token.
+func (c *Client) VoteBallot(ctx context.Context, pollid string, token, sig string, b *query.Ballot) (*query.VoteReply, error) {
+	poll, err := c.GetPoll(ctx, pollid)
+	if err != nil {
+		return nil, fmt.Errorf("Error in VoteBallot: %w", err)
+	}
+
+	nonce, err := NewNonce()
+	if err != nil {
+		return nil, fmt.Errorf("Error in VoteBallot while generating nonce: %w", err)
+	}
+
+	sign, weight, err := c.Authorize(ctx, poll, token, sig, b.Commitment(nonce))
+	if err != nil {
+		return nil, fmt.Errorf("Error in VoteBallot: %w", err)
+	}
+
+	vr, err := c.SendBallot(ctx, poll, b, nonce, sign, weight)
+	if err != nil {
+		return nil, fmt.Errorf("Error in VoteBallot: %w", err)
+	}
+	return vr, nil
+}
+
+// Vote runs the whole protocol: votes in poll with given answers using token.
+func (c *Client) Vote(ctx context.Context, pollid string, token, sig string, answers *query.PollSchema) (*query.VoteReply, error) {
+	poll, err := c.GetPoll(ctx, pollid)
+	if err != nil {
+		return nil, fmt.Errorf("Error in Vote: %w", err)
+	}
+
+	nonce, err := NewNonce()
+	if err != nil {
+		return nil, fmt.Errorf("Error in Vote while generating nonce: %w", err)
+	}
+	ballot := answers.Commitment(nonce)
+
+	sign, weight, err := c.Authorize(ctx, poll, token, sig, ballot)
+	if err != nil {
+		return nil, fmt.Errorf("Error in Vote: %w", err)
+	}
+
+	vr, err := c.Send(ctx, poll, answers, nonce, sign, weight)
+	if err != nil {
+		return nil, fmt.Errorf("Error in Vote: %w", err)
+	}
+	return vr, nil
+}